@@ -0,0 +1,431 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// clientOptions are the flags of the client subcommands
+type clientOptions struct {
+	BrokerURL  string
+	Username   string
+	Password   string
+	Token      string
+	Insecure   bool
+	CAFile     string
+	APIVersion string
+	Timeout    int
+	Output     string
+
+	InstanceID        string
+	BindingID         string
+	ServiceID         string
+	PlanID            string
+	Params            string
+	Operation         string
+	AcceptsIncomplete bool
+}
+
+// fetchAPIVersion is the OSB version that added fetching instances and
+// bindings. The OSB client library stops at 2.13, so requests specific to
+// 2.14 are sent without it.
+const fetchAPIVersion = "2.14"
+
+// instanceResponse is the answer of the broker when fetching an instance
+type instanceResponse struct {
+	ServiceID    string                 `json:"service_id"`
+	PlanID       string                 `json:"plan_id"`
+	DashboardURL *string                `json:"dashboard_url,omitempty"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+}
+
+const clientUsage = `usage: %s client <command> [flags]
+
+Commands:
+  catalog          list the services and plans of the broker
+  provision        provision an instance
+  update           update the parameters of an instance
+  deprovision      deprovision an instance
+  bind             bind to an instance and print the credentials
+  unbind           delete a binding
+  get-instance     print an instance, as stored by the broker (OSB 2.14)
+  get-binding      print the credentials of an existing binding (OSB 2.14)
+  last-operation   print the state of the last operation on an instance
+
+Flags:
+`
+
+// runClient exercises a broker through the OSB API, as a platform would
+func runClient(args []string, out io.Writer) error {
+	o := clientOptions{}
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	fs.StringVar(&o.BrokerURL, "broker-url", "https://localhost:8443", "URL of the broker")
+	fs.StringVar(&o.Username, "username", os.Getenv("DATAVERSE_BROKER_USERNAME"), "username for HTTP basic auth")
+	fs.StringVar(&o.Password, "password", os.Getenv("DATAVERSE_BROKER_PASSWORD"), "password for HTTP basic auth")
+	fs.StringVar(&o.Token, "token", os.Getenv("DATAVERSE_BROKER_TOKEN"), "bearer token, instead of basic auth")
+	fs.BoolVar(&o.Insecure, "insecure-skip-verify", false, "don't verify the certificate of the broker")
+	fs.StringVar(&o.CAFile, "ca-file", "", "PEM file with the CA certificates used to verify the broker")
+	fs.StringVar(&o.APIVersion, "api-version", "2.13", "OSB API version to send: 2.11, 2.12, 2.13 or 2.14")
+	fs.IntVar(&o.Timeout, "timeout", 60, "request timeout, in seconds")
+	fs.StringVar(&o.Output, "output", "table", "output format: table or json")
+	fs.StringVar(&o.InstanceID, "instance-id", "", "ID of the instance")
+	fs.StringVar(&o.BindingID, "binding-id", "", "ID of the binding")
+	fs.StringVar(&o.ServiceID, "service-id", "", "ID of the service")
+	fs.StringVar(&o.PlanID, "plan-id", "", "ID of the plan")
+	fs.StringVar(&o.Params, "params", "", "parameters, as a JSON object")
+	fs.StringVar(&o.Operation, "operation", "", "operation key returned by an asynchronous request")
+	fs.BoolVar(&o.AcceptsIncomplete, "accepts-incomplete", false, "allow the broker to answer asynchronously")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, clientUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if len(args) == 0 {
+		fs.Usage()
+		return errors.New("missing client command")
+	}
+	command := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if o.Output != "table" && o.Output != "json" {
+		return fmt.Errorf("unknown output format %q", o.Output)
+	}
+
+	client, err := newOSBClient(&o)
+	if err != nil {
+		return err
+	}
+
+	var params map[string]interface{}
+	if o.Params != "" {
+		if err = json.Unmarshal([]byte(o.Params), &params); err != nil {
+			return fmt.Errorf("invalid --params: %v", err)
+		}
+	}
+
+	var response interface{}
+	switch command {
+	case "catalog":
+		if o.APIVersion == fetchAPIVersion {
+			// Only 2.14 catalogs say which services can be fetched
+			catalog := &osb.CatalogResponse{}
+			response, err = catalog, brokerGet(&o, "/v2/catalog", catalog)
+		} else {
+			response, err = client.GetCatalog()
+		}
+	case "provision":
+		if err = requireFlags(map[string]string{"instance-id": o.InstanceID, "service-id": o.ServiceID, "plan-id": o.PlanID}); err != nil {
+			return err
+		}
+		response, err = client.ProvisionInstance(&osb.ProvisionRequest{
+			InstanceID:        o.InstanceID,
+			ServiceID:         o.ServiceID,
+			PlanID:            o.PlanID,
+			AcceptsIncomplete: o.AcceptsIncomplete,
+			Parameters:        params,
+			// Brokers may require the IDs of the platform, these are unused
+			OrganizationGUID: "dataverse-broker-client",
+			SpaceGUID:        "dataverse-broker-client",
+		})
+	case "update":
+		if err = requireFlags(map[string]string{"instance-id": o.InstanceID, "service-id": o.ServiceID}); err != nil {
+			return err
+		}
+		request := &osb.UpdateInstanceRequest{
+			InstanceID:        o.InstanceID,
+			ServiceID:         o.ServiceID,
+			AcceptsIncomplete: o.AcceptsIncomplete,
+			Parameters:        params,
+		}
+		if o.PlanID != "" {
+			request.PlanID = &o.PlanID
+		}
+		response, err = client.UpdateInstance(request)
+	case "deprovision":
+		if err = requireFlags(map[string]string{"instance-id": o.InstanceID, "service-id": o.ServiceID, "plan-id": o.PlanID}); err != nil {
+			return err
+		}
+		response, err = client.DeprovisionInstance(&osb.DeprovisionRequest{
+			InstanceID:        o.InstanceID,
+			ServiceID:         o.ServiceID,
+			PlanID:            o.PlanID,
+			AcceptsIncomplete: o.AcceptsIncomplete,
+		})
+	case "bind":
+		if err = requireFlags(map[string]string{"instance-id": o.InstanceID, "binding-id": o.BindingID, "service-id": o.ServiceID, "plan-id": o.PlanID}); err != nil {
+			return err
+		}
+		response, err = client.Bind(&osb.BindRequest{
+			BindingID:         o.BindingID,
+			InstanceID:        o.InstanceID,
+			ServiceID:         o.ServiceID,
+			PlanID:            o.PlanID,
+			AcceptsIncomplete: o.AcceptsIncomplete,
+			Parameters:        params,
+		})
+	case "unbind":
+		if err = requireFlags(map[string]string{"instance-id": o.InstanceID, "binding-id": o.BindingID, "service-id": o.ServiceID, "plan-id": o.PlanID}); err != nil {
+			return err
+		}
+		response, err = client.Unbind(&osb.UnbindRequest{
+			BindingID:         o.BindingID,
+			InstanceID:        o.InstanceID,
+			ServiceID:         o.ServiceID,
+			PlanID:            o.PlanID,
+			AcceptsIncomplete: o.AcceptsIncomplete,
+		})
+	case "get-instance":
+		if err = requireFlags(map[string]string{"instance-id": o.InstanceID}); err != nil {
+			return err
+		}
+		instance := &instanceResponse{}
+		response, err = instance, brokerGet(&o, "/v2/service_instances/"+url.PathEscape(o.InstanceID), instance)
+	case "get-binding":
+		if err = requireFlags(map[string]string{"instance-id": o.InstanceID, "binding-id": o.BindingID}); err != nil {
+			return err
+		}
+		binding := &osb.GetBindingResponse{}
+		response, err = binding, brokerGet(&o, "/v2/service_instances/"+url.PathEscape(o.InstanceID)+"/service_bindings/"+url.PathEscape(o.BindingID), binding)
+	case "last-operation":
+		if err = requireFlags(map[string]string{"instance-id": o.InstanceID}); err != nil {
+			return err
+		}
+		request := &osb.LastOperationRequest{InstanceID: o.InstanceID}
+		if o.ServiceID != "" {
+			request.ServiceID = &o.ServiceID
+		}
+		if o.PlanID != "" {
+			request.PlanID = &o.PlanID
+		}
+		if o.Operation != "" {
+			key := osb.OperationKey(o.Operation)
+			request.OperationKey = &key
+		}
+		response, err = client.PollLastOperation(request)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown client command %q", command)
+	}
+	if err != nil {
+		return err
+	}
+
+	if o.Output == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(response)
+	}
+	return printTable(out, response)
+}
+
+func newOSBClient(o *clientOptions) (osb.Client, error) {
+	config := osb.DefaultClientConfiguration()
+	config.Name = "dataverse-broker-client"
+	config.URL = o.BrokerURL
+	config.TimeoutSeconds = o.Timeout
+
+	switch o.APIVersion {
+	case "2.11":
+		config.APIVersion = osb.Version2_11()
+	case "2.12":
+		config.APIVersion = osb.Version2_12()
+	case "2.13", fetchAPIVersion:
+		config.APIVersion = osb.Version2_13()
+		// Asynchronous bindings are alpha features of the library
+		config.EnableAlphaFeatures = true
+	default:
+		return nil, fmt.Errorf("unsupported API version %q", o.APIVersion)
+	}
+
+	if o.Token != "" {
+		config.AuthConfig = &osb.AuthConfig{BearerConfig: &osb.BearerConfig{Token: o.Token}}
+	} else if o.Username != "" {
+		config.AuthConfig = &osb.AuthConfig{BasicAuthConfig: &osb.BasicAuthConfig{
+			Username: o.Username,
+			Password: o.Password,
+		}}
+	}
+
+	tlsConfig, err := newTLSConfig(o)
+	if err != nil {
+		return nil, err
+	}
+	config.TLSConfig = tlsConfig
+
+	return osb.NewClient(config)
+}
+
+// newTLSConfig is how the client verifies the broker
+func newTLSConfig(o *clientOptions) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: o.Insecure}
+	if o.CAFile == "" {
+		return config, nil
+	}
+	if o.Insecure {
+		return nil, errors.New("--ca-file can't be used with --insecure-skip-verify")
+	}
+
+	caData, err := ioutil.ReadFile(o.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no certificate found in %s", o.CAFile)
+	}
+	return config, nil
+}
+
+// brokerGet sends a GET request of the 2.14 API, which the OSB client library
+// doesn't know, with the authentication and TLS settings of the client
+func brokerGet(o *clientOptions, path string, into interface{}) error {
+	tlsConfig, err := newTLSConfig(o)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimRight(o.BrokerURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(osb.APIVersionHeader, fetchAPIVersion)
+	if o.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+o.Token)
+	} else if o.Username != "" {
+		req.SetBasicAuth(o.Username, o.Password)
+	}
+
+	client := &http.Client{
+		Timeout:   time.Duration(o.Timeout) * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		httpErr := osb.HTTPStatusCodeError{StatusCode: resp.StatusCode}
+		var failure struct {
+			Error       *string `json:"error"`
+			Description *string `json:"description"`
+		}
+		if json.Unmarshal(body, &failure) == nil {
+			httpErr.ErrorMessage = failure.Error
+			httpErr.Description = failure.Description
+		}
+		return httpErr
+	}
+	return json.Unmarshal(body, into)
+}
+
+func requireFlags(flags map[string]string) error {
+	missing := make([]string, 0)
+	for name, value := range flags {
+		if value == "" {
+			missing = append(missing, "--"+name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	sort.Strings(missing)
+	return fmt.Errorf("missing required flags: %v", missing)
+}
+
+// printTable prints a response of the broker as aligned columns
+func printTable(out io.Writer, response interface{}) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+
+	switch r := response.(type) {
+	case *osb.CatalogResponse:
+		fmt.Fprintln(w, "SERVICE\tSERVICE ID\tPLAN\tPLAN ID\tDESCRIPTION")
+		for _, service := range r.Services {
+			for _, plan := range service.Plans {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", service.Name, service.ID, plan.Name, plan.ID, service.Description)
+			}
+		}
+	case *osb.ProvisionResponse:
+		fmt.Fprintln(w, "ASYNC\tOPERATION\tDASHBOARD URL")
+		fmt.Fprintf(w, "%t\t%s\t%s\n", r.Async, operationKey(r.OperationKey), stringValue(r.DashboardURL))
+	case *osb.UpdateInstanceResponse:
+		fmt.Fprintln(w, "ASYNC\tOPERATION")
+		fmt.Fprintf(w, "%t\t%s\n", r.Async, operationKey(r.OperationKey))
+	case *osb.DeprovisionResponse:
+		fmt.Fprintln(w, "ASYNC\tOPERATION")
+		fmt.Fprintf(w, "%t\t%s\n", r.Async, operationKey(r.OperationKey))
+	case *osb.BindResponse:
+		printCredentials(w, r.Credentials)
+	case *osb.GetBindingResponse:
+		printCredentials(w, r.Credentials)
+	case *instanceResponse:
+		params, _ := json.Marshal(r.Parameters)
+		fmt.Fprintln(w, "SERVICE ID\tPLAN ID\tDASHBOARD URL\tPARAMETERS")
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.ServiceID, r.PlanID, stringValue(r.DashboardURL), params)
+	case *osb.UnbindResponse:
+		fmt.Fprintln(w, "ASYNC")
+		fmt.Fprintf(w, "%t\n", r.Async)
+	case *osb.LastOperationResponse:
+		fmt.Fprintln(w, "STATE\tDESCRIPTION")
+		fmt.Fprintf(w, "%s\t%s\n", r.State, stringValue(r.Description))
+	default:
+		return fmt.Errorf("unable to print %T as a table", response)
+	}
+
+	return w.Flush()
+}
+
+// printCredentials prints binding credentials sorted by key, values that
+// aren't strings as JSON
+func printCredentials(w io.Writer, credentials map[string]interface{}) {
+	fmt.Fprintln(w, "CREDENTIAL\tVALUE")
+	keys := make([]string, 0, len(credentials))
+	for key := range credentials {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := credentials[key]
+		if _, ok := value.(string); !ok {
+			data, _ := json.Marshal(value)
+			value = string(data)
+		}
+		fmt.Fprintf(w, "%s\t%v\n", key, value)
+	}
+}
+
+func operationKey(key *osb.OperationKey) string {
+	if key == nil {
+		return ""
+	}
+	return string(*key)
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// clientRequest is what the fake broker saw of a request
+type clientRequest struct {
+	Method            string
+	Path              string
+	APIVersion        string
+	AcceptsIncomplete string
+	Authorization     string
+}
+
+// newFakeBroker answers the OSB API with canned responses and records the
+// requests it gets
+func newFakeBroker() (*httptest.Server, func() []clientRequest) {
+	var (
+		lock     sync.Mutex
+		requests []clientRequest
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests = append(requests, clientRequest{
+			Method:            r.Method,
+			Path:              r.URL.Path,
+			APIVersion:        r.Header.Get(osb.APIVersionHeader),
+			AcceptsIncomplete: r.URL.Query().Get("accepts_incomplete"),
+			Authorization:     r.Header.Get("Authorization"),
+		})
+		lock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		write := func(code int, body interface{}) {
+			w.WriteHeader(code)
+			json.NewEncoder(w).Encode(body)
+		}
+
+		switch {
+		case r.URL.Path == "/v2/catalog":
+			write(http.StatusOK, map[string]interface{}{"services": []interface{}{map[string]interface{}{
+				"id": "service1", "name": "test-dataverse", "description": "Test Dataverse", "bindable": true,
+				"bindings_retrievable": r.Header.Get(osb.APIVersionHeader) == "2.14",
+				"plans":                []interface{}{map[string]interface{}{"id": "plan1", "name": "default", "description": "Default"}},
+			}}})
+		case r.URL.Path == "/v2/service_instances/i1" && r.Method == "GET":
+			write(http.StatusOK, map[string]interface{}{"service_id": "service1", "plan_id": "plan1", "parameters": map[string]interface{}{"version": "1.0"}})
+		case r.URL.Path == "/v2/service_instances/missing" && r.Method == "GET":
+			write(http.StatusNotFound, map[string]interface{}{"description": "Instance not found"})
+		case r.URL.Path == "/v2/service_instances/i1/service_bindings/b1" && r.Method == "PUT":
+			write(http.StatusCreated, map[string]interface{}{"credentials": map[string]interface{}{"coordinates": "https://demo.dataverse.org/dataverse/test", "files": 2}})
+		case r.URL.Path == "/v2/service_instances/i1/service_bindings/b1" && r.Method == "GET":
+			write(http.StatusOK, map[string]interface{}{"credentials": map[string]interface{}{"coordinates": "https://demo.dataverse.org/dataverse/test"}})
+		case r.URL.Path == "/v2/service_instances/i1/service_bindings/b1" && r.Method == "DELETE":
+			write(http.StatusOK, map[string]interface{}{})
+		case r.URL.Path == "/v2/service_instances/i1" && r.Method == "PUT":
+			write(http.StatusAccepted, map[string]interface{}{"operation": "provision-i1"})
+		default:
+			write(http.StatusNotFound, map[string]interface{}{})
+		}
+	}))
+
+	return server, func() []clientRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]clientRequest{}, requests...)
+	}
+}
+
+// Check the client sends the requests of each command, and prints the
+// answers of the broker
+func TestClient(t *testing.T) {
+
+	server, requests := newFakeBroker()
+	defer server.Close()
+
+	run := func(args ...string) (string, error) {
+		out := &bytes.Buffer{}
+		args = append(args, "--broker-url", server.URL, "--username", "admin", "--password", "secret")
+		err := runClient(args, out)
+		return out.String(), err
+	}
+	last := func() clientRequest {
+		all := requests()
+		return all[len(all)-1]
+	}
+
+	out, err := run("catalog")
+	if err != nil {
+		t.Fatalf("Error on catalog: %#+v\n", err)
+	}
+	if !strings.Contains(out, "test-dataverse") || !strings.Contains(out, "plan1") {
+		t.Errorf("Error printing catalog: %s\n", out)
+	}
+	if request := last(); request.APIVersion != "2.13" || !strings.HasPrefix(request.Authorization, "Basic ") {
+		t.Errorf("Error in catalog request: %#+v\n", request)
+	}
+
+	out, err = run("catalog", "--api-version", "2.14", "--output", "json")
+	if err != nil {
+		t.Fatalf("Error on 2.14 catalog: %#+v\n", err)
+	}
+	if request := last(); request.APIVersion != "2.14" {
+		t.Errorf("Error in 2.14 catalog request: expected version 2.14, got %#+v\n", request)
+	}
+	if !strings.Contains(out, `"bindings_retrievable": true`) {
+		t.Errorf("Error printing 2.14 catalog: %s\n", out)
+	}
+
+	if _, err = run("catalog", "--api-version", "2.15"); err == nil {
+		t.Errorf("Error on catalog with unsupported version: expected an error\n")
+	}
+
+	out, err = run("provision", "--instance-id", "i1", "--service-id", "service1", "--plan-id", "plan1", "--accepts-incomplete")
+	if err != nil {
+		t.Fatalf("Error on provision: %#+v\n", err)
+	}
+	if !strings.Contains(out, "provision-i1") {
+		t.Errorf("Error printing provision: %s\n", out)
+	}
+	if request := last(); request.AcceptsIncomplete != "true" {
+		t.Errorf("Error in provision request: expected accepts_incomplete, got %#+v\n", request)
+	}
+
+	out, err = run("bind", "--instance-id", "i1", "--binding-id", "b1", "--service-id", "service1", "--plan-id", "plan1", "--accepts-incomplete")
+	if err != nil {
+		t.Fatalf("Error on bind: %#+v\n", err)
+	}
+	if request := last(); request.Method != "PUT" || request.AcceptsIncomplete != "true" {
+		t.Errorf("Error in bind request: expected accepts_incomplete, got %#+v\n", request)
+	}
+	if !strings.Contains(out, "coordinates  https://demo.dataverse.org/dataverse/test") || !strings.Contains(out, "files        2") {
+		t.Errorf("Error printing credentials: %s\n", out)
+	}
+
+	if _, err = run("unbind", "--instance-id", "i1", "--binding-id", "b1", "--service-id", "service1", "--plan-id", "plan1", "--accepts-incomplete"); err != nil {
+		t.Fatalf("Error on unbind: %#+v\n", err)
+	}
+	if request := last(); request.Method != "DELETE" || request.AcceptsIncomplete != "true" {
+		t.Errorf("Error in unbind request: expected accepts_incomplete, got %#+v\n", request)
+	}
+
+	out, err = run("get-instance", "--instance-id", "i1", "--token", "secret-token")
+	if err != nil {
+		t.Fatalf("Error on get-instance: %#+v\n", err)
+	}
+	if request := last(); request.APIVersion != "2.14" || request.Authorization != "Bearer secret-token" {
+		t.Errorf("Error in get-instance request: %#+v\n", request)
+	}
+	if !strings.Contains(out, `{"version":"1.0"}`) {
+		t.Errorf("Error printing instance: %s\n", out)
+	}
+
+	if out, err = run("get-binding", "--instance-id", "i1", "--binding-id", "b1"); err != nil {
+		t.Fatalf("Error on get-binding: %#+v\n", err)
+	}
+	if !strings.Contains(out, "coordinates  https://demo.dataverse.org/dataverse/test") {
+		t.Errorf("Error printing binding: %s\n", out)
+	}
+
+	_, err = run("get-instance", "--instance-id", "missing")
+	if httpErr, ok := osb.IsHTTPError(err); !ok || httpErr.StatusCode != http.StatusNotFound || httpErr.Description == nil || *httpErr.Description != "Instance not found" {
+		t.Errorf("Error on get-instance of missing instance: expected 404, got %#+v\n", err)
+	}
+
+	count := len(requests())
+	if _, err = run("bind", "--instance-id", "i1"); err == nil || !strings.Contains(err.Error(), "--binding-id --plan-id --service-id") {
+		t.Errorf("Error on bind without flags: expected the missing flags, got %#+v\n", err)
+	}
+	if _, err = run("catalog", "--output", "yaml"); err == nil {
+		t.Errorf("Error on catalog with unknown output: expected an error\n")
+	}
+	if len(requests()) != count {
+		t.Errorf("Error on invalid commands: expected no request to the broker\n")
+	}
+}
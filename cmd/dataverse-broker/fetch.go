@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dataverse-broker/dataverse-broker/pkg/broker"
+)
+
+// fetchOptions are the flags of the fetch subcommand
+type fetchOptions struct {
+	BindingDir string
+	Dest       string
+	Parallel   int
+	Retries    int
+}
+
+// binding is what fetch reads from the mounted binding credentials
+type binding struct {
+	ServerUrl string
+	Token     string
+	Dataverse string
+	Dataset   string
+	// Version of the dataset the binding is pinned to
+	Version string
+	// Set when the broker serves the files through its data proxy
+	ProxyURL   string
+	ProxyToken string
+	// Set when the files are downloaded through signed links, which
+	// expire and are refreshed from the manifest
+	ManifestURL   string
+	ManifestToken string
+}
+
+// authorize adds the binding's credential to a request for a file. Signed
+// links need none.
+func (b *binding) authorize(req *http.Request) {
+	switch {
+	case b.ManifestURL != "":
+	case b.ProxyToken != "":
+		req.Header.Set("Authorization", "Bearer "+b.ProxyToken)
+	case b.Token != "":
+		req.Header.Set("X-Dataverse-key", b.Token)
+	}
+}
+
+// signedLinkMargin is how long before they expire signed links are refreshed
+const signedLinkMargin = time.Minute
+
+// signedLinks are the links to the files of a binding with signed links,
+// refreshed from its manifest before they expire
+type signedLinks struct {
+	sync.Mutex
+	b       *binding
+	urls    map[int]string
+	expires time.Time
+}
+
+// link returns a valid link to a file
+func (l *signedLinks) link(file broker.ManifestFile) (string, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.urls == nil || time.Now().Add(signedLinkMargin).After(l.expires) {
+		files, expires, err := manifestFiles(l.b.ManifestURL, l.b.ManifestToken)
+		if err != nil {
+			return "", err
+		}
+		l.urls = map[int]string{}
+		for _, f := range files {
+			l.urls[f.FileID] = f.DownloadURL
+		}
+		l.expires = expires
+	}
+
+	link, ok := l.urls[file.FileID]
+	if !ok {
+		return "", errors.New("no longer in the binding's manifest")
+	}
+	return link, nil
+}
+
+// runFetch downloads the files of a bound dataverse or dataset to a local
+// directory, skipping those already there, e.g. from an init container
+func runFetch(args []string, out io.Writer) error {
+	o := fetchOptions{}
+	fs := flag.NewFlagSet("fetch", flag.ContinueOnError)
+	fs.StringVar(&o.BindingDir, "binding-dir", "/etc/binding", "directory where the binding credentials are mounted, one file per key")
+	fs.StringVar(&o.Dest, "dest", "/data", "directory to download the files to")
+	fs.IntVar(&o.Parallel, "parallel", 4, "number of files downloaded at once")
+	fs.IntVar(&o.Retries, "retries", 3, "attempts per file, interrupted downloads are resumed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if o.Parallel < 1 || o.Retries < 1 {
+		return errors.New("--parallel and --retries must be at least 1")
+	}
+
+	b, err := readBinding(o.BindingDir)
+	if err != nil {
+		return err
+	}
+
+	var (
+		files []broker.ManifestFile
+		links *signedLinks
+	)
+	switch {
+	case b.ManifestURL != "":
+		links = &signedLinks{b: b}
+		files, links.expires, err = manifestFiles(b.ManifestURL, b.ManifestToken)
+	case b.ProxyURL != "":
+		files, _, err = manifestFiles(b.ProxyURL+"/files", b.ProxyToken)
+	case b.Dataset != "" && b.Version != "":
+		files, err = broker.DatasetVersionFiles(b.ServerUrl, b.Dataset, b.Version, b.Token)
+	case b.Dataset != "":
+		files, err = broker.DatasetFiles(b.ServerUrl, b.Dataset, b.Token)
+	default:
+		files, err = broker.DataverseFiles(b.ServerUrl, b.Dataverse, b.Token)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%d files to fetch\n", len(files))
+
+	queue := make(chan broker.ManifestFile)
+	var (
+		lock                     sync.Mutex
+		wg                       sync.WaitGroup
+		fetched, skipped, failed int
+	)
+
+	for i := 0; i < o.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range queue {
+				var skip bool
+				var err error
+				for attempt := 0; attempt < o.Retries; attempt++ {
+					if links != nil {
+						if file.DownloadURL, err = links.link(file); err != nil {
+							continue
+						}
+					}
+					if skip, err = fetchFile(file, o.Dest, b); err == nil {
+						break
+					}
+				}
+
+				lock.Lock()
+				switch {
+				case err != nil:
+					failed++
+					fmt.Fprintf(out, "failed  %s: %v\n", file.Path, err)
+				case skip:
+					skipped++
+					fmt.Fprintf(out, "skipped %s\n", file.Path)
+				default:
+					fetched++
+					fmt.Fprintf(out, "fetched %s\n", file.Path)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for _, file := range files {
+		queue <- file
+	}
+	close(queue)
+	wg.Wait()
+
+	fmt.Fprintf(out, "%d fetched, %d up to date, %d failed\n", fetched, skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be fetched", failed)
+	}
+	return nil
+}
+
+// readBinding reads the credentials of a binding mounted from a secret.
+// Values that aren't strings are JSON encoded by the platform.
+func readBinding(dir string) (*binding, error) {
+	read := func(key string) (string, error) {
+		data, err := ioutil.ReadFile(filepath.Join(dir, key))
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		value := strings.TrimSpace(string(data))
+		var s string
+		if strings.HasPrefix(value, `"`) && json.Unmarshal([]byte(value), &s) == nil {
+			value = s
+		}
+		return value, nil
+	}
+
+	b := &binding{}
+	for key, value := range map[string]*string{
+		"server_url":     &b.ServerUrl,
+		"credentials":    &b.Token,
+		"dataverse":      &b.Dataverse,
+		"dataset":        &b.Dataset,
+		"version":        &b.Version,
+		"proxy_url":      &b.ProxyURL,
+		"proxy_token":    &b.ProxyToken,
+		"manifest_url":   &b.ManifestURL,
+		"manifest_token": &b.ManifestToken,
+	} {
+		v, err := read(key)
+		if err != nil {
+			return nil, err
+		}
+		*value = v
+	}
+
+	if b.ProxyURL == "" && b.ManifestURL == "" && (b.ServerUrl == "" || (b.Dataverse == "" && b.Dataset == "")) {
+		return nil, fmt.Errorf("%s doesn't hold the credentials of a binding: proxy_url, manifest_url, or server_url and dataverse or dataset are required", dir)
+	}
+	return b, nil
+}
+
+// manifestFiles pages through the manifest of a binding on the broker's data
+// proxy, and returns when its links expire, if they do. Files still being
+// listed can't be fetched yet.
+func manifestFiles(first string, token string) ([]broker.ManifestFile, time.Time, error) {
+	files := make([]broker.ManifestFile, 0)
+	var expires time.Time
+
+	next := first
+	for next != "" {
+		req, err := http.NewRequest("GET", next, nil)
+		if err != nil {
+			return nil, expires, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, expires, err
+		}
+		manifest := broker.Manifest{}
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&manifest)
+		} else {
+			err = fmt.Errorf("GET %s: %s", next, resp.Status)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, expires, err
+		}
+		if manifest.Pending {
+			return nil, expires, errors.New("the files of the binding are still being listed, try again later")
+		}
+
+		if manifest.ExpiresAt != "" {
+			at, err := time.Parse(time.RFC3339, manifest.ExpiresAt)
+			if err != nil {
+				return nil, expires, fmt.Errorf("GET %s: invalid expiry %q", next, manifest.ExpiresAt)
+			}
+			if expires.IsZero() || at.Before(expires) {
+				expires = at
+			}
+		}
+		files = append(files, manifest.Files...)
+		next = manifest.Next
+	}
+
+	return files, expires, nil
+}
+
+// localPath maps the path of a file in the manifest to a path under dest,
+// never outside of it
+func localPath(dest string, file broker.ManifestFile) (string, error) {
+	clean := strings.TrimPrefix(path.Clean("/"+file.Path), "/")
+	if clean == "" {
+		return "", fmt.Errorf("invalid path %q", file.Path)
+	}
+	return filepath.Join(dest, filepath.FromSlash(clean)), nil
+}
+
+// fetchFile downloads a file unless it is already there with the right
+// checksum. Partial downloads are kept in a .part file and resumed.
+func fetchFile(file broker.ManifestFile, dest string, b *binding) (bool, error) {
+	target, err := localPath(dest, file)
+	if err != nil {
+		return false, err
+	}
+
+	if info, err := os.Stat(target); err == nil && info.Size() == file.Size {
+		if ok, err := verify(target, file); err == nil && ok {
+			return true, nil
+		}
+	}
+
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return false, err
+	}
+
+	part := target + ".part"
+	var offset int64
+	if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	}
+	if offset > file.Size {
+		offset = 0
+	}
+
+	if offset < file.Size || file.Size == 0 {
+		if err = download(file, part, offset, b); err != nil {
+			return false, err
+		}
+	}
+
+	ok, err := verify(part, file)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		// Start over on the next attempt
+		os.Remove(part)
+		return false, fmt.Errorf("size or %s checksum mismatch", file.Checksum.Type)
+	}
+
+	return false, os.Rename(part, target)
+}
+
+// download appends the file from offset to part, or rewrites part if the
+// server doesn't support range requests
+func download(file broker.ManifestFile, part string, offset int64, b *binding) error {
+	req, err := http.NewRequest("GET", file.DownloadURL, nil)
+	if err != nil {
+		return err
+	}
+	b.authorize(req)
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+
+	// Downloads may be long, they aren't subject to a timeout
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		flags |= os.O_TRUNC
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Already complete
+		return nil
+	default:
+		return fmt.Errorf("GET %s: %s", file.DownloadURL, resp.Status)
+	}
+
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// verify checks the size and checksum of a downloaded file
+func verify(local string, file broker.ManifestFile) (bool, error) {
+	info, err := os.Stat(local)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() != file.Size {
+		return false, nil
+	}
+	if file.Checksum.Value == "" {
+		return true, nil
+	}
+	return file.Checksum.VerifyFile(local)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fetchTestFiles are the files of the fake Dataverse, by ID
+var fetchTestFiles = map[int]string{
+	1: strings.Repeat("first file\n", 1000),
+	2: strings.Repeat("second file\n", 1000),
+	3: strings.Repeat("third file\n", 1000),
+	4: strings.Repeat("fourth file\n", 1000),
+}
+
+// fakeFile describes a file of fetchTestFiles as the Dataverse files API does
+func fakeFile(id int) map[string]interface{} {
+	sum := md5.Sum([]byte(fetchTestFiles[id]))
+	return map[string]interface{}{
+		"label":          "file" + strconv.Itoa(id) + ".txt",
+		"directoryLabel": "data",
+		"dataFile": map[string]interface{}{
+			"id":       id,
+			"filesize": len(fetchTestFiles[id]),
+			"checksum": map[string]interface{}{"type": "MD5", "value": hex.EncodeToString(sum[:])},
+		},
+	}
+}
+
+// writeBindingDir mounts binding credentials in a new directory, one file per
+// key
+func writeBindingDir(t *testing.T, credentials map[string]string) string {
+	dir, err := ioutil.TempDir("", "dataverse-broker-binding")
+	if err != nil {
+		t.Fatalf("Error creating binding dir: %#+v\n", err)
+	}
+	for key, value := range credentials {
+		if err = ioutil.WriteFile(filepath.Join(dir, key), []byte(value), 0600); err != nil {
+			t.Fatalf("Error writing %s: %#+v\n", key, err)
+		}
+	}
+	return dir
+}
+
+// Check fetch lists the version a binding is pinned to, downloads files in
+// parallel, resumes partial downloads and skips files already there
+func TestFetch(t *testing.T) {
+
+	var (
+		lock             sync.Mutex
+		listed           []string
+		ranges           []string
+		active, parallel int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/datasets/") {
+			lock.Lock()
+			listed = append(listed, r.URL.Path)
+			lock.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": "OK", "data": []interface{}{
+				fakeFile(1), fakeFile(2), fakeFile(3), fakeFile(4),
+			}})
+			return
+		}
+
+		id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/access/datafile/"))
+		lock.Lock()
+		active++
+		if active > parallel {
+			parallel = active
+		}
+		if r.Header.Get("Range") != "" {
+			ranges = append(ranges, strconv.Itoa(id)+" "+r.Header.Get("Range"))
+		}
+		lock.Unlock()
+
+		// Long enough for the other downloads to start
+		time.Sleep(50 * time.Millisecond)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(fetchTestFiles[id]))
+
+		lock.Lock()
+		active--
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	bindingDir := writeBindingDir(t, map[string]string{
+		"server_url":  `"` + server.URL + `"`,
+		"credentials": "secret-token",
+		"dataset":     "doi:10.5072/FK2/PIN",
+		"version":     "1.0",
+	})
+	defer os.RemoveAll(bindingDir)
+	dest, err := ioutil.TempDir("", "dataverse-broker-fetch")
+	if err != nil {
+		t.Fatalf("Error creating dest dir: %#+v\n", err)
+	}
+	defer os.RemoveAll(dest)
+
+	// File 1 is already there, file 2 half downloaded and file 3 there
+	// with other content of the same size
+	os.MkdirAll(filepath.Join(dest, "data"), 0755)
+	ioutil.WriteFile(filepath.Join(dest, "data", "file1.txt"), []byte(fetchTestFiles[1]), 0644)
+	half := len(fetchTestFiles[2]) / 2
+	ioutil.WriteFile(filepath.Join(dest, "data", "file2.txt.part"), []byte(fetchTestFiles[2][:half]), 0644)
+	ioutil.WriteFile(filepath.Join(dest, "data", "file3.txt"), bytes.Repeat([]byte("x"), len(fetchTestFiles[3])), 0644)
+
+	out := &bytes.Buffer{}
+	if err = runFetch([]string{"--binding-dir", bindingDir, "--dest", dest, "--parallel", "3"}, out); err != nil {
+		t.Fatalf("Error on fetch: %#+v\n%s", err, out.String())
+	}
+
+	lock.Lock()
+	if len(listed) != 1 || listed[0] != "/api/datasets/:persistentId/versions/1.0/files" {
+		t.Errorf("Error listing files: expected those of version 1.0, got %#+v\n", listed)
+	}
+	for id, content := range fetchTestFiles {
+		data, err := ioutil.ReadFile(filepath.Join(dest, "data", "file"+strconv.Itoa(id)+".txt"))
+		if err != nil || string(data) != content {
+			t.Errorf("Error in file %d: %#+v\n", id, err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dest, "data", "file2.txt.part")); !os.IsNotExist(err) {
+		t.Errorf("Error in dest: partial download left behind\n")
+	}
+	if len(ranges) != 1 || ranges[0] != "2 bytes="+strconv.Itoa(half)+"-" {
+		t.Errorf("Error resuming download: expected a range request for file 2, got %#+v\n", ranges)
+	}
+	if !strings.Contains(out.String(), "skipped data/file1.txt") || !strings.Contains(out.String(), "fetched data/file3.txt") ||
+		!strings.Contains(out.String(), "3 fetched, 1 up to date, 0 failed") {
+		t.Errorf("Error in output: %s\n", out.String())
+	}
+	if parallel < 2 || parallel > 3 {
+		t.Errorf("Error in parallel downloads: expected 2 or 3 at once, got %d\n", parallel)
+	}
+	lock.Unlock()
+
+	out.Reset()
+	if err = runFetch([]string{"--binding-dir", bindingDir, "--dest", dest}, out); err != nil {
+		t.Fatalf("Error on second fetch: %#+v\n", err)
+	}
+	if !strings.Contains(out.String(), "0 fetched, 4 up to date, 0 failed") {
+		t.Errorf("Error in output of second fetch: expected every file skipped, got %s\n", out.String())
+	}
+}
+
+// Check fetch downloads bindings with signed links from their manifest,
+// refreshing the links once expired, and exits non-zero when files fail
+func TestFetchSignedLinks(t *testing.T) {
+
+	var (
+		lock     sync.Mutex
+		listings int
+	)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/data/binding1/files":
+			if r.Header.Get("Authorization") != "Bearer manifest-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			lock.Lock()
+			listings++
+			generation := strconv.Itoa(listings)
+			lock.Unlock()
+
+			// Links of the first listing have already expired
+			expires := time.Now().Add(-time.Minute)
+			if generation != "1" {
+				expires = time.Now().Add(15 * time.Minute)
+			}
+			start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+			manifest := map[string]interface{}{
+				"total_count": 3,
+				"start":       start,
+				"expires_at":  expires.UTC().Format(time.RFC3339),
+			}
+			files := []interface{}{}
+			for id := start + 1; id <= start+2 && id <= 3; id++ {
+				sum := md5.Sum([]byte(fetchTestFiles[id]))
+				files = append(files, map[string]interface{}{
+					"file_id":      id,
+					"path":         "file" + strconv.Itoa(id) + ".txt",
+					"size":         len(fetchTestFiles[id]),
+					"checksum":     map[string]interface{}{"type": "MD5", "value": hex.EncodeToString(sum[:])},
+					"download_url": server.URL + "/signed/binding1/" + strconv.Itoa(id) + "?generation=" + generation,
+				})
+			}
+			manifest["files"] = files
+			if start == 0 {
+				manifest["next"] = server.URL + "/data/binding1/files?start=2&per_page=2"
+			}
+			json.NewEncoder(w).Encode(manifest)
+		case strings.HasPrefix(r.URL.Path, "/signed/binding1/"):
+			id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/signed/binding1/"))
+			if r.URL.Query().Get("generation") == "1" || r.Header.Get("Authorization") != "" || id == 3 {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(fetchTestFiles[id]))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	bindingDir := writeBindingDir(t, map[string]string{
+		"manifest_url":   server.URL + "/data/binding1/files",
+		"manifest_token": "manifest-token",
+	})
+	defer os.RemoveAll(bindingDir)
+	dest, err := ioutil.TempDir("", "dataverse-broker-fetch")
+	if err != nil {
+		t.Fatalf("Error creating dest dir: %#+v\n", err)
+	}
+	defer os.RemoveAll(dest)
+
+	out := &bytes.Buffer{}
+	err = runFetch([]string{"--binding-dir", bindingDir, "--dest", dest, "--retries", "2"}, out)
+	if err == nil || !strings.Contains(out.String(), "failed  file3.txt") || !strings.Contains(out.String(), "2 fetched, 0 up to date, 1 failed") {
+		t.Errorf("Error on fetch: expected file 3 to fail, got %#+v\n%s", err, out.String())
+	}
+	for _, id := range []int{1, 2} {
+		data, err := ioutil.ReadFile(filepath.Join(dest, "file"+strconv.Itoa(id)+".txt"))
+		if err != nil || string(data) != fetchTestFiles[id] {
+			t.Errorf("Error in file %d: %#+v\n", id, err)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if listings < 4 {
+		t.Errorf("Error refreshing links: expected the manifest listed again, got %d pages\n", listings)
+	}
+}
@@ -4,20 +4,24 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"path"
 	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/gorilla/mux"
 	prom "github.com/prometheus/client_golang/prometheus"
-	"github.com/shawn-hurley/osb-broker-k8s-lib/middleware"
 	clientset "k8s.io/client-go/kubernetes"
 	clientrest "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
 	"github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	"github.com/dataverse-broker/dataverse-broker/pkg/middleware"
+	osbbroker "github.com/pmorie/osb-broker-lib/pkg/broker"
 	"github.com/pmorie/osb-broker-lib/pkg/metrics"
 	"github.com/pmorie/osb-broker-lib/pkg/rest"
 	"github.com/pmorie/osb-broker-lib/pkg/server"
@@ -33,7 +37,19 @@ var options struct {
 	TLSCertFile          string
 	TLSKeyFile           string
 	AuthenticateK8SToken bool
+	AuthorizeK8SAccess   bool
+	AuthorizeVerb        string
+	AuthorizeAPIGroup    string
+	AuthorizeResource    string
+	AuthorizeCacheTTL    time.Duration
 	KubeConfig           string
+	AuthenticateBasic    bool
+	AuthenticateBearer   bool
+	AuthCredentialsFile  string
+	AdminPort            int
+	AdminCredentialsFile string
+	ProxyPort            int
+	S3Port               int
 }
 
 func init() {
@@ -44,12 +60,24 @@ func init() {
 	flag.StringVar(&options.TLSCert, "tlsCert", "", "base-64 encoded PEM block to use as the certificate for TLS. If '--tlsCert' is used, then '--tlsKey' must also be used.")
 	flag.StringVar(&options.TLSKey, "tlsKey", "", "base-64 encoded PEM block to use as the private key matching the TLS certificate.")
 	flag.BoolVar(&options.AuthenticateK8SToken, "authenticate-k8s-token", false, "option to specify if the broker should validate the bearer auth token with kubernetes")
+	flag.BoolVar(&options.AuthorizeK8SAccess, "authorize-k8s-access", false, "option to specify if the broker should authorize authenticated users with a kubernetes subject access review; requires --authenticate-k8s-token")
+	flag.StringVar(&options.AuthorizeVerb, "authorize-verb", "create", "verb checked by the subject access review")
+	flag.StringVar(&options.AuthorizeAPIGroup, "authorize-api-group", "servicecatalog.k8s.io", "API group of the resource checked by the subject access review")
+	flag.StringVar(&options.AuthorizeResource, "authorize-resource", "servicebrokers/proxy", "resource (and optional subresource) checked by the subject access review")
+	flag.DurationVar(&options.AuthorizeCacheTTL, "authorize-cache-ttl", 30*time.Second, "how long a subject access review result is reused for the same user")
 	flag.StringVar(&options.KubeConfig, "kube-config", "", "specify the kube config path to be used")
+	flag.BoolVar(&options.AuthenticateBasic, "authenticate-basic", false, "option to specify if the broker should require HTTP basic auth")
+	flag.BoolVar(&options.AuthenticateBearer, "authenticate-bearer", false, "option to specify if the broker should accept static bearer tokens")
+	flag.StringVar(&options.AuthCredentialsFile, "auth-credentials-file", "", "JSON file with the users and tokens accepted by --authenticate-basic and --authenticate-bearer; reloaded when it changes or on SIGHUP. Credentials are read from the environment if not set")
+	flag.IntVar(&options.AdminPort, "admin-port", 0, "port for the admin API to listen on; the admin API is disabled if not set")
+	flag.StringVar(&options.AdminCredentialsFile, "admin-credentials-file", "", "JSON file with the users and tokens accepted by the admin API, in the format of --auth-credentials-file")
+	flag.IntVar(&options.ProxyPort, "proxy-port", 0, "port for the data proxy to listen on; required with --proxyUrl")
+	flag.IntVar(&options.S3Port, "s3-port", 0, "port for the S3 gateway to listen on; required with --s3Url")
 	broker.AddFlags(&options.Options)
-	flag.Parse()
 }
 
 func main() {
+	flag.Parse()
 	if err := run(); err != nil && err != context.Canceled && err != context.DeadlineExceeded {
 		glog.Fatalln(err)
 	}
@@ -68,6 +96,15 @@ func runWithContext(ctx context.Context) error {
 		fmt.Printf("%s/%s\n", path.Base(os.Args[0]), "0.1.0")
 		return nil
 	}
+	if flag.Arg(0) == "client" {
+		return runClient(flag.Args()[1:], os.Stdout)
+	}
+	if flag.Arg(0) == "fetch" {
+		return runFetch(flag.Args()[1:], os.Stdout)
+	}
+	if flag.Arg(0) == "push" {
+		return runPush(flag.Args()[1:], os.Stdout)
+	}
 	if (options.TLSCert != "" || options.TLSKey != "") &&
 		(options.TLSCert == "" || options.TLSKey == "") {
 		fmt.Println("To use TLS with specified cert or key data, both --tlsCert and --tlsKey must be used")
@@ -88,13 +125,46 @@ func runWithContext(ctx context.Context) error {
 	reg := prom.NewRegistry()
 	osbMetrics := metrics.New()
 	reg.MustRegister(osbMetrics)
+	reg.MustRegister(broker.BackendMetrics())
+
+	var brokerInterface osbbroker.Interface = businessLogic
+	if auditor := businessLogic.Auditor(); auditor != nil {
+		brokerInterface = &broker.AuditedBroker{
+			Interface: businessLogic,
+			Auditor:   auditor,
+		}
+	}
 
-	api, err := rest.NewAPISurface(businessLogic, osbMetrics)
+	api, err := rest.NewAPISurface(brokerInterface, osbMetrics)
 	if err != nil {
 		return err
 	}
 
+	if options.AuthorizeK8SAccess && !options.AuthenticateK8SToken {
+		return fmt.Errorf("--authorize-k8s-access requires --authenticate-k8s-token")
+	}
+
+	if (options.AuthenticateBasic || options.AuthenticateBearer) && options.AuthenticateK8SToken {
+		return fmt.Errorf("--authenticate-basic and --authenticate-bearer can't be used with --authenticate-k8s-token")
+	}
+
 	s := server.New(api, reg)
+	businessLogic.RegisterFetchHandlers(s.Router)
+	businessLogic.RegisterManifestHandlers(s.Router)
+	if options.AuthenticateBasic || options.AuthenticateBearer {
+		store, err := middleware.NewCredentialStore(options.AuthCredentialsFile)
+		if err != nil {
+			return err
+		}
+		go reloadOnHangup(ctx, store)
+
+		sa := middleware.StaticAuthMiddleware{
+			Store:       store,
+			AllowBasic:  options.AuthenticateBasic,
+			AllowBearer: options.AuthenticateBearer,
+		}
+		s.Router.Use(sa.Middleware)
+	}
 	if options.AuthenticateK8SToken {
 		// get k8s client
 		k8sClient, err := getKubernetesClient(options.KubeConfig)
@@ -107,26 +177,98 @@ func runWithContext(ctx context.Context) error {
 		}
 		// Use TokenReviewMiddleware.
 		s.Router.Use(tr.Middleware)
+
+		if options.AuthorizeK8SAccess {
+			// Authorize the user found by the TokenReviewMiddleware
+			sar := &middleware.SubjectAccessReviewMiddleware{
+				SubjectAccessReview: k8sClient.AuthorizationV1().SubjectAccessReviews(),
+				ResourceAttributes:  middleware.ParseResourceAttributes(options.AuthorizeVerb, options.AuthorizeAPIGroup, options.AuthorizeResource),
+				CacheTTL:            options.AuthorizeCacheTTL,
+			}
+			s.Router.Use(sar.Middleware)
+		}
+	}
+	// Audit the endpoints osb-broker-lib doesn't serve, once the caller is
+	// authenticated
+	s.Router.Use(businessLogic.Auditor().Middleware)
+
+	if options.AdminPort != 0 {
+		if options.AdminCredentialsFile == "" {
+			return fmt.Errorf("--admin-port requires --admin-credentials-file")
+		}
+		adminStore, err := middleware.NewCredentialStore(options.AdminCredentialsFile)
+		if err != nil {
+			return err
+		}
+		go reloadOnHangup(ctx, adminStore)
+
+		admin := &server.Server{Router: mux.NewRouter()}
+		admin.Router.PathPrefix("/").Handler(businessLogic.AdminHandler())
+		admin.Router.Use(middleware.StaticAuthMiddleware{
+			Store:       adminStore,
+			AllowBasic:  true,
+			AllowBearer: true,
+		}.Middleware)
+
+		go func() {
+			glog.Infof("Starting admin API!")
+			if err := runServer(ctx, admin, ":"+strconv.Itoa(options.AdminPort)); err != nil && err != http.ErrServerClosed {
+				glog.Errorf("admin API stopped: %v", err)
+			}
+		}()
+	}
+
+	if (options.ProxyPort != 0) != (options.ProxyURL != "") {
+		return fmt.Errorf("--proxy-port and --proxyUrl must be used together")
+	}
+	if options.ProxyPort != 0 {
+		proxy := &server.Server{Router: mux.NewRouter()}
+		proxy.Router.PathPrefix("/").Handler(businessLogic.ProxyHandler())
+
+		go func() {
+			glog.Infof("Starting data proxy!")
+			if err := runServer(ctx, proxy, ":"+strconv.Itoa(options.ProxyPort)); err != nil && err != http.ErrServerClosed {
+				glog.Errorf("data proxy stopped: %v", err)
+			}
+		}()
+	}
+
+	if (options.S3Port != 0) != (options.S3URL != "") {
+		return fmt.Errorf("--s3-port and --s3Url must be used together")
+	}
+	if options.S3Port != 0 {
+		gateway := &server.Server{Router: mux.NewRouter()}
+		gateway.Router.SkipClean(true)
+		gateway.Router.PathPrefix("/").Handler(businessLogic.S3Handler())
+
+		go func() {
+			glog.Infof("Starting S3 gateway!")
+			if err := runServer(ctx, gateway, ":"+strconv.Itoa(options.S3Port)); err != nil && err != http.ErrServerClosed {
+				glog.Errorf("S3 gateway stopped: %v", err)
+			}
+		}()
 	}
 
 	glog.Infof("Starting broker!")
 
+	return runServer(ctx, s, addr)
+}
+
+// runServer serves s on addr with the TLS options given on the command line
+func runServer(ctx context.Context, s *server.Server, addr string) error {
 	if options.Insecure {
-		err = s.Run(ctx, addr)
-	} else {
-		if options.TLSCert != "" && options.TLSKey != "" {
-			glog.V(4).Infof("Starting secure broker with TLS cert and key data")
-			err = s.RunTLS(ctx, addr, options.TLSCert, options.TLSKey)
-		} else {
-			if options.TLSCertFile == "" || options.TLSKeyFile == "" {
-				glog.Error("unable to run securely without TLS Certificate and Key. Please review options and if running with TLS, specify --tls-cert-file and --tls-private-key-file or --tlsCert and --tlsKey.")
-				return nil
-			}
-			glog.V(4).Infof("Starting secure broker with file based TLS cert and key")
-			err = s.RunTLSWithTLSFiles(ctx, addr, options.TLSCertFile, options.TLSKeyFile)
-		}
+		return s.Run(ctx, addr)
 	}
-	return err
+	if options.TLSCert != "" && options.TLSKey != "" {
+		glog.V(4).Infof("Starting secure broker with TLS cert and key data")
+		return s.RunTLS(ctx, addr, options.TLSCert, options.TLSKey)
+	}
+	if options.TLSCertFile == "" || options.TLSKeyFile == "" {
+		glog.Error("unable to run securely without TLS Certificate and Key. Please review options and if running with TLS, specify --tls-cert-file and --tls-private-key-file or --tlsCert and --tlsKey.")
+		return nil
+	}
+	glog.V(4).Infof("Starting secure broker with file based TLS cert and key")
+	return s.RunTLSWithTLSFiles(ctx, addr, options.TLSCertFile, options.TLSKeyFile)
 }
 
 func getKubernetesClient(kubeConfigPath string) (clientset.Interface, error) {
@@ -152,7 +294,7 @@ func getKubernetesClient(kubeConfigPath string) (clientset.Interface, error) {
 }
 
 func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
-	term := make(chan os.Signal)
+	term := make(chan os.Signal, 1)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
 
 	for {
@@ -166,3 +308,20 @@ func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
 		}
 	}
 }
+
+func reloadOnHangup(ctx context.Context, store *middleware.CredentialStore) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-hup:
+			glog.Infof("Received SIGHUP, reloading credentials...")
+			if err := store.Reload(); err != nil {
+				glog.Errorf("unable to reload credentials: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
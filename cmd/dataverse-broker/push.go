@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/dataverse-broker/dataverse-broker/pkg/broker"
+)
+
+// defaultSidecar is the name of the sidecar file looked up in the source
+// directory when --sidecar isn't given
+const defaultSidecar = ".dataverse.json"
+
+// pushOptions are the flags of the push subcommand
+type pushOptions struct {
+	BindingDir string
+	Src        string
+	Sidecar    string
+	Retries    int
+}
+
+// fileMetadata is what the sidecar file can tell about an uploaded file
+type fileMetadata struct {
+	Description string `json:"description,omitempty"`
+	// Directory of the file in the dataset, its directory in the source by
+	// default
+	DirectoryLabel string   `json:"directoryLabel,omitempty"`
+	Categories     []string `json:"categories,omitempty"`
+}
+
+// pushFile is a local file and where it goes in the dataset
+type pushFile struct {
+	Local    string
+	Path     string
+	Size     int64
+	Metadata fileMetadata
+}
+
+// runPush uploads the files of a local directory to the draft of a bound
+// dataset, skipping those already there with the same checksum, e.g. at the
+// end of a pipeline
+func runPush(args []string, out io.Writer) error {
+	o := pushOptions{}
+	fs := flag.NewFlagSet("push", flag.ContinueOnError)
+	fs.StringVar(&o.BindingDir, "binding-dir", "/etc/binding", "directory where the binding credentials are mounted, one file per key")
+	fs.StringVar(&o.Src, "src", ".", "directory to upload the files of")
+	fs.StringVar(&o.Sidecar, "sidecar", "", "JSON file with the description, directoryLabel and categories of files by path, "+defaultSidecar+" in --src by default")
+	fs.IntVar(&o.Retries, "retries", 3, "attempts per file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if o.Retries < 1 {
+		return errors.New("--retries must be at least 1")
+	}
+
+	b, err := readBinding(o.BindingDir)
+	if err != nil {
+		return err
+	}
+	if b.Dataset == "" || b.Token == "" || b.ServerUrl == "" {
+		return fmt.Errorf("%s doesn't hold the credentials of a binding to a dataset: server_url, dataset and credentials are required", o.BindingDir)
+	}
+
+	sidecar := o.Sidecar
+	if sidecar == "" {
+		sidecar = filepath.Join(o.Src, defaultSidecar)
+	}
+	metadata, err := readSidecar(sidecar, o.Sidecar != "")
+	if err != nil {
+		return err
+	}
+
+	files, err := localFiles(o.Src, sidecar, metadata)
+	if err != nil {
+		return err
+	}
+
+	existing, err := broker.DatasetFiles(b.ServerUrl, b.Dataset, b.Token)
+	if err != nil {
+		return err
+	}
+	remote := make(map[string]broker.ManifestFile, len(existing))
+	for _, file := range existing {
+		remote[file.Path] = file
+	}
+	fmt.Fprintf(out, "%d files to push to %s\n", len(files), b.Dataset)
+
+	// Files are sent one after another: Dataverse locks the dataset while
+	// it ingests each of them
+	var uploaded, replaced, skipped, failed int
+	for i, file := range files {
+		current, exists := remote[file.Path]
+		if exists && file.Size == current.Size && current.Checksum.Value != "" {
+			if ok, err := current.Checksum.VerifyFile(file.Local); err == nil && ok {
+				skipped++
+				fmt.Fprintf(out, "[%d/%d] skipped  %s\n", i+1, len(files), file.Path)
+				continue
+			}
+		}
+
+		for attempt := 0; attempt < o.Retries; attempt++ {
+			if err = broker.WaitForDatasetLocks(b.ServerUrl, b.Dataset, b.Token); err != nil {
+				continue
+			}
+			if exists {
+				err = uploadFile(b, file, fmt.Sprintf("%s/api/files/%d/replace", b.ServerUrl, current.FileID), true)
+			} else {
+				err = uploadFile(b, file, b.ServerUrl+"/api/datasets/:persistentId/add?"+url.Values{"persistentId": {b.Dataset}}.Encode(), false)
+			}
+			if err == nil {
+				break
+			}
+		}
+
+		switch {
+		case err != nil:
+			failed++
+			fmt.Fprintf(out, "[%d/%d] failed   %s: %v\n", i+1, len(files), file.Path, err)
+		case exists:
+			replaced++
+			fmt.Fprintf(out, "[%d/%d] replaced %s (%d bytes)\n", i+1, len(files), file.Path, file.Size)
+		default:
+			uploaded++
+			fmt.Fprintf(out, "[%d/%d] uploaded %s (%d bytes)\n", i+1, len(files), file.Path, file.Size)
+		}
+	}
+
+	fmt.Fprintf(out, "%d uploaded, %d replaced, %d up to date, %d failed\n", uploaded, replaced, skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be pushed", failed)
+	}
+	return nil
+}
+
+// readSidecar reads the metadata of the files to push by their path in the
+// source directory. A missing sidecar is only an error when asked for.
+func readSidecar(sidecar string, required bool) (map[string]fileMetadata, error) {
+	metadata := map[string]fileMetadata{}
+
+	data, err := ioutil.ReadFile(sidecar)
+	if os.IsNotExist(err) && !required {
+		return metadata, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("invalid sidecar %s: %v", sidecar, err)
+	}
+	return metadata, nil
+}
+
+// localFiles lists the regular files under src, except the sidecar, with
+// their path in the dataset
+func localFiles(src string, sidecar string, metadata map[string]fileMetadata) ([]pushFile, error) {
+	files := make([]pushFile, 0)
+
+	err := filepath.Walk(src, func(local string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || sameFile(local, sidecar) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(src, local)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		m := metadata[rel]
+		if m.DirectoryLabel == "" {
+			if dir := path.Dir(rel); dir != "." {
+				m.DirectoryLabel = dir
+			}
+		}
+
+		files = append(files, pushFile{
+			Local:    local,
+			Path:     path.Join(m.DirectoryLabel, path.Base(rel)),
+			Size:     info.Size(),
+			Metadata: m,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+func sameFile(a string, b string) bool {
+	ia, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	ib, err := os.Stat(b)
+	return err == nil && os.SameFile(ia, ib)
+}
+
+// uploadFile sends a file with its metadata to the native add-file or
+// replace-file API, streaming it rather than reading it in memory
+func uploadFile(b *binding, file pushFile, target string, replace bool) error {
+	jsonData := map[string]interface{}{
+		"description":    file.Metadata.Description,
+		"directoryLabel": file.Metadata.DirectoryLabel,
+	}
+	if len(file.Metadata.Categories) > 0 {
+		jsonData["categories"] = file.Metadata.Categories
+	}
+	if replace {
+		// The content type may change with the new version of the file
+		jsonData["forceReplace"] = true
+	}
+	encoded, err := json.Marshal(jsonData)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(file.Local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := form.WriteField("jsonData", string(encoded))
+		if err == nil {
+			var part io.Writer
+			if part, err = form.CreateFormFile("file", path.Base(file.Path)); err == nil {
+				_, err = io.Copy(part, f)
+			}
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	defer func() {
+		// Stop writing the form and wait, so the file isn't closed while
+		// it is read
+		body.Close()
+		<-done
+	}()
+
+	req, err := http.NewRequest("POST", target, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("X-Dataverse-key", b.Token)
+
+	// Uploads may be long, they aren't subject to a timeout
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	response := struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil || resp.StatusCode >= 300 || response.Status != "OK" {
+		message := response.Message
+		if message == "" {
+			message = resp.Status
+		}
+		return fmt.Errorf("POST %s: %s", req.URL.Path, message)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// pushRequest is an upload the fake Dataverse got
+type pushRequest struct {
+	Target   string
+	Filename string
+	Content  string
+	JSONData map[string]interface{}
+}
+
+// Check push maps files with the sidecar, skips those already in the dataset,
+// replaces those that changed, retries once the dataset is unlocked and
+// fails when a file can't be pushed
+func TestPush(t *testing.T) {
+
+	summary := "site,count\nA,3\n"
+	oldData := "old measurements\n"
+	newData := "new measurements\n"
+
+	var (
+		lock     sync.Mutex
+		uploads  []pushRequest
+		locks    = 1
+		refusals = 1
+	)
+	remoteFile := func(id int, label string, directory string, content string) map[string]interface{} {
+		sum := md5.Sum([]byte(content))
+		return map[string]interface{}{
+			"label":          label,
+			"directoryLabel": directory,
+			"dataFile": map[string]interface{}{
+				"id":       id,
+				"filesize": len(content),
+				"checksum": map[string]interface{}{"type": "MD5", "value": hex.EncodeToString(sum[:])},
+			},
+		}
+	}
+	write := func(w http.ResponseWriter, code int, body interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(body)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Dataverse-key") != "secret-token" && r.URL.Query().Get("key") != "secret-token" {
+			write(w, http.StatusUnauthorized, map[string]interface{}{"status": "ERROR", "message": "Bad API key"})
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/files") && r.Method == "GET":
+			write(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": []interface{}{
+				remoteFile(5, "summary.csv", "tables", summary),
+				remoteFile(7, "old.txt", "data", strings.Repeat("x", len(oldData))),
+			}})
+		case strings.HasSuffix(r.URL.Path, "/locks"):
+			data := []interface{}{}
+			if locks > 0 {
+				locks--
+				data = append(data, map[string]interface{}{"lockType": "Ingest"})
+			}
+			write(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": data})
+		case r.Method == "POST":
+			file, header, err := r.FormFile("file")
+			if err != nil {
+				write(w, http.StatusBadRequest, map[string]interface{}{"status": "ERROR", "message": err.Error()})
+				return
+			}
+			content, _ := ioutil.ReadAll(file)
+			upload := pushRequest{Target: r.URL.Path, Filename: header.Filename, Content: string(content)}
+			json.Unmarshal([]byte(r.FormValue("jsonData")), &upload.JSONData)
+			uploads = append(uploads, upload)
+
+			switch {
+			case header.Filename == "bad.txt":
+				write(w, http.StatusForbidden, map[string]interface{}{"status": "ERROR", "message": "Not allowed to add files"})
+			case header.Filename == "new.txt" && refusals > 0:
+				// Ingest of the previous file locked the dataset again
+				refusals--
+				write(w, http.StatusBadRequest, map[string]interface{}{"status": "ERROR", "message": "Dataset is locked"})
+			default:
+				write(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": map[string]interface{}{}})
+			}
+		default:
+			write(w, http.StatusNotFound, map[string]interface{}{"status": "ERROR", "message": "Not found"})
+		}
+	}))
+	defer server.Close()
+
+	bindingDir := writeBindingDir(t, map[string]string{
+		"server_url":  server.URL,
+		"credentials": "secret-token",
+		"dataset":     "doi:10.5072/FK2/PUSH",
+	})
+	defer os.RemoveAll(bindingDir)
+	src, err := ioutil.TempDir("", "dataverse-broker-push")
+	if err != nil {
+		t.Fatalf("Error creating src dir: %#+v\n", err)
+	}
+	defer os.RemoveAll(src)
+
+	for local, content := range map[string]string{
+		"results/summary.csv": summary,
+		"data/old.txt":        newData,
+		"new.txt":             "new file\n",
+		"sub/bad.txt":         "refused\n",
+		defaultSidecar: `{"results/summary.csv": {"description": "Summary table", "directoryLabel": "tables"},
+		                  "new.txt": {"description": "A new file", "categories": ["Data"]}}`,
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(src, local)), 0755)
+		if err = ioutil.WriteFile(filepath.Join(src, local), []byte(content), 0644); err != nil {
+			t.Fatalf("Error writing %s: %#+v\n", local, err)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	err = runPush([]string{"--binding-dir", bindingDir, "--src", src, "--retries", "2"}, out)
+	if err == nil || !strings.Contains(err.Error(), "1 files could not be pushed") {
+		t.Errorf("Error on push: expected bad.txt to fail, got %#+v\n", err)
+	}
+	for _, line := range []string{
+		"4 files to push to doi:10.5072/FK2/PUSH",
+		"skipped  tables/summary.csv",
+		"replaced data/old.txt",
+		"uploaded new.txt",
+		"failed   sub/bad.txt: POST /api/datasets/:persistentId/add: Not allowed to add files",
+		"1 uploaded, 1 replaced, 1 up to date, 1 failed",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Error in output: expected %q, got\n%s", line, out.String())
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if locks != 0 {
+		t.Errorf("Error on push: the dataset locks weren't checked\n")
+	}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].Filename < uploads[j].Filename })
+	targets := make([]string, 0, len(uploads))
+	for _, upload := range uploads {
+		targets = append(targets, upload.Filename+" "+upload.Target)
+	}
+	expected := []string{
+		"bad.txt /api/datasets/:persistentId/add",
+		"bad.txt /api/datasets/:persistentId/add",
+		"new.txt /api/datasets/:persistentId/add",
+		"new.txt /api/datasets/:persistentId/add",
+		"old.txt /api/files/7/replace",
+	}
+	if strings.Join(targets, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Error in uploads: expected\n%s\ngot\n%s\n", strings.Join(expected, "\n"), strings.Join(targets, "\n"))
+	}
+
+	if upload := uploads[0]; upload.JSONData["directoryLabel"] != "sub" {
+		t.Errorf("Error in upload of bad.txt: expected its directory as label, got %#+v\n", upload.JSONData)
+	}
+	if upload := uploads[2]; upload.Content != "new file\n" || upload.JSONData["description"] != "A new file" ||
+		toJSON(upload.JSONData["categories"]) != `["Data"]` || upload.JSONData["directoryLabel"] != "" {
+		t.Errorf("Error in upload of new.txt: %#+v\n", upload)
+	}
+	if upload := uploads[4]; upload.Content != newData || upload.JSONData["forceReplace"] != true || upload.JSONData["directoryLabel"] != "data" {
+		t.Errorf("Error in replacement of old.txt: %#+v\n", upload)
+	}
+}
+
+func toJSON(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,220 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/golang/glog"
+)
+
+// defaultManagedRole lets accounts see and download unpublished content
+// without changing anything
+const defaultManagedRole = "member"
+
+// defaultManagedEmailDomain is used for the e-mail addresses of accounts,
+// which Dataverse requires but nobody reads
+const defaultManagedEmailDomain = "dataverse-broker.invalid"
+
+// managedUsernameLength keeps usernames within what Dataverse accepts
+const managedUsernameLength = 60
+
+// ManagedAccountsServer holds what the broker needs to create accounts on a
+// Dataverse server
+type ManagedAccountsServer struct {
+	// API token of a user allowed to assign roles on the whitelisted
+	// dataverses, and a superuser to deactivate accounts
+	AdminToken string `json:"admin_token"`
+	// The server's BuiltinUsers.KEY setting, required to create users
+	BuiltinUsersKey string `json:"builtin_users_key"`
+	// Role assigned to accounts, "member" by default
+	Role        string `json:"role,omitempty"`
+	EmailDomain string `json:"email_domain,omitempty"`
+}
+
+// ManagedAccountsConfig lists the servers on which every binding gets its own
+// account, keyed by ServerUrl (e.g. "https://demo.dataverse.org")
+type ManagedAccountsConfig struct {
+	Servers map[string]ManagedAccountsServer `json:"servers"`
+}
+
+// managedAccount is the Dataverse account of a binding
+type managedAccount struct {
+	ServerUrl string `json:"server_url"`
+	Username  string `json:"username"`
+	Token     string `json:"token"`
+	// Where the role is assigned: "dataverses/<alias>" or
+	// "datasets/:persistentId" with its persistent ID
+	Target       string `json:"target"`
+	PersistentID string `json:"persistent_id,omitempty"`
+	AssignmentID int    `json:"assignment_id,omitempty"`
+}
+
+// FileToManagedAccounts reads a ManagedAccountsConfig from a JSON file
+func FileToManagedAccounts(path string) (*ManagedAccountsConfig, error) {
+	byteValue, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ManagedAccountsConfig{}
+	if err = json.Unmarshal(byteValue, config); err != nil {
+		return nil, err
+	}
+
+	servers := make(map[string]ManagedAccountsServer, len(config.Servers))
+	for server, settings := range config.Servers {
+		if settings.AdminToken == "" || settings.BuiltinUsersKey == "" {
+			return nil, fmt.Errorf("managed accounts of %s need an admin_token and a builtin_users_key", server)
+		}
+		if settings.Role == "" {
+			settings.Role = defaultManagedRole
+		}
+		if settings.EmailDomain == "" {
+			settings.EmailDomain = defaultManagedEmailDomain
+		}
+		key, err := serverKey(server)
+		if err != nil {
+			return nil, err
+		}
+		servers[key] = settings
+	}
+	config.Servers = servers
+
+	return config, nil
+}
+
+// settings returns the managed accounts settings of a server, if it has any
+func (c *ManagedAccountsConfig) settings(serverUrl string) (ManagedAccountsServer, bool) {
+	if c == nil {
+		return ManagedAccountsServer{}, false
+	}
+	key, err := serverKey(serverUrl)
+	if err != nil {
+		return ManagedAccountsServer{}, false
+	}
+	settings, ok := c.Servers[key]
+	return settings, ok
+}
+
+// managedUsername derives the username of a binding's account from its ID
+func managedUsername(bindingID string) string {
+	username := "binding-" + aliasPattern.ReplaceAllString(bindingID, "-")
+	if len(username) > managedUsernameLength {
+		username = username[:managedUsernameLength]
+	}
+	return username
+}
+
+// accountTarget is where the role of an instance's accounts is assigned
+func accountTarget(instance *dataverseInstance) (string, string) {
+	switch {
+	case instance.Deposit != nil:
+		return "datasets/:persistentId", instance.Deposit.PersistentID
+	case instance.Description.Type == "dataset":
+		return "datasets/:persistentId", instance.Description.Global_id
+	}
+	return "dataverses/" + url.PathEscape(instance.dataverseAlias()), ""
+}
+
+// assignmentsURL is the assignments API of the account's target
+func (a *managedAccount) assignmentsURL(id int) string {
+	u := a.ServerUrl + "/api/" + a.Target + "/assignments"
+	if id != 0 {
+		u += fmt.Sprintf("/%d", id)
+	}
+	if a.PersistentID != "" {
+		u += "?" + url.Values{"persistentId": {a.PersistentID}}.Encode()
+	}
+	return u
+}
+
+// createManagedAccount creates a builtin user for a binding and assigns it
+// the configured role on the instance's dataverse or dataset
+func createManagedAccount(settings ManagedAccountsServer, instance *dataverseInstance, bindingID string) (*managedAccount, error) {
+	password, err := newBindingToken()
+	if err != nil {
+		return nil, err
+	}
+
+	target, pid := accountTarget(instance)
+	account := &managedAccount{
+		ServerUrl:    instance.ServerUrl,
+		Username:     managedUsername(bindingID),
+		Target:       target,
+		PersistentID: pid,
+	}
+
+	user := map[string]interface{}{
+		"userName":    account.Username,
+		"firstName":   "Binding",
+		"lastName":    bindingID,
+		"email":       account.Username + "@" + settings.EmailDomain,
+		"affiliation": "dataverse-broker",
+	}
+	query := url.Values{"password": {password}, "key": {settings.BuiltinUsersKey}}
+	created := struct {
+		ApiToken string `json:"apiToken"`
+	}{}
+	if err = nativeAPI("POST", account.ServerUrl+"/api/builtin-users?"+query.Encode(), "", user, &created); err != nil {
+		return nil, err
+	}
+	account.Token = created.ApiToken
+
+	assignment := struct {
+		ID int `json:"id"`
+	}{}
+	err = nativeAPI("POST", account.assignmentsURL(0), settings.AdminToken, map[string]interface{}{
+		"assignee": "@" + account.Username,
+		"role":     settings.Role,
+	}, &assignment)
+	if err != nil {
+		// Don't leave a usable account behind
+		if disableErr := disableManagedAccount(settings, account); disableErr != nil {
+			glog.Errorf("accounts: unable to disable %q: %v", account.Username, disableErr)
+		}
+		return nil, err
+	}
+	account.AssignmentID = assignment.ID
+
+	glog.Infof("accounts: created %q with role %q on %s for binding %q", account.Username, settings.Role, target+pid, bindingID)
+	return account, nil
+}
+
+// disableManagedAccount deletes the account's API token, so it can't be
+// used anymore, and deactivates the account
+func disableManagedAccount(settings ManagedAccountsServer, account *managedAccount) error {
+	err := nativeAPI("DELETE", account.ServerUrl+"/api/users/token", account.Token, nil, nil)
+	// A token deleted before is no longer accepted
+	if err != nil && !isNotFound(err) && !isStatus(err, http.StatusUnauthorized) {
+		return err
+	}
+
+	// Needs a superuser and a server recent enough, the token is gone anyway
+	err = nativeAPI("POST", account.ServerUrl+"/api/admin/authenticatedUsers/"+url.PathEscape(account.Username)+"/deactivate",
+		settings.AdminToken, nil, nil)
+	if err != nil {
+		glog.Warningf("accounts: unable to deactivate %q: %s", account.Username, errorDescription(err))
+	}
+	return nil
+}
+
+// removeManagedAccount revokes the role assignment of a binding's account
+// and disables it
+func removeManagedAccount(settings ManagedAccountsServer, account *managedAccount) error {
+	if account.AssignmentID != 0 {
+		err := nativeAPI("DELETE", account.assignmentsURL(account.AssignmentID), settings.AdminToken, nil, nil)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+
+	if err := disableManagedAccount(settings, account); err != nil {
+		return err
+	}
+
+	glog.Infof("accounts: revoked and disabled %q", account.Username)
+	return nil
+}
@@ -0,0 +1,318 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// AdminInstance is an instance as shown by the admin API
+type AdminInstance struct {
+	ID           string                 `json:"id"`
+	ServiceID    string                 `json:"service_id"`
+	PlanID       string                 `json:"plan_id"`
+	ServerName   string                 `json:"server_name"`
+	ServerUrl    string                 `json:"server_url"`
+	DataverseUrl string                 `json:"dataverse_url"`
+	Params       map[string]interface{} `json:"params,omitempty"`
+	Bindings     []string               `json:"bindings"`
+	// Dataset and version resolved for the open-dataset service
+	Dataset        string `json:"dataset,omitempty"`
+	DatasetVersion string `json:"dataset_version,omitempty"`
+}
+
+// AdminBinding is a binding as shown by the admin API, without credentials
+type AdminBinding struct {
+	ID         string                 `json:"id"`
+	InstanceID string                 `json:"instance_id"`
+	ServiceID  string                 `json:"service_id"`
+	PlanID     string                 `json:"plan_id"`
+	Params     map[string]interface{} `json:"params,omitempty"`
+	// Set when the binding's instance no longer exists
+	Orphaned bool `json:"orphaned"`
+}
+
+// AdminServerHealth is the state of a Dataverse server
+type AdminServerHealth struct {
+	ServerUrl    string `json:"server_url"`
+	CircuitState string `json:"circuit_state"`
+	Failures     int    `json:"consecutive_failures"`
+	// Only set when a live check was requested
+	Reachable *bool  `json:"reachable,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// AdminHandler returns the router for the admin API. It must be served on
+// its own port, behind authentication.
+func (b *BusinessLogic) AdminHandler() http.Handler {
+	router := mux.NewRouter()
+
+	router.HandleFunc("/admin/instances", b.adminListInstances).Methods("GET").Name("admin_list_instances")
+	router.HandleFunc("/admin/instances/{instance_id}", b.adminGetInstance).Methods("GET").Name("admin_get_instance")
+	router.HandleFunc("/admin/instances/{instance_id}", b.adminDeleteInstance).Methods("DELETE").Name("admin_delete_instance")
+	router.HandleFunc("/admin/bindings", b.adminListBindings).Methods("GET").Name("admin_list_bindings")
+	router.HandleFunc("/admin/bindings/{binding_id}", b.adminDeleteBinding).Methods("DELETE").Name("admin_delete_binding")
+	router.HandleFunc("/admin/catalog/reload", b.adminReloadCatalog).Methods("POST").Name("admin_reload_catalog")
+	router.HandleFunc("/admin/health", b.adminHealth).Methods("GET").Name("admin_health")
+	router.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	router.Use(b.auditor.Middleware)
+
+	return router
+}
+
+// readCatalog reads the whitelist for a reload. Unlike FileToService it fails
+// on invalid JSON, incomplete entries and empty whitelists, so a typo can't
+// replace the live catalog.
+func readCatalog(path string) (map[string]*dataverseInstance, error) {
+	jsonPath := filepath.Join(path, "dataverses.json")
+	byteValue, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var dataverseInstances []*dataverseInstance
+	if err = json.Unmarshal(byteValue, &dataverseInstances); err != nil {
+		return nil, fmt.Errorf("invalid whitelist %s: %v", jsonPath, err)
+	}
+	if len(dataverseInstances) == 0 {
+		return nil, fmt.Errorf("whitelist %s has no dataverses", jsonPath)
+	}
+
+	dataverseMap := make(map[string]*dataverseInstance, len(dataverseInstances))
+	for i, dataverse := range dataverseInstances {
+		if dataverse == nil || dataverse.ServiceID == "" || dataverse.PlanID == "" || dataverse.ServerUrl == "" || dataverse.Description == nil {
+			return nil, fmt.Errorf("entry %d of whitelist %s needs a service_id, plan_id, server_url and description", i, jsonPath)
+		}
+		if _, ok := dataverseMap[dataverse.ServiceID]; ok {
+			return nil, fmt.Errorf("service_id %q appears twice in whitelist %s", dataverse.ServiceID, jsonPath)
+		}
+		dataverseMap[dataverse.ServiceID] = dataverse
+	}
+	return dataverseMap, nil
+}
+
+// ReloadCatalog re-reads the whitelist. Existing instances are kept, even if
+// their dataverse was removed from the whitelist. The current catalog is kept
+// if the whitelist is invalid or empty.
+func (b *BusinessLogic) ReloadCatalog() (int, error) {
+	dataverseMap, err := readCatalog(b.catalogPath)
+	if err != nil {
+		glog.Errorf("catalog not reloaded: %v", err)
+		return 0, err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.dataverses = dataverseMap
+
+	glog.Infof("reloaded catalog with %d dataverses", len(dataverseMap))
+	return len(dataverseMap), nil
+}
+
+// adminInstance must be called with the BusinessLogic locked
+func (b *BusinessLogic) adminInstance(instance *dataverseInstance) *AdminInstance {
+	bindings := make([]string, 0)
+	for id, binding := range b.bindings {
+		if binding.InstanceID == instance.ID {
+			bindings = append(bindings, id)
+		}
+	}
+	sort.Strings(bindings)
+
+	admin := &AdminInstance{
+		ID:           instance.ID,
+		ServiceID:    instance.ServiceID,
+		PlanID:       instance.PlanID,
+		ServerName:   instance.ServerName,
+		ServerUrl:    instance.ServerUrl,
+		DataverseUrl: instance.Description.Url,
+		Params:       redactParams(instance.Params),
+		Bindings:     bindings,
+	}
+	if instance.Opened != nil {
+		admin.Dataset = instance.Opened.PersistentID
+		admin.DatasetVersion = instance.Opened.Version
+	}
+	return admin
+}
+
+// adminListInstances filters on the service_id, plan_id and server_url query
+// parameters
+func (b *BusinessLogic) adminListInstances(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	b.RLock()
+	instances := make([]*AdminInstance, 0, len(b.instances))
+	for _, instance := range b.instances {
+		if !matchesFilter(query.Get("service_id"), instance.ServiceID) ||
+			!matchesFilter(query.Get("plan_id"), instance.PlanID) ||
+			!matchesFilter(query.Get("server_url"), instance.ServerUrl) {
+			continue
+		}
+		instances = append(instances, b.adminInstance(instance))
+	}
+	b.RUnlock()
+
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	writeFetchResponse(w, http.StatusOK, instances)
+}
+
+func (b *BusinessLogic) adminGetInstance(w http.ResponseWriter, r *http.Request) {
+	b.RLock()
+	defer b.RUnlock()
+
+	instance, ok := b.instances[mux.Vars(r)[osb.VarKeyInstanceID]]
+	if !ok {
+		writeFetchError(w, osb.HTTPStatusCodeError{StatusCode: http.StatusNotFound})
+		return
+	}
+
+	writeFetchResponse(w, http.StatusOK, b.adminInstance(instance))
+}
+
+// adminDeleteInstance forgets an instance and its bindings without
+// contacting the platform, or Dataverse but to remove the accounts of its
+// bindings
+func (b *BusinessLogic) adminDeleteInstance(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)[osb.VarKeyInstanceID]
+
+	b.RLock()
+	_, ok := b.instances[instanceID]
+	b.RUnlock()
+	if !ok {
+		writeFetchError(w, osb.HTTPStatusCodeError{StatusCode: http.StatusNotFound})
+		return
+	}
+
+	if err := b.removeBindingAccounts(instanceID); err != nil {
+		glog.Errorf("admin: unable to remove accounts of instance %q: %v", instanceID, err)
+		writeFetchError(w, err)
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.deleteInstance(instanceID)
+
+	glog.Infof("admin: force deleted instance %q", instanceID)
+	writeFetchResponse(w, http.StatusOK, map[string]interface{}{})
+}
+
+// adminListBindings filters on the instance_id query parameter, and on
+// orphaned=true for bindings whose instance is gone
+func (b *BusinessLogic) adminListBindings(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	b.RLock()
+	bindings := make([]*AdminBinding, 0, len(b.bindings))
+	for _, binding := range b.bindings {
+		_, exists := b.instances[binding.InstanceID]
+		if !matchesFilter(query.Get("instance_id"), binding.InstanceID) ||
+			(query.Get("orphaned") == "true" && exists) {
+			continue
+		}
+		bindings = append(bindings, &AdminBinding{
+			ID:         binding.ID,
+			InstanceID: binding.InstanceID,
+			ServiceID:  binding.ServiceID,
+			PlanID:     binding.PlanID,
+			Params:     redactParams(binding.Params),
+			Orphaned:   !exists,
+		})
+	}
+	b.RUnlock()
+
+	sort.Slice(bindings, func(i, j int) bool { return bindings[i].ID < bindings[j].ID })
+	writeFetchResponse(w, http.StatusOK, bindings)
+}
+
+func (b *BusinessLogic) adminDeleteBinding(w http.ResponseWriter, r *http.Request) {
+	bindingID := mux.Vars(r)[osb.VarKeyBindingID]
+
+	b.RLock()
+	binding, ok := b.bindings[bindingID]
+	b.RUnlock()
+	if !ok {
+		writeFetchError(w, osb.HTTPStatusCodeError{StatusCode: http.StatusNotFound})
+		return
+	}
+
+	if binding.Account != nil {
+		if settings, ok := b.accounts.settings(binding.Account.ServerUrl); ok {
+			if err := removeManagedAccount(settings, binding.Account); err != nil {
+				glog.Errorf("admin: unable to remove account of binding %q: %v", bindingID, err)
+				writeFetchError(w, err)
+				return
+			}
+		}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.bindings, bindingID)
+
+	glog.Infof("admin: force deleted binding %q", bindingID)
+	writeFetchResponse(w, http.StatusOK, map[string]interface{}{})
+}
+
+func (b *BusinessLogic) adminReloadCatalog(w http.ResponseWriter, r *http.Request) {
+	count, err := b.ReloadCatalog()
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+
+	writeFetchResponse(w, http.StatusOK, map[string]interface{}{
+		"dataverses": count,
+	})
+}
+
+// adminHealth reports the circuit breaker of every whitelisted server, and
+// pings them when called with check=true
+func (b *BusinessLogic) adminHealth(w http.ResponseWriter, r *http.Request) {
+	b.RLock()
+	servers := make(map[string]bool)
+	for _, dataverse := range b.dataverses {
+		servers[dataverse.ServerUrl] = true
+	}
+	b.RUnlock()
+
+	health := make([]*AdminServerHealth, 0, len(servers))
+	for server := range servers {
+		state, failures := backendStatus(server)
+		serverHealth := &AdminServerHealth{
+			ServerUrl:    server,
+			CircuitState: state,
+			Failures:     failures,
+		}
+
+		if r.URL.Query().Get("check") == "true" {
+			reachable, err := PingDataverse(server + "/api/info/version")
+			serverHealth.Reachable = &reachable
+			if err != nil {
+				serverHealth.Error = err.Error()
+			}
+		}
+
+		health = append(health, serverHealth)
+	}
+
+	sort.Slice(health, func(i, j int) bool { return health[i].ServerUrl < health[j].ServerUrl })
+	writeFetchResponse(w, http.StatusOK, health)
+}
+
+func matchesFilter(filter string, value string) bool {
+	return filter == "" || filter == value
+}
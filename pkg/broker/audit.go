@@ -0,0 +1,365 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+
+	"github.com/dataverse-broker/dataverse-broker/pkg/middleware"
+)
+
+// auditFormatVersion is bumped whenever a field of AuditRecord changes
+// meaning or is removed. Adding fields doesn't change it.
+const auditFormatVersion = 1
+
+// AuditRecord is a single line of the audit log. Parameters and credentials
+// are never recorded.
+type AuditRecord struct {
+	FormatVersion int    `json:"format_version"`
+	Time          string `json:"time"`
+	Operation     string `json:"operation"`
+	InstanceID    string `json:"instance_id,omitempty"`
+	BindingID     string `json:"binding_id,omitempty"`
+	ServiceID     string `json:"service_id,omitempty"`
+	PlanID        string `json:"plan_id,omitempty"`
+	// The platform user the request is made on behalf of
+	OriginatingIdentity *AuditIdentity `json:"originating_identity,omitempty"`
+	// The client authenticated by the broker, e.g. the service catalog
+	Caller          string                 `json:"caller,omitempty"`
+	PlatformContext map[string]interface{} `json:"platform_context,omitempty"`
+	// "success" or "failure"
+	Outcome    string  `json:"outcome"`
+	StatusCode int     `json:"status_code"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// AuditIdentity is the originating identity of a request
+type AuditIdentity struct {
+	Platform string      `json:"platform"`
+	Value    interface{} `json:"value,omitempty"`
+}
+
+// Auditor writes AuditRecords as JSON lines
+type Auditor struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// NewAuditor writes the audit log to a file, appending to it, or to stdout
+// when path is "-"
+func NewAuditor(path string) (*Auditor, error) {
+	if path == "-" {
+		return &Auditor{w: os.Stdout}, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Auditor{w: f}, nil
+}
+
+// NewAuditorWriter writes the audit log to w
+func NewAuditorWriter(w io.Writer) *Auditor {
+	return &Auditor{w: w}
+}
+
+// Write appends a record to the log
+func (a *Auditor) Write(record *AuditRecord) {
+	record.FormatVersion = auditFormatVersion
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		glog.Errorf("unable to marshal audit record: %v", err)
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if _, err = a.w.Write(append(data, '\n')); err != nil {
+		glog.Errorf("unable to write audit record: %v", err)
+	}
+}
+
+// finish fills in who made a request and how long it took, and writes its
+// record
+func (a *Auditor) finish(record *AuditRecord, identity *osb.OriginatingIdentity, r *http.Request, start time.Time) {
+	record.Time = start.UTC().Format(time.RFC3339Nano)
+	record.DurationMs = float64(time.Since(start)) / float64(time.Millisecond)
+
+	if identity == nil {
+		identity = originatingIdentityFromRequest(r)
+	}
+	if identity != nil {
+		auditIdentity := &AuditIdentity{Platform: identity.Platform}
+		var value interface{}
+		if json.Unmarshal([]byte(identity.Value), &value) == nil {
+			auditIdentity.Value = value
+		}
+		record.OriginatingIdentity = auditIdentity
+	}
+
+	if user, ok := middleware.UserFromRequest(r); ok {
+		record.Caller = user.Username
+	}
+
+	a.Write(record)
+}
+
+// auditRecordKey is the request context key of the AuditRecord of a request
+type auditRecordKey struct{}
+
+// auditStatusWriter remembers the status code of a response
+type auditStatusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *auditStatusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditStatusWriter) Write(data []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Handler writes an AuditRecord for every request to an endpoint
+// osb-broker-lib doesn't serve, such as the data proxy or the S3 gateway.
+// Handlers name the instance and binding of a request with auditTarget. A nil
+// Auditor audits nothing.
+func (a *Auditor) Handler(operation string, next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Health checks aren't operations, and requests are audited once
+		if r.URL.Path == "/healthz" || r.Context().Value(auditRecordKey{}) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		record := &AuditRecord{Operation: operation}
+		writer := &auditStatusWriter{ResponseWriter: w}
+		next.ServeHTTP(writer, r.WithContext(context.WithValue(r.Context(), auditRecordKey{}, record)))
+
+		record.StatusCode = writer.code
+		if record.StatusCode == 0 {
+			record.StatusCode = http.StatusOK
+		}
+		record.Outcome = "success"
+		if record.StatusCode >= 400 {
+			record.Outcome = "failure"
+		}
+		a.finish(record, nil, r, start)
+	})
+}
+
+// Middleware audits the requests to the named routes of a router, with the
+// name of the route as the operation and its instance_id and binding_id
+// variables as the target
+func (a *Auditor) Middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil || route.GetName() == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		vars := mux.Vars(r)
+		a.Handler(route.GetName(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auditTarget(r, vars[osb.VarKeyInstanceID], vars[osb.VarKeyBindingID])
+			next.ServeHTTP(w, r)
+		})).ServeHTTP(w, r)
+	})
+}
+
+// auditTarget records the instance and binding a request is about, when it
+// is audited
+func auditTarget(r *http.Request, instanceID string, bindingID string) {
+	record, ok := r.Context().Value(auditRecordKey{}).(*AuditRecord)
+	if !ok {
+		return
+	}
+	if instanceID != "" {
+		record.InstanceID = instanceID
+	}
+	if bindingID != "" {
+		record.BindingID = bindingID
+	}
+}
+
+// AuditedBroker wraps a broker.Interface and writes an AuditRecord for every
+// operation it handles
+type AuditedBroker struct {
+	broker.Interface
+	Auditor *Auditor
+}
+
+var _ broker.Interface = &AuditedBroker{}
+
+// tokenPattern matches API keys passed in Dataverse urls
+var tokenPattern = regexp.MustCompile(`(key=)[^&\s"]*`)
+
+// audit fills in the outcome of an operation and writes its record. status
+// is the code osb-broker-lib answers with when the operation succeeds.
+func (a *AuditedBroker) audit(record *AuditRecord, identity *osb.OriginatingIdentity, c *broker.RequestContext, start time.Time, status int, err error) {
+	record.Outcome = "success"
+	record.StatusCode = status
+	if err != nil {
+		record.Outcome = "failure"
+		record.StatusCode = http.StatusInternalServerError
+		if httpErr, ok := osb.IsHTTPError(err); ok {
+			record.StatusCode = httpErr.StatusCode
+		}
+		record.Error = tokenPattern.ReplaceAllString(err.Error(), "${1}REDACTED")
+	}
+
+	var r *http.Request
+	if c != nil {
+		r = c.Request
+	}
+	a.Auditor.finish(record, identity, r, start)
+}
+
+// asyncStatus is the status of an operation that may finish asynchronously
+func asyncStatus(async bool, status int) int {
+	if async {
+		return http.StatusAccepted
+	}
+	return status
+}
+
+func (a *AuditedBroker) GetCatalog(c *broker.RequestContext) (*broker.CatalogResponse, error) {
+	start := time.Now()
+	response, err := a.Interface.GetCatalog(c)
+	a.audit(&AuditRecord{Operation: "get_catalog"}, nil, c, start, http.StatusOK, err)
+	return response, err
+}
+
+func (a *AuditedBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestContext) (*broker.ProvisionResponse, error) {
+	start := time.Now()
+	response, err := a.Interface.Provision(request, c)
+	status := http.StatusCreated
+	if response != nil {
+		status = asyncStatus(response.Async, status)
+		if response.Exists {
+			status = http.StatusOK
+		}
+	}
+	a.audit(&AuditRecord{
+		Operation:       "provision",
+		InstanceID:      request.InstanceID,
+		ServiceID:       request.ServiceID,
+		PlanID:          request.PlanID,
+		PlatformContext: request.Context,
+	}, request.OriginatingIdentity, c, start, status, err)
+	return response, err
+}
+
+func (a *AuditedBroker) Deprovision(request *osb.DeprovisionRequest, c *broker.RequestContext) (*broker.DeprovisionResponse, error) {
+	start := time.Now()
+	response, err := a.Interface.Deprovision(request, c)
+	status := http.StatusOK
+	if response != nil {
+		status = asyncStatus(response.Async, status)
+	}
+	a.audit(&AuditRecord{
+		Operation:  "deprovision",
+		InstanceID: request.InstanceID,
+		ServiceID:  request.ServiceID,
+		PlanID:     request.PlanID,
+	}, request.OriginatingIdentity, c, start, status, err)
+	return response, err
+}
+
+func (a *AuditedBroker) LastOperation(request *osb.LastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
+	start := time.Now()
+	response, err := a.Interface.LastOperation(request, c)
+	record := &AuditRecord{
+		Operation:  "last_operation",
+		InstanceID: request.InstanceID,
+	}
+	if request.ServiceID != nil {
+		record.ServiceID = *request.ServiceID
+	}
+	if request.PlanID != nil {
+		record.PlanID = *request.PlanID
+	}
+	a.audit(record, request.OriginatingIdentity, c, start, http.StatusOK, err)
+	return response, err
+}
+
+func (a *AuditedBroker) Bind(request *osb.BindRequest, c *broker.RequestContext) (*broker.BindResponse, error) {
+	start := time.Now()
+	response, err := a.Interface.Bind(request, c)
+	// osb-broker-lib answers 201 to asynchronous bindings too
+	status := http.StatusCreated
+	if response != nil && response.Exists {
+		status = http.StatusOK
+	}
+	a.audit(&AuditRecord{
+		Operation:       "bind",
+		InstanceID:      request.InstanceID,
+		BindingID:       request.BindingID,
+		ServiceID:       request.ServiceID,
+		PlanID:          request.PlanID,
+		PlatformContext: request.Context,
+	}, request.OriginatingIdentity, c, start, status, err)
+	return response, err
+}
+
+func (a *AuditedBroker) Unbind(request *osb.UnbindRequest, c *broker.RequestContext) (*broker.UnbindResponse, error) {
+	start := time.Now()
+	response, err := a.Interface.Unbind(request, c)
+	a.audit(&AuditRecord{
+		Operation:  "unbind",
+		InstanceID: request.InstanceID,
+		BindingID:  request.BindingID,
+		ServiceID:  request.ServiceID,
+		PlanID:     request.PlanID,
+	}, request.OriginatingIdentity, c, start, http.StatusOK, err)
+	return response, err
+}
+
+func (a *AuditedBroker) Update(request *osb.UpdateInstanceRequest, c *broker.RequestContext) (*broker.UpdateInstanceResponse, error) {
+	start := time.Now()
+	response, err := a.Interface.Update(request, c)
+	record := &AuditRecord{
+		Operation:       "update",
+		InstanceID:      request.InstanceID,
+		ServiceID:       request.ServiceID,
+		PlatformContext: request.Context,
+	}
+	if request.PlanID != nil {
+		record.PlanID = *request.PlanID
+	}
+	status := http.StatusOK
+	if response != nil {
+		status = asyncStatus(response.Async, status)
+	}
+	a.audit(record, request.OriginatingIdentity, c, start, status, err)
+	return response, err
+}
@@ -0,0 +1,438 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// BackendLimits holds the limits applied to every request the broker sends to
+// a single Dataverse server
+type BackendLimits struct {
+	// Maximum number of requests in flight at once, 0 for no limit
+	MaxConcurrent int `json:"max_concurrent"`
+	// Token bucket refill rate and size, 0 requests_per_second for no limit
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+	// How long a request may wait for a concurrency slot or a token
+	WaitSeconds int `json:"wait_seconds"`
+	// Consecutive failures before the circuit breaker opens, 0 to disable
+	FailureThreshold int `json:"failure_threshold"`
+	// How long the breaker stays open before letting a trial request through
+	OpenSeconds int `json:"open_seconds"`
+}
+
+// BackendConfig holds the default limits and per-server overrides, keyed by
+// ServerUrl (e.g. "https://demo.dataverse.org")
+type BackendConfig struct {
+	Default BackendLimits            `json:"default"`
+	Servers map[string]BackendLimits `json:"servers,omitempty"`
+}
+
+// DefaultBackendConfig is used when no backend config file is given
+var DefaultBackendConfig = BackendConfig{
+	Default: BackendLimits{
+		MaxConcurrent:     4,
+		RequestsPerSecond: 5,
+		Burst:             10,
+		WaitSeconds:       30,
+		FailureThreshold:  5,
+		OpenSeconds:       30,
+	},
+}
+
+// dataverseResponseTimeout is how long a Dataverse server may take to start
+// answering a request. Downloads may take longer once the answer started.
+const dataverseResponseTimeout = 2 * time.Minute
+
+// dataverseClient sends the requests to Dataverse servers. Unlike
+// http.DefaultClient it gives up on servers that don't answer.
+var dataverseClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: dataverseResponseTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	},
+}
+
+// Circuit breaker states, also reported as the value of the breaker metric
+const (
+	breakerClosed   = 0
+	breakerOpen     = 1
+	breakerHalfOpen = 2
+)
+
+// backend guards the requests sent to a single Dataverse server
+type backend struct {
+	server  string
+	limits  BackendLimits
+	slots   chan struct{}
+	limiter *rate.Limiter
+
+	sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// backendPool maps server keys (scheme://host) to their backend
+type backendPool struct {
+	sync.Mutex
+	config   BackendConfig
+	backends map[string]*backend
+}
+
+var backends = &backendPool{
+	config:   DefaultBackendConfig,
+	backends: make(map[string]*backend),
+}
+
+// Metrics describing the backends, registered through BackendMetrics
+var (
+	backendRequests = prom.NewCounterVec(prom.CounterOpts{
+		Name: "dataverse_backend_requests_total",
+		Help: "Requests sent to Dataverse servers, by outcome.",
+	}, []string{"server", "outcome"})
+	backendInFlight = prom.NewGaugeVec(prom.GaugeOpts{
+		Name: "dataverse_backend_requests_in_flight",
+		Help: "Requests currently in flight to Dataverse servers.",
+	}, []string{"server"})
+	backendBreaker = prom.NewGaugeVec(prom.GaugeOpts{
+		Name: "dataverse_backend_circuit_state",
+		Help: "Circuit breaker state per Dataverse server (0 closed, 1 open, 2 half-open).",
+	}, []string{"server"})
+	backendLatency = prom.NewHistogramVec(prom.HistogramOpts{
+		Name: "dataverse_backend_request_duration_seconds",
+		Help: "Latency of requests sent to Dataverse servers.",
+	}, []string{"server"})
+)
+
+// backendMetricsCollector collects the backend metrics
+type backendMetricsCollector struct{}
+
+// BackendMetrics returns a collector for the per-server request, in-flight,
+// circuit breaker and latency metrics
+func BackendMetrics() prom.Collector {
+	return backendMetricsCollector{}
+}
+
+// Describe returns all descriptions of the collector.
+func (backendMetricsCollector) Describe(ch chan<- *prom.Desc) {
+	backendRequests.Describe(ch)
+	backendInFlight.Describe(ch)
+	backendBreaker.Describe(ch)
+	backendLatency.Describe(ch)
+}
+
+// Collect returns the current state of all metrics of the collector.
+func (backendMetricsCollector) Collect(ch chan<- prom.Metric) {
+	backendRequests.Collect(ch)
+	backendInFlight.Collect(ch)
+	backendBreaker.Collect(ch)
+	backendLatency.Collect(ch)
+}
+
+// FileToBackendConfig reads a backend config from a JSON file, filling in
+// DefaultBackendConfig for a missing "default" entry
+func FileToBackendConfig(path string) (BackendConfig, error) {
+	config := BackendConfig{}
+
+	byteValue, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	if err = json.Unmarshal(byteValue, &config); err != nil {
+		return config, err
+	}
+
+	if config.Default == (BackendLimits{}) {
+		config.Default = DefaultBackendConfig.Default
+	}
+
+	return config, nil
+}
+
+// ConfigureBackends replaces the limits used for Dataverse servers. Existing
+// circuit breaker state is discarded.
+func ConfigureBackends(config BackendConfig) {
+	backends.Lock()
+	defer backends.Unlock()
+
+	backends.config = config
+	backends.backends = make(map[string]*backend)
+}
+
+// serverKey reduces a url to scheme://host, which identifies its server
+func serverKey(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("no host in url %q", rawurl)
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// get returns the backend for a server, creating it on first use
+func (p *backendPool) get(server string) *backend {
+	p.Lock()
+	defer p.Unlock()
+
+	if b, ok := p.backends[server]; ok {
+		return b
+	}
+
+	limits, ok := p.config.Servers[server]
+	if !ok {
+		limits = p.config.Default
+	}
+
+	b := &backend{
+		server: server,
+		limits: limits,
+	}
+	if limits.MaxConcurrent > 0 {
+		b.slots = make(chan struct{}, limits.MaxConcurrent)
+	}
+	if limits.RequestsPerSecond > 0 {
+		burst := limits.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		b.limiter = rate.NewLimiter(rate.Limit(limits.RequestsPerSecond), burst)
+	}
+	backendBreaker.WithLabelValues(server).Set(breakerClosed)
+
+	p.backends[server] = b
+	return b
+}
+
+// allow checks the circuit breaker before a request. In the half-open state
+// only a single trial request is let through.
+func (b *backend) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < time.Duration(b.limits.OpenSeconds)*time.Second {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.trial = true
+		return true
+	case breakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+// record feeds the outcome of a request into the circuit breaker
+func (b *backend) record(failed bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.trial = false
+
+	if !failed {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.limits.FailureThreshold > 0 && b.failures >= b.limits.FailureThreshold) {
+		if b.state != breakerOpen {
+			glog.Warningf("circuit breaker for %s opened after %d consecutive failures", b.server, b.failures)
+		}
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// abandon lets the next request try when a request ended without telling
+// whether the server is healthy
+func (b *backend) abandon() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.trial = false
+}
+
+// setState must be called with the backend locked
+func (b *backend) setState(state int) {
+	b.state = state
+	backendBreaker.WithLabelValues(b.server).Set(float64(state))
+}
+
+// acquire waits for a concurrency slot and a rate limit token
+func (b *backend) acquire(ctx context.Context) error {
+	if b.slots != nil {
+		select {
+		case b.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if b.limiter != nil {
+		if err := b.limiter.Wait(ctx); err != nil {
+			b.release()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *backend) release() {
+	if b.slots != nil {
+		<-b.slots
+	}
+}
+
+// backendBody releases the concurrency slot of a request once its response
+// body is closed, so streamed downloads count against MaxConcurrent
+type backendBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *backendBody) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// backendUnavailable is returned in place of a request that was not sent
+func backendUnavailable(server string, reason string) error {
+	description := fmt.Sprintf("Dataverse server %s is unavailable: %s", server, reason)
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusServiceUnavailable,
+		Description: &description,
+	}
+}
+
+// isBackendUnavailable tells if err was returned by backendUnavailable
+func isBackendUnavailable(err error) bool {
+	httpErr, ok := err.(osb.HTTPStatusCodeError)
+	return ok && httpErr.StatusCode == http.StatusServiceUnavailable
+}
+
+// doDataverseRequest sends a request to a Dataverse server, subject to that
+// server's concurrency limit, rate limit and circuit breaker. Transport errors
+// and 5xx responses count as failures, requests canceled by the client don't.
+// The concurrency slot is held until the response body is closed.
+func doDataverseRequest(req *http.Request) (*http.Response, error) {
+	server, err := serverKey(req.URL.String())
+	if err != nil {
+		return nil, err
+	}
+	b := backends.get(server)
+
+	if !b.allow() {
+		backendRequests.WithLabelValues(server, "rejected").Inc()
+		return nil, backendUnavailable(server, "circuit breaker open")
+	}
+
+	ctx := req.Context()
+	if b.limits.WaitSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(b.limits.WaitSeconds)*time.Second)
+		defer cancel()
+	}
+	if err := b.acquire(ctx); err != nil {
+		// The trial slot was never used, let the next request try
+		b.abandon()
+		backendRequests.WithLabelValues(server, "throttled").Inc()
+		return nil, backendUnavailable(server, "too many requests")
+	}
+
+	backendInFlight.WithLabelValues(server).Inc()
+	release := func() {
+		backendInFlight.WithLabelValues(server).Dec()
+		b.release()
+	}
+
+	start := time.Now()
+	resp, err := dataverseClient.Do(req)
+	backendLatency.WithLabelValues(server).Observe(time.Since(start).Seconds())
+
+	switch {
+	case err != nil && req.Context().Err() == context.Canceled:
+		// The client went away, which says nothing about the server
+		b.abandon()
+		backendRequests.WithLabelValues(server, "canceled").Inc()
+	case err != nil || resp.StatusCode >= 500:
+		b.record(true)
+		backendRequests.WithLabelValues(server, "failure").Inc()
+	default:
+		b.record(false)
+		backendRequests.WithLabelValues(server, "success").Inc()
+	}
+
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &backendBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// dataverseGet is http.Get through the server's backend limits
+func dataverseGet(rawurl string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	return doDataverseRequest(req)
+}
+
+// backendStatus returns the circuit breaker state and consecutive failures of
+// a server. Servers that haven't been contacted yet are closed.
+func backendStatus(serverUrl string) (string, int) {
+	server, err := serverKey(serverUrl)
+	if err != nil {
+		return "unknown", 0
+	}
+	b := backends.get(server)
+
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		return "open", b.failures
+	case breakerHalfOpen:
+		return "half-open", b.failures
+	}
+	return "closed", b.failures
+}
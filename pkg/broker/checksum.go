@@ -0,0 +1,54 @@
+package broker
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// NewHash returns a hash for the checksum's algorithm, as named by Dataverse:
+// MD5, SHA-1, SHA-256 or SHA-512
+func (c DatafileChecksum) NewHash() (hash.Hash, error) {
+	switch strings.ToUpper(c.Type) {
+	case "MD5":
+		return md5.New(), nil
+	case "SHA-1", "SHA1":
+		return sha1.New(), nil
+	case "SHA-256", "SHA256":
+		return sha256.New(), nil
+	case "SHA-512", "SHA512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum type %q", c.Type)
+}
+
+// Matches compares the checksum to the sum of a hash
+func (c DatafileChecksum) Matches(h hash.Hash) bool {
+	return strings.EqualFold(c.Value, hex.EncodeToString(h.Sum(nil)))
+}
+
+// VerifyFile checks that the file at path has the checksum
+func (c DatafileChecksum) VerifyFile(path string) (bool, error) {
+	h, err := c.NewHash()
+	if err != nil {
+		return false, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err = io.Copy(h, f); err != nil {
+		return false, err
+	}
+	return c.Matches(h), nil
+}
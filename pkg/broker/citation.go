@@ -0,0 +1,105 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// citationFormats are the formats of the citation in binding credentials,
+// by credential, as named by the Dataverse citation export API
+var citationFormats = map[string]string{
+	"citation_bibtex": "BibTeX",
+	"citation_ris":    "RIS",
+}
+
+// citation is the plain text citation of a dataset version
+type citation struct {
+	Message string `json:"message"`
+}
+
+// exportCitation returns the citation of a dataset version in one of the
+// formats of the citation export API, which answers with the citation itself
+// rather than the usual JSON envelope
+func exportCitation(serverUrl string, pid string, version string, format string, token string) (string, error) {
+	query := "?" + url.Values{"persistentId": {pid}}.Encode()
+	req, err := http.NewRequest("GET", serverUrl+"/api/datasets/:persistentId/versions/"+version+"/citation/"+format+query, nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("X-Dataverse-key", token)
+	}
+
+	resp, err := doDataverseRequest(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		response := nativeResponse{}
+		json.Unmarshal(body, &response)
+		description := response.Message
+		if description == "" {
+			description = fmt.Sprintf("Dataverse answered %s to GET %s", resp.Status, req.URL.Path)
+		}
+		return "", dataverseError(resp.StatusCode, description)
+	}
+	return string(body), nil
+}
+
+// instanceCitations are the citations of the dataset of an instance, for the
+// version it is pinned to or the current one, nil when the instance has no
+// dataset. Citations are a convenience: those Dataverse can't give, such as
+// the formats of servers older than 6.4, are left out rather than failing the
+// binding.
+func instanceCitations(instance *dataverseInstance, version string) map[string]interface{} {
+	pid := instance.datasetPID()
+	if pid == "" {
+		return nil
+	}
+	token, _ := instance.Params["credentials"].(string)
+
+	citations := map[string]interface{}{}
+	if instance.Description.Citation != "" {
+		citations["citation"] = instance.Description.Citation
+	}
+
+	var err error
+	if version == "" {
+		if version, err = resolveVersion(instance.ServerUrl, pid, ":latest", token); err != nil {
+			glog.Warningf("citation: unable to resolve version of %s: %s", pid, errorDescription(err))
+			return citations
+		}
+	}
+	citations["citation_version"] = version
+
+	text := citation{}
+	query := "?" + url.Values{"persistentId": {pid}}.Encode()
+	err = nativeAPI("GET", instance.ServerUrl+"/api/datasets/:persistentId/versions/"+version+"/citation"+query, token, nil, &text)
+	if err != nil {
+		glog.Warningf("citation: unable to get citation of %s version %s: %s", pid, version, errorDescription(err))
+	} else if text.Message != "" {
+		citations["citation"] = strings.TrimSpace(text.Message)
+	}
+
+	for key, format := range citationFormats {
+		exported, err := exportCitation(instance.ServerUrl, pid, version, format, token)
+		if err != nil {
+			glog.Warningf("citation: unable to export %s citation of %s version %s: %s", format, pid, version, errorDescription(err))
+			continue
+		}
+		citations[key] = exported
+	}
+	return citations
+}
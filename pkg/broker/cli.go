@@ -2,14 +2,31 @@ package broker
 
 import (
 	"flag"
+	"os"
+	"path/filepath"
+	"time"
 )
 
 // Options holds the options specified by the broker's code on the command
 // line. Users should add their own options here and add flags for them in
 // AddFlags.
 type Options struct {
-	CatalogPath string
-	Async       bool
+	CatalogPath       string
+	Async             bool
+	BackendConfigPath string
+	PolicyPath        string
+	AuditLogPath      string
+	ManifestPageSize  int
+	ProxyURL          string
+	ProxyCacheDir     string
+	ProxyCacheMaxMB   int
+	SigningKeysPath   string
+	SignedURLTTL      time.Duration
+	S3URL             string
+	S3Region          string
+	DepositRetention  string
+	SandboxRetention  string
+	ManagedAccounts   string
 }
 
 // AddFlags is a hook called to initialize the CLI flags for broker options.
@@ -18,4 +35,18 @@ type Options struct {
 func AddFlags(o *Options) {
 	flag.StringVar(&o.CatalogPath, "catalogPath", "", "The path to the catalog")
 	flag.BoolVar(&o.Async, "async", false, "Indicates whether the broker is handling the requests asynchronously.")
+	flag.StringVar(&o.BackendConfigPath, "backendConfig", "", "Path to a JSON file with per-server concurrency, rate limit and circuit breaker settings")
+	flag.StringVar(&o.PolicyPath, "policyPath", "", "Path to a JSON policy mapping namespaces, groups and users to the services and plans they may use")
+	flag.StringVar(&o.AuditLogPath, "auditLog", "", "File to append the JSON lines audit log of broker operations to, or '-' for stdout")
+	flag.IntVar(&o.ManifestPageSize, "manifestPageSize", defaultManifestPageSize, "Number of files listed in binding credentials and per page of the binding manifest endpoint")
+	flag.StringVar(&o.ProxyURL, "proxyUrl", "", "External URL of the data proxy. When set, bindings get a credential for the proxy instead of the Dataverse API token")
+	flag.StringVar(&o.ProxyCacheDir, "proxyCacheDir", filepath.Join(os.TempDir(), "dataverse-broker-cache"), "Directory where the data proxy and the S3 gateway cache files")
+	flag.IntVar(&o.ProxyCacheMaxMB, "proxyCacheMaxMB", 10240, "Size of the file cache in MB, 0 for no limit")
+	flag.StringVar(&o.SigningKeysPath, "signingKeys", "", "Path to a JSON file with the HMAC keys of signed download links. When set, bindings get expiring links to the data proxy instead of a token; requires --proxyUrl")
+	flag.StringVar(&o.S3URL, "s3Url", "", "External URL of the S3 gateway. When set, bindings also get S3 access keys for a bucket of their files")
+	flag.StringVar(&o.S3Region, "s3Region", defaultS3Region, "Region S3 clients must sign requests for")
+	flag.StringVar(&o.DepositRetention, "depositRetention", DepositRetentionKeep, "What deprovisioning does to published deposit datasets: 'keep', or 'discard-draft' to delete their unpublished changes. Unpublished datasets are always deleted")
+	flag.StringVar(&o.SandboxRetention, "sandboxRetention", SandboxRetentionFail, "What deprovisioning does to sandbox dataverses that aren't empty: 'fail' to keep the instance, or 'retain' to leave the dataverse and delete the instance")
+	flag.StringVar(&o.ManagedAccounts, "managedAccounts", "", "Path to a JSON file with the admin tokens of the Dataverse servers on which every binding gets its own read-only account instead of the provisioner's API key")
+	flag.DurationVar(&o.SignedURLTTL, "signedUrlTtl", 15*time.Minute, "How long signed download links are valid")
 }
@@ -0,0 +1,299 @@
+package broker
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/golang/glog"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// What happens to deposited datasets that were published when their instance
+// is deprovisioned. Datasets never published are always deleted.
+const (
+	// DepositRetentionKeep leaves the dataset as it is, including any draft
+	DepositRetentionKeep = "keep"
+	// DepositRetentionDiscardDraft deletes the unpublished draft version,
+	// keeping the published versions
+	DepositRetentionDiscardDraft = "discard-draft"
+)
+
+// depositSubjects is the controlled vocabulary of the citation block's
+// subject field
+var depositSubjects = []string{
+	"Agricultural Sciences",
+	"Arts and Humanities",
+	"Astronomy and Astrophysics",
+	"Business and Management",
+	"Chemistry",
+	"Computer and Information Science",
+	"Earth and Environmental Sciences",
+	"Engineering",
+	"Law",
+	"Mathematical Sciences",
+	"Medicine, Health and Life Sciences",
+	"Physics",
+	"Social Sciences",
+	"Other",
+}
+
+// depositDataset is a draft dataset created when provisioning the deposit
+// plan
+type depositDataset struct {
+	ID           int    `json:"id"`
+	PersistentID string `json:"persistentId"`
+}
+
+// depositPlanID is the ID of the deposit plan of a dataverse service
+func depositPlanID(planID string) string {
+	return planID + "-deposit"
+}
+
+// isDepositPlan tells if planID is the deposit plan of the dataverse
+func isDepositPlan(dataverse *dataverseInstance, planID string) bool {
+	return dataverse.Description.Type != "dataset" && planID == depositPlanID(dataverse.PlanID)
+}
+
+// depositPlan is the catalog entry of the deposit plan of a dataverse
+func depositPlan(dataverse *dataverseInstance) osb.Plan {
+	return osb.Plan{
+		Name:        "deposit",
+		ID:          depositPlanID(dataverse.PlanID),
+		Description: "A new draft dataset in " + dataverse.Description.Name + " to upload files to",
+		Free:        truePtr(),
+		Schemas: &osb.Schemas{
+			ServiceInstance: &osb.ServiceInstanceSchema{
+				Create: &osb.InputParametersSchema{
+					Parameters: map[string]interface{}{
+						"type":     "object",
+						"required": []string{"credentials", "title", "authors", "description", "subject"},
+						"properties": map[string]interface{}{
+							"credentials": map[string]interface{}{
+								"type":        "string",
+								"description": "API key of a Dataverse user allowed to add datasets to the dataverse",
+							},
+							"title": map[string]interface{}{
+								"type":        "string",
+								"description": "Title of the dataset",
+							},
+							"authors": map[string]interface{}{
+								"type":        "array",
+								"description": "Names of the authors, as \"Family, Given\"",
+								"items":       map[string]interface{}{"type": "string"},
+							},
+							"description": map[string]interface{}{
+								"type":        "string",
+								"description": "Description of the dataset",
+							},
+							"subject": map[string]interface{}{
+								"type":        "string",
+								"description": "Subject of the dataset",
+								"enum":        depositSubjects,
+							},
+							"contact": map[string]interface{}{
+								"type":        "string",
+								"description": "E-mail address of the dataset contact, required by most servers",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func primitiveField(typeName string, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"typeName":  typeName,
+		"typeClass": "primitive",
+		"multiple":  false,
+		"value":     value,
+	}
+}
+
+func compoundField(typeName string, values []map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"typeName":  typeName,
+		"typeClass": "compound",
+		"multiple":  true,
+		"value":     values,
+	}
+}
+
+// depositMetadata validates the provision parameters of the deposit plan and
+// returns the dataset to create, in the format of the native API
+func depositMetadata(params map[string]interface{}) (map[string]interface{}, error) {
+	if _, err := stringParam(params, "credentials"); err != nil {
+		return nil, badRequest("A Dataverse API key is required to create a dataset")
+	}
+	title, err := stringParam(params, "title")
+	if err != nil {
+		return nil, err
+	}
+	authors, err := stringsParam(params, "authors")
+	if err != nil {
+		return nil, err
+	}
+	description, err := stringParam(params, "description")
+	if err != nil {
+		return nil, err
+	}
+	subject, err := stringParam(params, "subject")
+	if err != nil {
+		return nil, err
+	}
+	if !containsString(depositSubjects, subject) {
+		return nil, badRequest(fmt.Sprintf("Unknown subject %q", subject))
+	}
+
+	authorValues := make([]map[string]interface{}, 0, len(authors))
+	for _, author := range authors {
+		authorValues = append(authorValues, map[string]interface{}{
+			"authorName": primitiveField("authorName", author),
+		})
+	}
+
+	fields := []interface{}{
+		primitiveField("title", title),
+		compoundField("author", authorValues),
+		compoundField("dsDescription", []map[string]interface{}{
+			{"dsDescriptionValue": primitiveField("dsDescriptionValue", description)},
+		}),
+		map[string]interface{}{
+			"typeName":  "subject",
+			"typeClass": "controlledVocabulary",
+			"multiple":  true,
+			"value":     []string{subject},
+		},
+	}
+	if contact, ok := params["contact"].(string); ok && contact != "" {
+		fields = append(fields, compoundField("datasetContact", []map[string]interface{}{
+			{"datasetContactEmail": primitiveField("datasetContactEmail", contact)},
+		}))
+	}
+
+	return map[string]interface{}{
+		"datasetVersion": map[string]interface{}{
+			"metadataBlocks": map[string]interface{}{
+				"citation": map[string]interface{}{
+					"displayName": "Citation Metadata",
+					"fields":      fields,
+				},
+			},
+		},
+	}, nil
+}
+
+// createDeposit creates the draft dataset of a deposit instance
+func createDeposit(instance *dataverseInstance) (*depositDataset, error) {
+	metadata, err := depositMetadata(instance.Params)
+	if err != nil {
+		return nil, err
+	}
+	token := instance.Params["credentials"].(string)
+
+	dataset := &depositDataset{}
+	err = nativeAPI("POST", instance.ServerUrl+"/api/dataverses/"+url.PathEscape(instance.Description.Identifier)+"/datasets",
+		token, metadata, dataset)
+	if err != nil {
+		return nil, err
+	}
+
+	glog.Infof("deposit: created dataset %s in %q for instance %q", dataset.PersistentID, instance.Description.Identifier, instance.ID)
+	return dataset, nil
+}
+
+// deprovisionDeposit removes the dataset of a deposit instance in the
+// background once Dataverse releases its locks, and forgets the instance when
+// done. It must be called with the BusinessLogic locked.
+func (b *BusinessLogic) deprovisionDeposit(instance *dataverseInstance) *osb.OperationKey {
+	serverUrl, pid, retention := instance.ServerUrl, instance.Deposit.PersistentID, b.depositRetention
+	token, _ := instance.Params["credentials"].(string)
+
+	return b.startOperation(instance, deprovisionOperation, func() error {
+		if err := WaitForDatasetLocks(serverUrl, pid, token); err != nil && !isNotFound(err) {
+			return err
+		}
+		return removeDeposit(instance, retention)
+	}, func(err error) {
+		if err == nil {
+			b.deleteInstance(instance.ID)
+		}
+	})
+}
+
+// datasetVersion is an entry of the Dataverse dataset versions API
+type datasetVersion struct {
+	VersionState       string `json:"versionState"`
+	VersionNumber      int    `json:"versionNumber"`
+	VersionMinorNumber int    `json:"versionMinorNumber"`
+}
+
+// removeDeposit deletes the dataset of a deposit instance if it was never
+// published, and applies the retention otherwise
+func removeDeposit(instance *dataverseInstance, retention string) error {
+	token, _ := instance.Params["credentials"].(string)
+	pid := instance.Deposit.PersistentID
+	query := "?" + url.Values{"persistentId": {pid}}.Encode()
+
+	versions := make([]datasetVersion, 0)
+	err := nativeAPI("GET", instance.ServerUrl+"/api/datasets/:persistentId/versions"+query, token, nil, &versions)
+	if isNotFound(err) {
+		glog.Infof("deposit: dataset %s of instance %q is already gone", pid, instance.ID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	published := false
+	draft := false
+	for _, version := range versions {
+		if version.VersionState == "DRAFT" {
+			draft = true
+		} else {
+			published = true
+		}
+	}
+
+	if !published || (draft && retention == DepositRetentionDiscardDraft) {
+		if err = checkDatasetLocks(instance.ServerUrl, pid, token); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case !published:
+		err = nativeAPI("DELETE", instance.ServerUrl+"/api/datasets/:persistentId/"+query, token, nil, nil)
+		if err == nil {
+			glog.Infof("deposit: deleted unpublished dataset %s of instance %q", pid, instance.ID)
+		}
+	case draft && retention == DepositRetentionDiscardDraft:
+		err = nativeAPI("DELETE", instance.ServerUrl+"/api/datasets/:persistentId/versions/:draft"+query, token, nil, nil)
+		if err == nil {
+			glog.Infof("deposit: discarded draft of published dataset %s of instance %q", pid, instance.ID)
+		}
+	default:
+		glog.Infof("deposit: keeping published dataset %s of instance %q", pid, instance.ID)
+	}
+
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// depositCredentials are the binding credentials specific to deposit
+// instances
+func depositCredentials(instance *dataverseInstance) map[string]interface{} {
+	pid := instance.Deposit.PersistentID
+	query := "?" + url.Values{"persistentId": {pid}}.Encode()
+	return map[string]interface{}{
+		"dataset": pid,
+		"upload_endpoints": map[string]interface{}{
+			"native": instance.ServerUrl + "/api/datasets/:persistentId/add" + query,
+			"sword":  instance.ServerUrl + "/dvn/api/data-deposit/v1.1/swordv2/edit-media/study/" + pid,
+		},
+	}
+}
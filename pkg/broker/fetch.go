@@ -0,0 +1,213 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// GetInstanceResponse is the body of a fetch instance response (OSB 2.14)
+type GetInstanceResponse struct {
+	ServiceID    string                 `json:"service_id"`
+	PlanID       string                 `json:"plan_id"`
+	DashboardURL string                 `json:"dashboard_url,omitempty"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// GetInstance returns a provisioned instance
+func (b *BusinessLogic) GetInstance(instanceID string) (*GetInstanceResponse, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	instance, ok := b.instances[instanceID]
+	if !ok {
+		return nil, osb.HTTPStatusCodeError{
+			StatusCode: http.StatusNotFound,
+		}
+	}
+
+	return &GetInstanceResponse{
+		ServiceID:    instance.ServiceID,
+		PlanID:       instance.PlanID,
+		DashboardURL: instance.Description.Url,
+		Parameters:   redactParams(instance.Params),
+	}, nil
+}
+
+// GetBinding returns a binding of a provisioned instance
+func (b *BusinessLogic) GetBinding(instanceID string, bindingID string) (*osb.GetBindingResponse, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	binding, ok := b.bindings[bindingID]
+	if !ok || binding.InstanceID != instanceID {
+		return nil, osb.HTTPStatusCodeError{
+			StatusCode: http.StatusNotFound,
+		}
+	}
+
+	return &osb.GetBindingResponse{
+		Credentials: b.bindingCredentials(binding),
+		Parameters:  binding.Params,
+	}, nil
+}
+
+// RegisterFetchHandlers adds the fetch instance and fetch binding endpoints
+// of OSB 2.14, which osb-broker-lib doesn't serve, to the broker's router.
+// They are audited by the Auditor's Middleware, which must be used on the
+// router after the authenticating middleware.
+func (b *BusinessLogic) RegisterFetchHandlers(router *mux.Router) {
+	router.HandleFunc("/v2/service_instances/{instance_id}", b.getInstanceHandler).Methods("GET").Name("get_instance")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.getBindingHandler).Methods("GET").Name("get_binding")
+	router.Use(advertiseInstanceFetch)
+}
+
+// catalogRecorder holds the catalog response so it can be amended
+type catalogRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *catalogRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *catalogRecorder) WriteHeader(code int) {
+	r.code = code
+}
+
+func (r *catalogRecorder) Write(data []byte) (int, error) {
+	return r.body.Write(data)
+}
+
+// advertiseInstanceFetch adds instances_retrievable to the services of the
+// catalog with bindings_retrievable, which GetCatalog sets for the versions
+// with the fetch endpoints. The OSB client types predate the field.
+func advertiseInstanceFetch(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/v2/catalog" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := &catalogRecorder{header: w.Header(), code: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		body := recorder.body.Bytes()
+		catalog := map[string]interface{}{}
+		if recorder.code == http.StatusOK && json.Unmarshal(body, &catalog) == nil {
+			services, _ := catalog["services"].([]interface{})
+			for _, s := range services {
+				if service, ok := s.(map[string]interface{}); ok && service["bindings_retrievable"] == true {
+					service["instances_retrievable"] = true
+				}
+			}
+			if amended, err := json.Marshal(catalog); err == nil {
+				body = amended
+			}
+		}
+
+		w.Header().Del("Content-Length")
+		w.WriteHeader(recorder.code)
+		w.Write(body)
+	})
+}
+
+func (b *BusinessLogic) getInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	if err := validateFetchAPIVersion(r); err != nil {
+		writeFetchError(w, err)
+		return
+	}
+
+	vars := mux.Vars(r)
+	response, err := b.GetInstance(vars[osb.VarKeyInstanceID])
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+
+	writeFetchResponse(w, http.StatusOK, response)
+}
+
+func (b *BusinessLogic) getBindingHandler(w http.ResponseWriter, r *http.Request) {
+	if err := validateFetchAPIVersion(r); err != nil {
+		writeFetchError(w, err)
+		return
+	}
+
+	vars := mux.Vars(r)
+	response, err := b.GetBinding(vars[osb.VarKeyInstanceID], vars[osb.VarKeyBindingID])
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+
+	writeFetchResponse(w, http.StatusOK, response)
+}
+
+// validateFetchAPIVersion checks the version is supported and new enough
+// for the fetch endpoints
+func validateFetchAPIVersion(r *http.Request) error {
+	version := r.Header.Get(osb.APIVersionHeader)
+	if err := validateAPIVersion(version); err != nil {
+		return err
+	}
+
+	v, _ := parseAPIVersion(version)
+	if !v.atLeast(fetchAPIVersion) {
+		return versionError("Fetching instances and bindings requires " + osb.APIVersionHeader + " " + fetchAPIVersion.String())
+	}
+
+	return nil
+}
+
+func writeFetchResponse(w http.ResponseWriter, code int, object interface{}) {
+	data, err := json.Marshal(object)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// writeFetchError writes errors the way osb-broker-lib does
+func writeFetchError(w http.ResponseWriter, err error) {
+	type e struct {
+		ErrorMessage *string `json:"error,omitempty"`
+		Description  *string `json:"description,omitempty"`
+	}
+
+	if httpErr, ok := osb.IsHTTPError(err); ok {
+		writeFetchResponse(w, httpErr.StatusCode, &e{
+			ErrorMessage: httpErr.ErrorMessage,
+			Description:  httpErr.Description,
+		})
+		return
+	}
+
+	description := err.Error()
+	writeFetchResponse(w, http.StatusInternalServerError, &e{Description: &description})
+}
+
+// redactParams hides the Dataverse API token in instance parameters
+func redactParams(params map[string]interface{}) map[string]interface{} {
+	if params == nil {
+		return nil
+	}
+	redacted := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		if k == "credentials" {
+			v = "REDACTED"
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
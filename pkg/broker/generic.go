@@ -0,0 +1,219 @@
+package broker
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// dataverseAliasPattern matches the aliases Dataverse allows
+var dataverseAliasPattern = regexp.MustCompile(`^(:root|[a-zA-Z0-9_-]+)$`)
+
+// genericServiceID is the ID of the service giving access to any dataverse of
+// a whitelisted server. It only depends on the server, so it stays the same
+// across restarts and reloads.
+func genericServiceID(serverUrl string) string {
+	sum := sha1.Sum([]byte(strings.TrimSuffix(serverUrl, "/")))
+	return "dataverse-server-" + hex.EncodeToString(sum[:8])
+}
+
+// genericPlanID is the ID of the plan of a generic service
+func genericPlanID(serviceID string) string {
+	return serviceID + "-default"
+}
+
+// genericServer returns the server of a generic service ID. It must be called
+// with the BusinessLogic locked.
+func (b *BusinessLogic) genericServer(serviceID string) (string, string, bool) {
+	servers, names := b.allowedServers()
+	for _, serverUrl := range servers {
+		if genericServiceID(serverUrl) == serviceID {
+			return serverUrl, names[serverUrl], true
+		}
+	}
+	return "", "", false
+}
+
+// genericServices are the catalog entries of the generic service of every
+// whitelisted server. It must be called with the BusinessLogic locked.
+func (b *BusinessLogic) genericServices() []osb.Service {
+	servers, names := b.allowedServers()
+	services := make([]osb.Service, 0, len(servers))
+	for _, serverUrl := range servers {
+		name := names[serverUrl]
+		if name == "" {
+			name = serverUrl
+		}
+		id := genericServiceID(serverUrl)
+
+		services = append(services, osb.Service{
+			Name:          id,
+			ID:            id,
+			Description:   "Any dataverse on " + serverUrl,
+			Bindable:      true,
+			PlanUpdatable: truePtr(),
+			Metadata: map[string]interface{}{
+				"displayName": "Dataverses of " + name,
+			},
+			Plans: []osb.Plan{
+				{
+					Name:        "default",
+					ID:          genericPlanID(id),
+					Description: "A dataverse by its alias or URL",
+					Free:        truePtr(),
+					Schemas: &osb.Schemas{
+						ServiceInstance: &osb.ServiceInstanceSchema{
+							Create: &osb.InputParametersSchema{
+								Parameters: map[string]interface{}{
+									"type":     "object",
+									"required": []string{"dataverse"},
+									"properties": map[string]interface{}{
+										"dataverse": map[string]interface{}{
+											"type":        "string",
+											"description": "Alias of the dataverse, or its URL on " + serverUrl,
+										},
+										"credentials": map[string]interface{}{
+											"type":        "string",
+											"description": "API key to access restricted files and datasets on Dataverse",
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		})
+	}
+	return services
+}
+
+// dataverseTarget returns the alias of a dataverse given by its alias or its
+// URL, which must be on the server
+func dataverseTarget(serverUrl string, target string) (string, error) {
+	if !strings.Contains(target, "/") {
+		if !dataverseAliasPattern.MatchString(target) {
+			return "", badRequest(fmt.Sprintf("%q is not a dataverse alias", target))
+		}
+		return target, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return "", badRequest(fmt.Sprintf("%q is not a dataverse alias or URL", target))
+	}
+	server, _ := serverKey(serverUrl)
+	if !strings.EqualFold(u.Scheme+"://"+u.Host, server) {
+		return "", badRequest(fmt.Sprintf("%s is not on %s", target, serverUrl))
+	}
+
+	alias := strings.TrimPrefix(strings.TrimSuffix(u.Path, "/"), "/dataverse/")
+	if alias == u.Path || !dataverseAliasPattern.MatchString(alias) {
+		return "", badRequest(fmt.Sprintf("%s is not the URL of a dataverse, such as %s/dataverse/<alias>", target, serverUrl))
+	}
+	return alias, nil
+}
+
+// resolvedDataverse is the part of the Dataverse dataverses API used to
+// describe a dataverse
+type resolvedDataverse struct {
+	ID           int    `json:"id"`
+	Alias        string `json:"alias"`
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	CreationDate string `json:"creationDate"`
+}
+
+// resolveDataverse checks a dataverse exists on the server and describes it
+// as a whitelist entry would
+func resolveDataverse(serverUrl string, alias string, token string) (*DataverseDescription, error) {
+	dataverse := resolvedDataverse{}
+	err := nativeAPI("GET", serverUrl+"/api/dataverses/"+url.PathEscape(alias), token, nil, &dataverse)
+	if isNotFound(err) {
+		return nil, badRequest(fmt.Sprintf("Dataverse %q was not found on %s", alias, serverUrl))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &DataverseDescription{
+		Name:         dataverse.Name,
+		Type:         "dataverse",
+		Url:          serverUrl + "/dataverse/" + dataverse.Alias,
+		Identifier:   dataverse.Alias,
+		Description:  dataverse.Description,
+		Published_at: dataverse.CreationDate,
+		Entity_id:    dataverse.ID,
+	}, nil
+}
+
+// existingInstance returns the response for provisioning an instance that
+// already exists with the same parameters, nil if it doesn't exist. It must be
+// called with the BusinessLogic locked.
+func (b *BusinessLogic) existingInstance(request *osb.ProvisionRequest) (*broker.ProvisionResponse, error) {
+	i := b.instances[request.InstanceID]
+	if i == nil {
+		return nil, nil
+	}
+	if i.ServiceID == request.ServiceID && i.PlanID == request.PlanID && reflect.DeepEqual(i.Params, request.Parameters) {
+		return &broker.ProvisionResponse{Exists: true}, nil
+	}
+	description := "InstanceID in use"
+	return nil, osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusConflict,
+		Description: &description,
+	}
+}
+
+// provisionGeneric provisions an instance of the generic service of a server.
+// It must be called with the BusinessLogic locked.
+func (b *BusinessLogic) provisionGeneric(request *osb.ProvisionRequest, serverUrl string, serverName string) (*broker.ProvisionResponse, error) {
+	if request.PlanID != genericPlanID(request.ServiceID) {
+		return nil, badRequest("Unknown plan of the service")
+	}
+	if response, err := b.existingInstance(request); response != nil || err != nil {
+		return response, err
+	}
+
+	target, err := stringParam(request.Parameters, "dataverse")
+	if err != nil {
+		return nil, err
+	}
+	alias, err := dataverseTarget(serverUrl, target)
+	if err != nil {
+		return nil, err
+	}
+	token, _ := request.Parameters["credentials"].(string)
+
+	description, err := resolveDataverse(serverUrl, alias, token)
+	if err != nil {
+		return nil, err
+	}
+
+	b.instances[request.InstanceID] = &dataverseInstance{
+		ID:          request.InstanceID,
+		ServiceID:   request.ServiceID,
+		PlanID:      request.PlanID,
+		ServerName:  serverName,
+		ServerUrl:   serverUrl,
+		Description: description,
+		Params:      request.Parameters,
+	}
+	glog.Infof("generic: instance %q is dataverse %q on %s", request.InstanceID, description.Identifier, serverUrl)
+
+	response := &broker.ProvisionResponse{}
+	if request.AcceptsIncomplete {
+		response.Async = b.async
+	}
+	return response, nil
+}
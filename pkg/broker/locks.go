@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// How often the locks of a dataset are checked while waiting for them to
+// clear, backing off from lockPollMin to lockPollMax, and how long to wait
+const (
+	lockPollMin = 250 * time.Millisecond
+	lockPollMax = 10 * time.Second
+	lockTimeout = time.Hour
+)
+
+// datasetLock is an entry of the Dataverse dataset locks API
+type datasetLock struct {
+	LockType string `json:"lockType"`
+	Date     string `json:"date"`
+	User     string `json:"user"`
+}
+
+// datasetLocks lists the locks on a dataset
+func datasetLocks(serverUrl string, pid string, token string) ([]datasetLock, error) {
+	locks := make([]datasetLock, 0)
+	query := "?" + url.Values{"persistentId": {pid}}.Encode()
+	err := nativeAPI("GET", serverUrl+"/api/datasets/:persistentId/locks"+query, token, nil, &locks)
+	return locks, err
+}
+
+// checkDatasetLocks returns a 422 when Dataverse has locked the dataset for
+// ingest, a workflow or review, so the dataset is only changed when Dataverse
+// would accept it
+func checkDatasetLocks(serverUrl string, pid string, token string) error {
+	locks, err := datasetLocks(serverUrl, pid, token)
+	if err != nil {
+		return err
+	}
+	if len(locks) == 0 {
+		return nil
+	}
+
+	types := make([]string, 0, len(locks))
+	for _, lock := range locks {
+		if !containsString(types, lock.LockType) {
+			types = append(types, lock.LockType)
+		}
+	}
+	message := "ConcurrencyError"
+	description := fmt.Sprintf("Dataset %s is locked by Dataverse (%s), try again later", pid, strings.Join(types, ", "))
+	return osb.HTTPStatusCodeError{
+		StatusCode:   http.StatusUnprocessableEntity,
+		ErrorMessage: &message,
+		Description:  &description,
+	}
+}
+
+// isDatasetLocked tells if err was returned by checkDatasetLocks for a locked
+// dataset
+func isDatasetLocked(err error) bool {
+	httpErr, ok := err.(osb.HTTPStatusCodeError)
+	return ok && httpErr.StatusCode == http.StatusUnprocessableEntity &&
+		httpErr.ErrorMessage != nil && *httpErr.ErrorMessage == "ConcurrencyError"
+}
+
+// WaitForDatasetLocks waits until Dataverse releases the locks on a dataset.
+// It is meant for operations running in the background, and for clients
+// changing a dataset one request after another.
+func WaitForDatasetLocks(serverUrl string, pid string, token string) error {
+	delay := lockPollMin
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		err := checkDatasetLocks(serverUrl, pid, token)
+		if err == nil {
+			return nil
+		}
+		if !isDatasetLocked(err) && !isBackendUnavailable(err) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+
+		time.Sleep(delay)
+		if delay *= 2; delay > lockPollMax {
+			delay = lockPollMax
+		}
+	}
+}
@@ -1,7 +1,11 @@
 package broker
 
 import (
+	"fmt"
 	"net/http"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/pmorie/osb-broker-lib/pkg/broker"
@@ -17,6 +21,33 @@ func NewBusinessLogic(o Options) (*BusinessLogic, error) {
 	// line, you would unpack it from the Options and set it on the
 	// BusinessLogic here.
 
+	var err error
+
+	backendConfig := DefaultBackendConfig
+	if o.BackendConfigPath != "" {
+		backendConfig, err = FileToBackendConfig(o.BackendConfigPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ConfigureBackends(backendConfig)
+
+	var policy *Policy
+	if o.PolicyPath != "" {
+		policy, err = FileToPolicy(o.PolicyPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var accounts *ManagedAccountsConfig
+	if o.ManagedAccounts != "" {
+		accounts, err = FileToManagedAccounts(o.ManagedAccounts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	dataverseInstances, err := FileToService(o.CatalogPath)
 
 	if err != nil {
@@ -29,13 +60,91 @@ func NewBusinessLogic(o Options) (*BusinessLogic, error) {
 		dataverseMap[dataverse.ServiceID] = dataverse
 	}
 
+	manifestPageSize := o.ManifestPageSize
+	if manifestPageSize <= 0 {
+		manifestPageSize = defaultManifestPageSize
+	}
+
+	var cache *fileCache
+	if o.ProxyURL != "" || o.S3URL != "" {
+		cache, err = newFileCache(o.ProxyCacheDir, int64(o.ProxyCacheMaxMB)<<20)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s3Region := o.S3Region
+	if s3Region == "" {
+		s3Region = defaultS3Region
+	}
+
+	depositRetention := o.DepositRetention
+	switch depositRetention {
+	case "":
+		depositRetention = DepositRetentionKeep
+	case DepositRetentionKeep, DepositRetentionDiscardDraft:
+	default:
+		return nil, fmt.Errorf("unknown deposit retention %q", depositRetention)
+	}
+
+	sandboxRetention := o.SandboxRetention
+	switch sandboxRetention {
+	case "":
+		sandboxRetention = SandboxRetentionFail
+	case SandboxRetentionFail, SandboxRetentionRetain:
+	default:
+		return nil, fmt.Errorf("unknown sandbox retention %q", sandboxRetention)
+	}
+
+	var signer *URLSigner
+	if o.SigningKeysPath != "" {
+		if o.ProxyURL == "" {
+			return nil, fmt.Errorf("signed download links require a proxy url")
+		}
+		ttl := o.SignedURLTTL
+		if ttl <= 0 {
+			ttl = defaultSignedURLTTL
+		}
+		signer, err = NewURLSigner(o.SigningKeysPath, ttl)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var auditor *Auditor
+	if o.AuditLogPath != "" {
+		auditor, err = NewAuditor(o.AuditLogPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &BusinessLogic{
-		async:      o.Async,
-		instances:  make(map[string]*dataverseInstance, 10),
-		dataverses: dataverseMap,
+		async:            o.Async,
+		instances:        make(map[string]*dataverseInstance, 10),
+		bindings:         make(map[string]*dataverseBinding, 10),
+		dataverses:       dataverseMap,
+		catalogPath:      o.CatalogPath,
+		policy:           policy,
+		manifestPageSize: manifestPageSize,
+		proxyURL:         strings.TrimRight(o.ProxyURL, "/"),
+		cache:            cache,
+		signer:           signer,
+		s3URL:            strings.TrimRight(o.S3URL, "/"),
+		s3Region:         s3Region,
+		depositRetention: depositRetention,
+		sandboxRetention: sandboxRetention,
+		accounts:         accounts,
+		auditor:          auditor,
 	}, nil
 }
 
+// Auditor returns the audit log of the broker, nil when disabled. Operations
+// of the OSB API are audited by wrapping the broker in an AuditedBroker.
+func (b *BusinessLogic) Auditor() *Auditor {
+	return b.auditor
+}
+
 var _ broker.Interface = &BusinessLogic{}
 
 func (b *BusinessLogic) GetCatalog(c *broker.RequestContext) (*broker.CatalogResponse, error) {
@@ -43,12 +152,42 @@ func (b *BusinessLogic) GetCatalog(c *broker.RequestContext) (*broker.CatalogRes
 	response := &broker.CatalogResponse{}
 
 	// Create Service objects from dataverses
+	b.RLock()
 	services, err := DataverseToService(b.dataverses)
+	services = append(services, b.genericServices()...)
+	if len(b.dataverses) > 0 {
+		services = append(services, openDatasetService())
+	}
+	b.RUnlock()
 
 	if err != nil {
 		return nil, err
 	}
 
+	if !requestAPIVersion(c).atLeast(schemasAPIVersion) {
+		// Plan schemas were added in 2.13
+		for i := range services {
+			for j := range services[i].Plans {
+				services[i].Plans[j].Schemas = nil
+			}
+		}
+	}
+	if requestAPIVersion(c).atLeast(fetchAPIVersion) {
+		// Every instance and binding can be fetched from 2.14 on,
+		// RegisterFetchHandlers adds instances_retrievable
+		for i := range services {
+			services[i].BindingsRetrievable = true
+		}
+	}
+
+	if b.policy != nil && b.policy.FilterCatalog {
+		// Only filter when the platform tells us who is asking
+		identity := originatingIdentityFromRequest(c.Request)
+		if subject, known := newPolicySubject(nil, identity, c); known {
+			services = b.policy.filterServices(subject, services)
+		}
+	}
+
 	osbResponse := &osb.CatalogResponse{
 		Services: services,
 	}
@@ -62,14 +201,21 @@ func (b *BusinessLogic) GetCatalog(c *broker.RequestContext) (*broker.CatalogRes
 
 func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.RequestContext) (*broker.ProvisionResponse, error) {
 
+	glog.Infof("provision request: instance %q, service %q, plan %q, parameters %v", request.InstanceID, request.ServiceID, request.PlanID, redactParams(request.Parameters))
+
+	if isOpenDataset(request.ServiceID) {
+		// Looking for the dataset on every server may take a while, it
+		// takes the lock when needed
+		return b.provisionOpenDataset(request, c)
+	}
+
 	b.Lock()
 	defer b.Unlock()
 
-	glog.Infof("provision request: %#+v", request)
-
 	response := broker.ProvisionResponse{}
 
-	if _, present := b.dataverses[request.ServiceID]; present == false {
+	genericUrl, genericName, generic := b.genericServer(request.ServiceID)
+	if _, present := b.dataverses[request.ServiceID]; present == false && !generic {
 		// dataverse not present; ServiceID invalid
 		description := "Invalid Dataverse Service"
 		return nil, osb.HTTPStatusCodeError{
@@ -78,6 +224,14 @@ func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.Reque
 		}
 	}
 
+	if err := b.provisionAllowed(request, c); err != nil {
+		return nil, err
+	}
+
+	if generic {
+		return b.provisionGeneric(request, genericUrl, genericName)
+	}
+
 	dataverseInstance := &dataverseInstance{
 		ID:          request.InstanceID,
 		ServiceID:   request.ServiceID,
@@ -91,6 +245,11 @@ func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.Reque
 	// Check to see if this is the same instance
 	if i := b.instances[request.InstanceID]; i != nil {
 		if i.Match(dataverseInstance) {
+			if i.inProgress() && i.Operation.Key == provisionOperation {
+				response.Async = true
+				response.OperationKey = &i.Operation.Key
+				return &response, nil
+			}
 			response.Exists = true
 			return &response, nil
 		} else {
@@ -103,6 +262,44 @@ func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.Reque
 		}
 	}
 
+	deposit := isDepositPlan(b.dataverses[request.ServiceID], request.PlanID)
+	if deposit {
+		// Fail early on missing metadata
+		if _, err := depositMetadata(request.Parameters); err != nil {
+			return nil, err
+		}
+	}
+
+	grant := isRoleGrantPlan(b.dataverses[request.ServiceID], request.PlanID)
+	if grant {
+		if _, _, err := roleGrantParams(request.Parameters); err != nil {
+			return nil, err
+		}
+	}
+
+	version, err := versionParam(dataverseInstance, request.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	search := isSearchPlan(b.dataverses[request.ServiceID], request.PlanID)
+	if search {
+		if _, err := searchQuery(dataverseInstance.Description.Identifier, request.Parameters); err != nil {
+			return nil, err
+		}
+	}
+
+	sandbox := isSandboxPlan(b.dataverses[request.ServiceID], request.PlanID)
+	if sandbox {
+		if !request.AcceptsIncomplete {
+			return nil, asyncRequired()
+		}
+		dataverseInstance.Sandbox = &sandboxDataverse{Alias: sandboxAlias(request.InstanceID)}
+		if _, err := sandboxMetadata(dataverseInstance.Sandbox.Alias, request.Parameters); err != nil {
+			return nil, err
+		}
+	}
+
 	// Ping the Dataverse server to see if it's live
 	succ, err := PingDataverse(dataverseInstance.Description.Url)
 
@@ -122,83 +319,563 @@ func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.Reque
 		}
 	}
 
+	if deposit {
+		if dataverseInstance.Deposit, err = createDeposit(dataverseInstance); err != nil {
+			glog.Errorf("provision: unable to create dataset for instance %q: %v", request.InstanceID, err)
+			return nil, err
+		}
+	}
+
+	if version != "" {
+		token, _ := dataverseInstance.Params["credentials"].(string)
+		if _, err = resolveVersion(dataverseInstance.ServerUrl, dataverseInstance.Description.Global_id, version, token); err != nil {
+			return nil, err
+		}
+	}
+
+	if search {
+		// Running the query checks Dataverse accepts it
+		if dataverseInstance.Search, err = createSearch(dataverseInstance); err != nil {
+			glog.Errorf("provision: invalid search for instance %q: %v", request.InstanceID, err)
+			return nil, err
+		}
+	}
+
+	if grant {
+		if dataverseInstance.Grant, err = createRoleGrant(dataverseInstance); err != nil {
+			glog.Errorf("provision: unable to grant role for instance %q: %v", request.InstanceID, err)
+			return nil, err
+		}
+	}
+
 	b.instances[request.InstanceID] = dataverseInstance
 
 	if request.AcceptsIncomplete {
 		response.Async = b.async
 	}
+	if sandbox {
+		response.Async = true
+		response.OperationKey = b.provisionSandbox(dataverseInstance)
+	}
 
 	glog.Infof("provision response: %#+v", response)
 
 	return &response, nil
 }
 
+// provisionAllowed checks the policy lets the platform user provision the
+// service and plan
+func (b *BusinessLogic) provisionAllowed(request *osb.ProvisionRequest, c *broker.RequestContext) error {
+	if b.policy != nil {
+		subject, _ := newPolicySubject(request.Context, request.OriginatingIdentity, c)
+		if !b.policy.allowed(subject, request.ServiceID, request.PlanID) {
+			return forbidden("Not allowed to provision this service and plan")
+		}
+	}
+	return nil
+}
+
 func (b *BusinessLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.RequestContext) (*broker.DeprovisionResponse, error) {
 
+	instance, response, err := b.startDeprovision(request)
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	// Deprovisioning goes ahead, the accounts of the bindings left are
+	// removed without the lock
+	err = b.removeBindingAccounts(request.InstanceID)
+
 	b.Lock()
 	defer b.Unlock()
 
-	response := broker.DeprovisionResponse{}
+	if instance != nil {
+		instance.updating = false
+	}
+	if err != nil {
+		glog.Errorf("deprovision: unable to remove accounts of instance %q: %v", request.InstanceID, err)
+		return nil, err
+	}
 
-	delete(b.instances, request.InstanceID)
+	// Unless the instance was provisioned meanwhile
+	if b.instances[request.InstanceID] == instance {
+		b.deleteInstance(request.InstanceID)
+	}
 
+	response = &broker.DeprovisionResponse{}
 	if request.AcceptsIncomplete {
 		response.Async = b.async
 	}
 
-	return &response, nil
+	return response, nil
+}
+
+// startDeprovision refuses deprovisioning or removes what the instance
+// created in Dataverse, returning the response when deprovisioning goes on
+// in the background. Otherwise it returns the instance, nil if it doesn't
+// exist, marked as being updated so nothing binds to it while the accounts of
+// its bindings are removed.
+func (b *BusinessLogic) startDeprovision(request *osb.DeprovisionRequest) (*dataverseInstance, *broker.DeprovisionResponse, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	response := &broker.DeprovisionResponse{}
+
+	instance, ok := b.instances[request.InstanceID]
+	if !ok {
+		return nil, nil, nil
+	}
+	if instance.inProgress() {
+		if instance.Operation != nil && instance.Operation.Key == deprovisionOperation {
+			response.Async = true
+			response.OperationKey = &instance.Operation.Key
+			return nil, response, nil
+		}
+		return nil, nil, concurrencyError()
+	}
+
+	// Sandbox and deposit instances, removed in the background, have no
+	// managed accounts
+	if instance.Sandbox != nil && instance.Sandbox.ID != 0 {
+		if !request.AcceptsIncomplete {
+			return nil, nil, asyncRequired()
+		}
+		response.Async = true
+		response.OperationKey = b.deprovisionSandbox(instance)
+		return nil, response, nil
+	}
+
+	if instance.Grant != nil {
+		if err := revokeRole(instance, instance.Grant.AssignmentID); err != nil {
+			glog.Errorf("deprovision: unable to revoke role of instance %q: %v", request.InstanceID, err)
+			return nil, nil, err
+		}
+	}
+
+	if instance.Deposit != nil {
+		// Keep the instance if the dataset couldn't be removed, so
+		// deprovisioning can be retried
+		err := removeDeposit(instance, b.depositRetention)
+		if isDatasetLocked(err) && request.AcceptsIncomplete {
+			// Remove the dataset once Dataverse is done with it
+			response.Async = true
+			response.OperationKey = b.deprovisionDeposit(instance)
+			return nil, response, nil
+		}
+		if err != nil {
+			glog.Errorf("deprovision: unable to remove dataset of instance %q: %v", request.InstanceID, err)
+			return nil, nil, err
+		}
+	}
+
+	instance.updating = true
+	return instance, nil, nil
+}
+
+// deleteInstance forgets an instance and its bindings, whose accounts must
+// have been removed. It must be called with the BusinessLogic locked.
+func (b *BusinessLogic) deleteInstance(instanceID string) {
+	delete(b.instances, instanceID)
+
+	for id, binding := range b.bindings {
+		if binding.InstanceID == instanceID {
+			delete(b.bindings, id)
+		}
+	}
+}
+
+// removeBindingAccounts removes the managed accounts of the bindings left to
+// an instance before it is deleted, and forgets those bindings. Bindings
+// whose account couldn't be removed are kept, so deleting can be retried.
+func (b *BusinessLogic) removeBindingAccounts(instanceID string) error {
+	b.RLock()
+	bindings := make([]*dataverseBinding, 0)
+	for _, binding := range b.bindings {
+		if binding.InstanceID == instanceID && binding.Account != nil {
+			bindings = append(bindings, binding)
+		}
+	}
+	b.RUnlock()
+
+	for _, binding := range bindings {
+		if settings, ok := b.accounts.settings(binding.Account.ServerUrl); ok {
+			if err := removeManagedAccount(settings, binding.Account); err != nil {
+				return err
+			}
+		}
+
+		b.Lock()
+		if existing, ok := b.bindings[binding.ID]; ok && existing.InstanceID == instanceID {
+			delete(b.bindings, binding.ID)
+		}
+		b.Unlock()
+	}
+	return nil
 }
 
 func (b *BusinessLogic) LastOperation(request *osb.LastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
-	// Your last-operation business logic goes here
 
-	return nil, nil
+	b.RLock()
+	defer b.RUnlock()
+
+	instance, ok := b.instances[request.InstanceID]
+	if !ok {
+		// Deprovisioning succeeded, or the instance never existed
+		return nil, osb.HTTPStatusCodeError{
+			StatusCode: http.StatusGone,
+		}
+	}
+
+	response := &broker.LastOperationResponse{
+		LastOperationResponse: osb.LastOperationResponse{
+			State: osb.StateSucceeded,
+		},
+	}
+	if instance.Operation != nil {
+		response.State = instance.Operation.State
+		if instance.Operation.Description != "" {
+			description := instance.Operation.Description
+			response.Description = &description
+		}
+	}
+
+	return response, nil
 }
 
 func (b *BusinessLogic) Bind(request *osb.BindRequest, c *broker.RequestContext) (*broker.BindResponse, error) {
 
-	b.Lock()
-	defer b.Unlock()
+	glog.Infof("bind request: binding %q, instance %q, service %q, plan %q", request.BindingID, request.InstanceID, request.ServiceID, request.PlanID)
 
-	glog.Infof("bind request: %#+v", request)
+	binding := &dataverseBinding{
+		ID:         request.BindingID,
+		InstanceID: request.InstanceID,
+		ServiceID:  request.ServiceID,
+		PlanID:     request.PlanID,
+		Params:     request.Parameters,
+	}
 
+	// Dataverse is read without the lock, from a copy of the instance as
+	// it is when bound
+	b.RLock()
 	instance, ok := b.instances[request.InstanceID]
+	response, err := b.existingBinding(binding)
+	if ok && response == nil && err == nil {
+		if err = instance.bindable(); err == nil {
+			instance = instance.snapshot()
+		}
+	}
+	b.RUnlock()
+
 	if !ok {
 		return nil, osb.HTTPStatusCodeError{
 			StatusCode: http.StatusNotFound,
 		}
 	}
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	// Bindings to a pinned dataset keep the version it had when bound
+	version, err := instanceVersion(instance)
+	if err != nil {
+		glog.Errorf("bind: unable to resolve version of instance %q: %v", request.InstanceID, err)
+		return nil, err
+	}
+
+	var results *DataverseResponse
+	if instance.Search != nil {
+		token, _ := instance.Params["credentials"].(string)
+		if results, err = runSearch(instance.ServerUrl, instance.Search, token, searchResultsMax); err != nil {
+			glog.Errorf("bind: unable to search for instance %q: %v", request.InstanceID, err)
+			return nil, err
+		}
+	}
+
+	// Listing the files may take a while, don't hold the lock meanwhile.
+	// Crawling the datasets of a dataverse or search results takes longer
+	// still, it goes on once the binding is created.
+	listing := fileListing{Files: []ManifestFile{}, Pending: true}
+	if !crawlsDatasets(instance) {
+		listing = instanceFiles(instance, version, nil)
+	}
+	// Citations of the version as it is now, kept with the binding
+	citations := instanceCitations(instance, version)
+
+	// Applications reading through Dataverse itself get an account of their
+	// own when the server allows it
+	settings, managed := b.accounts.settings(instance.ServerUrl)
+	managed = managed && b.proxyURL == "" && instance.Deposit == nil && instance.Sandbox == nil
+	if managed {
+		if binding.Account, err = createManagedAccount(settings, instance, binding.ID); err != nil {
+			glog.Errorf("bind: unable to create account for binding %q: %v", request.BindingID, err)
+			return nil, err
+		}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	// The same binding may have been created while listing files
+	if response, err = b.existingBinding(binding); response != nil || err != nil {
+		if managed {
+			if removeErr := removeManagedAccount(settings, binding.Account); removeErr != nil {
+				glog.Errorf("bind: unable to remove account %q: %v", binding.Account.Username, removeErr)
+			}
+		}
+		return response, err
+	}
 
 	credentials := ""
 	if instance.Params["credentials"] != nil {
 		credentials = instance.Params["credentials"].(string)
 	}
 
-	response := broker.BindResponse{
+	binding.Files = listing.Files
+	binding.FilesPending = listing.Pending
+	binding.FilesIncomplete = listing.Incomplete
+	binding.UnlistedDatasets = listing.UnlistedDatasets
+	binding.CreatedAt = time.Now()
+	binding.Credentials = map[string]interface{}{
+		"coordinates": instance.Description.Url,
+		"server_url":  instance.ServerUrl,
+	}
+	switch {
+	case b.signer != nil && instance.Deposit == nil && instance.Description.Type == "dataset":
+		// Applications only get expiring links to the files of this
+		// dataset, and a token to refresh them through the proxy
+		if binding.ProxyToken, err = newBindingToken(); err != nil {
+			return nil, err
+		}
+		binding.Signed = true
+		binding.Credentials["manifest_url"] = b.proxyURL + "/data/" + binding.ID + "/files"
+		binding.Credentials["manifest_token"] = binding.ProxyToken
+	case b.proxyURL != "":
+		// Applications only get access to the files of this binding,
+		// through the proxy
+		if binding.ProxyToken, err = newBindingToken(); err != nil {
+			return nil, err
+		}
+		binding.Credentials["proxy_url"] = b.proxyURL + "/data/" + binding.ID
+		binding.Credentials["proxy_token"] = binding.ProxyToken
+	case binding.Account != nil:
+		binding.Credentials["credentials"] = binding.Account.Token
+		binding.Credentials["username"] = binding.Account.Username
+	default:
+		binding.Credentials["credentials"] = credentials
+	}
+	if b.s3URL != "" {
+		if binding.S3AccessKeyID, binding.S3SecretKey, err = newS3Keys(); err != nil {
+			return nil, err
+		}
+		binding.Credentials["s3_endpoint"] = b.s3URL
+		binding.Credentials["s3_region"] = b.s3Region
+		binding.Credentials["s3_bucket"] = binding.ID
+		binding.Credentials["s3_access_key_id"] = binding.S3AccessKeyID
+		binding.Credentials["s3_secret_access_key"] = binding.S3SecretKey
+	}
+	binding.Credentials["manifest"] = b.manifestPage(binding, 0, b.manifestPageSize)
+	switch {
+	case instance.Deposit != nil:
+		// Uploads go to Dataverse itself, which needs its own token
+		binding.Credentials["credentials"] = credentials
+		for k, v := range depositCredentials(instance) {
+			binding.Credentials[k] = v
+		}
+	case instance.Sandbox != nil:
+		// The sandbox is the team's own, to add datasets to
+		binding.Credentials["credentials"] = credentials
+		binding.Credentials["coordinates"] = instance.ServerUrl + "/dataverse/" + instance.Sandbox.Alias
+		binding.Credentials["dataverse"] = instance.Sandbox.Alias
+	case instance.Search != nil:
+		// The results as they are now, the endpoint for fresh ones
+		binding.Credentials["search_url"] = instance.ServerUrl + "/api/search?" + instance.Search.Query
+		binding.Credentials["search_results"] = results
+	case instance.Description.Type == "dataset":
+		binding.Credentials["dataset"] = instance.Description.Global_id
+		if version != "" {
+			for k, v := range versionCredentials(instance, version) {
+				binding.Credentials[k] = v
+			}
+		}
+	default:
+		binding.Credentials["dataverse"] = instance.Description.Identifier
+	}
+	for k, v := range citations {
+		binding.Credentials[k] = v
+	}
+	b.bindings[request.BindingID] = binding
+	if listing.Pending {
+		go b.listBindingFiles(binding, instance, version, results)
+	}
+
+	response = &broker.BindResponse{
 		BindResponse: osb.BindResponse{
-			Credentials: map[string]interface{}{
-				"coordinates": instance.Description.Url,
-				"credentials": credentials,
-			},
+			Credentials: binding.Credentials,
 		},
 	}
 	if request.AcceptsIncomplete {
 		response.Async = b.async
 	}
 
-	glog.Infof("bind response: %#+v", response)
+	glog.Infof("bind response: binding %q, %d files, async %v", request.BindingID, len(listing.Files), response.Async)
 
-	return &response, nil
+	return response, nil
+}
+
+// existingBinding returns the response for a binding that already exists,
+// nil if it doesn't. It must be called with the BusinessLogic locked.
+func (b *BusinessLogic) existingBinding(binding *dataverseBinding) (*broker.BindResponse, error) {
+	existing := b.bindings[binding.ID]
+	if existing == nil {
+		return nil, nil
+	}
+
+	// Check to see if this is the same binding
+	if existing.InstanceID == binding.InstanceID && reflect.DeepEqual(existing.Params, binding.Params) {
+		return &broker.BindResponse{
+			BindResponse: osb.BindResponse{
+				Credentials: b.bindingCredentials(existing),
+			},
+			Exists: true,
+		}, nil
+	}
+
+	description := "BindingID in use"
+	return nil, osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusConflict,
+		Description: &description,
+	}
+}
+
+// snapshot copies an instance, for reading it without the lock. It must be
+// called with the BusinessLogic locked.
+func (i *dataverseInstance) snapshot() *dataverseInstance {
+	s := *i
+	s.Params = make(map[string]interface{}, len(i.Params))
+	for k, v := range i.Params {
+		s.Params[k] = v
+	}
+	if i.Description != nil {
+		description := *i.Description
+		s.Description = &description
+	}
+	if i.Grant != nil {
+		grant := *i.Grant
+		s.Grant = &grant
+	}
+	if i.Sandbox != nil {
+		sandbox := *i.Sandbox
+		s.Sandbox = &sandbox
+	}
+	if i.Opened != nil {
+		opened := *i.Opened
+		s.Opened = &opened
+	}
+	s.Operation = nil
+	return &s
 }
 
 func (b *BusinessLogic) Unbind(request *osb.UnbindRequest, c *broker.RequestContext) (*broker.UnbindResponse, error) {
 
+	b.RLock()
+	binding := b.bindings[request.BindingID]
+	b.RUnlock()
+
+	if binding != nil && binding.Account != nil {
+		// Keep the binding if its account couldn't be removed, so unbinding
+		// can be retried
+		if settings, ok := b.accounts.settings(binding.Account.ServerUrl); ok {
+			if err := removeManagedAccount(settings, binding.Account); err != nil {
+				glog.Errorf("unbind: unable to remove account of binding %q: %v", request.BindingID, err)
+				return nil, err
+			}
+		}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.bindings, request.BindingID)
+
 	return &broker.UnbindResponse{}, nil
 }
 
 func (b *BusinessLogic) Update(request *osb.UpdateInstanceRequest, c *broker.RequestContext) (*broker.UpdateInstanceResponse, error) {
 
+	if b.policy != nil && request.PlanID != nil {
+		subject, _ := newPolicySubject(request.Context, request.OriginatingIdentity, c)
+		if !b.policy.allowed(subject, request.ServiceID, *request.PlanID) {
+			return nil, forbidden("Not allowed to change to this plan")
+		}
+	}
+
+	update, err := b.startUpdate(request)
+	if err != nil {
+		return nil, err
+	}
+	instance := update.instance
+
+	// Dataverse is changed without holding the lock, checking the dataset
+	// and version before changing the role so a failure leaves the instance
+	// as it was. Locked datasets are only published once Dataverse releases
+	// them, publishing is refused meanwhile.
+	if update.publication != nil {
+		err = checkDatasetLocks(instance.ServerUrl, update.publication.pid, update.publication.token)
+	}
+	resolved := ""
+	if err == nil && update.version != "" {
+		token, _ := instance.Params["credentials"].(string)
+		if resolved, err = resolveVersion(instance.ServerUrl, instance.Description.Global_id, update.version, token); err != nil {
+			glog.Errorf("update: unable to change version of instance %q: %v", request.InstanceID, err)
+		}
+	}
+	assignmentID := 0
+	if err == nil && update.role != "" {
+		if assignmentID, err = changeRole(instance, update.role); err != nil {
+			glog.Errorf("update: unable to change role of instance %q: %v", request.InstanceID, err)
+		}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	instance.updating = false
+	if err != nil {
+		return nil, err
+	}
+
+	// Params, the grant and the opened dataset are replaced rather than
+	// changed, for whatever still reads the instance without the lock
+	params := make(map[string]interface{}, len(instance.Params)+1)
+	for k, v := range instance.Params {
+		params[k] = v
+	}
+	if update.version != "" {
+		// Existing bindings keep the version they were created with
+		params["version"] = update.version
+		if instance.Opened != nil {
+			opened := *instance.Opened
+			opened.Version = resolved
+			instance.Opened = &opened
+		}
+	}
+	if update.role != "" {
+		grant := *instance.Grant
+		grant.Role = update.role
+		grant.AssignmentID = assignmentID
+		instance.Grant = &grant
+		params["role"] = update.role
+	}
+	instance.Params = params
+
 	response := broker.UpdateInstanceResponse{}
+
+	if update.publication != nil {
+		response.Async = true
+		response.OperationKey = b.publishDataset(instance, update.publication)
+		return &response, nil
+	}
+
 	if request.AcceptsIncomplete {
 		response.Async = b.async
 	}
@@ -206,6 +883,55 @@ func (b *BusinessLogic) Update(request *osb.UpdateInstanceRequest, c *broker.Req
 	return &response, nil
 }
 
+// instanceUpdate is a checked update of an instance
+type instanceUpdate struct {
+	instance *dataverseInstance
+	// New version and role, empty when they don't change
+	version     string
+	role        string
+	publication *publication
+}
+
+// startUpdate checks an update before anything is changed, and marks the
+// instance as being updated so nothing else changes it meanwhile
+func (b *BusinessLogic) startUpdate(request *osb.UpdateInstanceRequest) (*instanceUpdate, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	instance, ok := b.instances[request.InstanceID]
+	if !ok {
+		return nil, osb.HTTPStatusCodeError{
+			StatusCode: http.StatusNotFound,
+		}
+	}
+	if instance.inProgress() {
+		return nil, concurrencyError()
+	}
+
+	update := &instanceUpdate{instance: instance}
+	var err error
+	if publish, ok := request.Parameters["publish"]; ok {
+		// Publishing continues after Dataverse answers
+		if !request.AcceptsIncomplete {
+			return nil, asyncRequired()
+		}
+		if update.publication, err = publishParams(instance, publish); err != nil {
+			return nil, err
+		}
+	}
+	if update.version, err = versionParam(instance, request.Parameters); err != nil {
+		return nil, err
+	}
+	if instance.Grant != nil && request.Parameters != nil {
+		if update.role, err = roleGrantUpdate(instance, request.Parameters); err != nil {
+			return nil, err
+		}
+	}
+
+	instance.updating = true
+	return update, nil
+}
+
 func (b *BusinessLogic) ValidateBrokerAPIVersion(version string) error {
-	return nil
+	return validateAPIVersion(version)
 }
@@ -0,0 +1,490 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// defaultManifestPageSize is the number of files returned in binding
+// credentials and per page of the manifest endpoint
+const defaultManifestPageSize = 1000
+
+// manifestDatasetsMax is the most datasets whose files are listed for a
+// dataverse binding, a request each
+const manifestDatasetsMax = 100
+
+// manifestListers is the number of datasets whose files are listed at once
+const manifestListers = 4
+
+// ManifestFile is a file of the bound dataverse or dataset
+type ManifestFile struct {
+	FileID int `json:"file_id"`
+	// Path of the file in its dataset, prefixed by the dataset's directory
+	// when the binding is to a dataverse
+	Path        string           `json:"path"`
+	Dataset     string           `json:"dataset"`
+	ContentType string           `json:"content_type"`
+	Size        int64            `json:"size"`
+	Checksum    DatafileChecksum `json:"checksum"`
+	DownloadURL string           `json:"download_url"`
+}
+
+// Manifest is a page of the files of a binding
+type Manifest struct {
+	TotalCount int            `json:"total_count"`
+	Start      int            `json:"start"`
+	Files      []ManifestFile `json:"files"`
+	// Broker path of the next page, empty on the last page
+	Next string `json:"next,omitempty"`
+	// When the download URLs stop working, for signed links
+	ExpiresAt string `json:"expires_at,omitempty"`
+	// Set while the files of a dataverse are being listed, the binding or
+	// the manifest can be fetched again for them
+	Pending bool `json:"pending,omitempty"`
+	// Set when some files of the instance are missing: Dataverse failed to
+	// list them, or the dataverse has more than manifestDatasetsMax datasets
+	Incomplete bool `json:"incomplete,omitempty"`
+	// Datasets whose files Dataverse failed to list
+	UnlistedDatasets []string `json:"unlisted_datasets,omitempty"`
+}
+
+// fileListing is the files of an instance, as far as they could be listed
+type fileListing struct {
+	Files            []ManifestFile
+	Pending          bool
+	Incomplete       bool
+	UnlistedDatasets []string
+}
+
+// bindingCredentials returns the credentials of a binding with its current
+// manifest: fresh signed links when they are used, and the files of a
+// dataverse once listed. It must be called with the BusinessLogic locked.
+func (b *BusinessLogic) bindingCredentials(binding *dataverseBinding) map[string]interface{} {
+	credentials := make(map[string]interface{}, len(binding.Credentials))
+	for k, v := range binding.Credentials {
+		credentials[k] = v
+	}
+	credentials["manifest"] = b.manifestPage(binding, 0, b.manifestPageSize)
+	return credentials
+}
+
+// datasetFile is an entry of the Dataverse dataset files API
+type datasetFile struct {
+	Label          string `json:"label"`
+	DirectoryLabel string `json:"directoryLabel"`
+	DataFile       struct {
+		ID          int              `json:"id"`
+		ContentType string           `json:"contentType"`
+		Filesize    int64            `json:"filesize"`
+		Md5         string           `json:"md5"`
+		Checksum    DatafileChecksum `json:"checksum"`
+		// Set for ingested tabular files, the checksum is the original's
+		OriginalFileFormat string `json:"originalFileFormat"`
+		OriginalFileSize   int64  `json:"originalFileSize"`
+	} `json:"dataFile"`
+}
+
+type datasetFilesWrapper struct {
+	Data    []datasetFile `json:"data"`
+	Status  string        `json:"status"`
+	Message string        `json:"message,omitempty"`
+}
+
+// DatasetFiles lists the files of the latest version of a dataset, including
+// the draft when a token is given
+func DatasetFiles(serverUrl string, persistentId string, token string) ([]ManifestFile, error) {
+	version := ":latest-published"
+	if token != "" {
+		version = ":latest"
+	}
+	return DatasetVersionFiles(serverUrl, persistentId, version, token)
+}
+
+// DatasetVersionFiles lists the files of a version of a dataset, N.M or one
+// of :latest, :latest-published and :draft
+func DatasetVersionFiles(serverUrl string, persistentId string, version string, token string) ([]ManifestFile, error) {
+	query := url.Values{"persistentId": {persistentId}}
+	if token != "" {
+		query.Set("key", token)
+	}
+
+	resp, err := dataverseGet(serverUrl + "/api/datasets/:persistentId/versions/" + version + "/files?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	response := datasetFilesWrapper{}
+	if err = json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("Error listing files of %s: %v", persistentId, err)
+	}
+	if response.Status != "OK" {
+		return nil, fmt.Errorf("Error listing files of %s: %s", persistentId, response.Message)
+	}
+
+	files := make([]ManifestFile, 0, len(response.Data))
+	for _, f := range response.Data {
+		checksum := f.DataFile.Checksum
+		if checksum.Value == "" && f.DataFile.Md5 != "" {
+			// Older servers only report MD5
+			checksum = DatafileChecksum{Type: "MD5", Value: f.DataFile.Md5}
+		}
+
+		file := ManifestFile{
+			FileID:      f.DataFile.ID,
+			Path:        path.Join(f.DirectoryLabel, f.Label),
+			Dataset:     persistentId,
+			ContentType: f.DataFile.ContentType,
+			Size:        f.DataFile.Filesize,
+			Checksum:    checksum,
+			DownloadURL: serverUrl + "/api/access/datafile/" + strconv.Itoa(f.DataFile.ID),
+		}
+		if f.DataFile.OriginalFileFormat != "" {
+			// Point to the uploaded file rather than its tab separated version
+			file.ContentType = f.DataFile.OriginalFileFormat
+			file.Size = f.DataFile.OriginalFileSize
+			file.DownloadURL += "?format=original"
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// DataverseFiles lists the files of every dataset in a dataverse and its sub
+// dataverses. Each dataset's files are put in a directory named after it.
+func DataverseFiles(serverUrl string, alias string, token string) ([]ManifestFile, error) {
+	datasets, _, err := dataverseDatasets(serverUrl, alias, token, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]ManifestFile, 0)
+	for _, pid := range datasets {
+		datasetFiles, err := DatasetFiles(serverUrl, pid, token)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range datasetFiles {
+			f.Path = path.Join(datasetDirectory(pid), f.Path)
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// dataverseDatasets returns the persistent IDs of the datasets in a dataverse
+// and its sub dataverses, at most max of them unless max is 0, and whether
+// there are more
+func dataverseDatasets(serverUrl string, alias string, token string, max int) ([]string, bool, error) {
+	start := 0
+	per_page := 100
+	datasets := make([]string, 0)
+
+	for {
+		query := url.Values{
+			"q":        {"*"},
+			"type":     {"dataset"},
+			"subtree":  {alias},
+			"start":    {strconv.Itoa(start)},
+			"per_page": {strconv.Itoa(per_page)},
+		}
+		if token != "" {
+			query.Set("key", token)
+		}
+
+		resp, err := dataverseGet(serverUrl + "/api/search?" + query.Encode())
+		if err != nil {
+			return nil, false, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, false, err
+		}
+
+		response := DataverseResponseWrapper{}
+		if err = json.Unmarshal(body, &response); err != nil {
+			return nil, false, fmt.Errorf("Error searching datasets of %s: %v", alias, err)
+		}
+		if response.Status != "OK" || response.Data == nil {
+			return nil, false, fmt.Errorf("Error searching datasets of %s: %s", alias, response.Message)
+		}
+
+		for _, dataset := range response.Data.Items {
+			if max > 0 && len(datasets) == max {
+				return datasets, true, nil
+			}
+			datasets = append(datasets, dataset.Global_id)
+		}
+
+		start += response.Data.Count_in_response
+		if response.Data.Count_in_response == 0 || start >= response.Data.Total_count {
+			return datasets, false, nil
+		}
+		if max > 0 && len(datasets) == max {
+			return datasets, true, nil
+		}
+	}
+}
+
+// listDatasets lists the files of datasets, manifestListers at a time, each
+// in a directory named after its dataset. Datasets whose files can't be
+// listed are left out and returned.
+func listDatasets(serverUrl string, datasets []string, token string) ([]ManifestFile, []string) {
+	listed := make([][]ManifestFile, len(datasets))
+	failed := make([]bool, len(datasets))
+
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < manifestListers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				files, err := DatasetFiles(serverUrl, datasets[j], token)
+				if err != nil {
+					glog.Warningf("manifest: unable to list files of %s: %s", datasets[j], errorDescription(err))
+					failed[j] = true
+					continue
+				}
+				listed[j] = files
+			}
+		}()
+	}
+	for j := range datasets {
+		queue <- j
+	}
+	close(queue)
+	wg.Wait()
+
+	files := make([]ManifestFile, 0)
+	unlisted := make([]string, 0)
+	for j, pid := range datasets {
+		if failed[j] {
+			unlisted = append(unlisted, pid)
+			continue
+		}
+		for _, f := range listed[j] {
+			f.Path = path.Join(datasetDirectory(pid), f.Path)
+			files = append(files, f)
+		}
+	}
+	return files, unlisted
+}
+
+// datasetDirectory turns a persistent ID into a directory name
+func datasetDirectory(persistentId string) string {
+	return strings.NewReplacer(":", "-", "/", "-").Replace(persistentId)
+}
+
+// crawlsDatasets tells if listing the files of an instance takes a request
+// per dataset
+func crawlsDatasets(instance *dataverseInstance) bool {
+	return instance.Search != nil || (instance.Deposit == nil && instance.Description.Type != "dataset")
+}
+
+// listBindingFiles lists the files of a binding that crawls datasets after
+// it was created. The binding is replaced rather than changed, as handlers
+// may be reading it.
+func (b *BusinessLogic) listBindingFiles(binding *dataverseBinding, instance *dataverseInstance, version string, results *DataverseResponse) {
+	listing := instanceFiles(instance, version, results)
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.bindings[binding.ID] != binding {
+		// Unbound meanwhile
+		return
+	}
+	listed := *binding
+	listed.Files = listing.Files
+	listed.FilesPending = false
+	listed.FilesIncomplete = listing.Incomplete
+	listed.UnlistedDatasets = listing.UnlistedDatasets
+	b.bindings[binding.ID] = &listed
+
+	glog.Infof("manifest: %d files listed for binding %q, incomplete %v", len(listing.Files), binding.ID, listing.Incomplete)
+}
+
+// instanceFiles lists the files an instance gives access to, in the given
+// version for pinned datasets and in the results of the binding's search for
+// search instances. The manifest is a convenience: files Dataverse fails to
+// list are left out rather than failing the binding, and only the first
+// manifestDatasetsMax datasets of a dataverse or search are listed.
+func instanceFiles(instance *dataverseInstance, version string, results *DataverseResponse) fileListing {
+	token, _ := instance.Params["credentials"].(string)
+
+	var pid string
+	switch {
+	case instance.Search != nil:
+		return searchFiles(instance, results, token)
+	case instance.Deposit != nil:
+		pid = instance.Deposit.PersistentID
+	case instance.Description.Type == "dataset":
+		pid = instance.Description.Global_id
+	default:
+		datasets, more, err := dataverseDatasets(instance.ServerUrl, instance.dataverseAlias(), token, manifestDatasetsMax)
+		if err != nil {
+			glog.Warningf("manifest: unable to list datasets of instance %q: %s", instance.ID, errorDescription(err))
+			return fileListing{Files: []ManifestFile{}, Incomplete: true}
+		}
+		if more {
+			glog.Infof("manifest: only the files of the first %d datasets of instance %q are listed", manifestDatasetsMax, instance.ID)
+		}
+		files, unlisted := listDatasets(instance.ServerUrl, datasets, token)
+		return fileListing{Files: files, Incomplete: more || len(unlisted) > 0, UnlistedDatasets: unlisted}
+	}
+
+	var files []ManifestFile
+	var err error
+	if version != "" && instance.Deposit == nil {
+		files, err = DatasetVersionFiles(instance.ServerUrl, pid, version, token)
+	} else {
+		files, err = DatasetFiles(instance.ServerUrl, pid, token)
+	}
+	if err != nil {
+		glog.Warningf("manifest: unable to list files of %s: %s", pid, errorDescription(err))
+		return fileListing{Files: []ManifestFile{}, Incomplete: true, UnlistedDatasets: []string{pid}}
+	}
+	return fileListing{Files: files}
+}
+
+// manifestPage returns perPage files of a binding from start. Download URLs
+// point to the data proxy for bindings using it, and are signed for bindings
+// with signed links, whose next page is also on the proxy.
+func (b *BusinessLogic) manifestPage(binding *dataverseBinding, start int, perPage int) *Manifest {
+	total := len(binding.Files)
+	if start > total {
+		start = total
+	}
+	end := start + perPage
+	if end > total {
+		end = total
+	}
+
+	manifest := &Manifest{
+		TotalCount:       total,
+		Start:            start,
+		Files:            make([]ManifestFile, 0, end-start),
+		Pending:          binding.FilesPending,
+		Incomplete:       binding.FilesIncomplete,
+		UnlistedDatasets: binding.UnlistedDatasets,
+	}
+	manifest.Files = append(manifest.Files, binding.Files[start:end]...)
+	if binding.Signed && b.signer != nil {
+		for i := range manifest.Files {
+			var expires time.Time
+			manifest.Files[i].DownloadURL, expires = b.signedFileURL(binding, manifest.Files[i])
+			manifest.ExpiresAt = expires.UTC().Format(time.RFC3339)
+		}
+	} else if binding.ProxyToken != "" {
+		for i := range manifest.Files {
+			manifest.Files[i].DownloadURL = b.proxyFileURL(binding, manifest.Files[i])
+		}
+	}
+	switch {
+	case end >= total:
+	case binding.Signed:
+		manifest.Next = fmt.Sprintf("%s/data/%s/files?start=%d&per_page=%d", b.proxyURL, binding.ID, end, perPage)
+	default:
+		manifest.Next = fmt.Sprintf("/v2/service_instances/%s/service_bindings/%s/manifest?start=%d&per_page=%d",
+			binding.InstanceID, binding.ID, end, perPage)
+	}
+	return manifest
+}
+
+// GetManifest returns a page of the files of a binding, as they were when
+// the binding was created
+func (b *BusinessLogic) GetManifest(instanceID string, bindingID string, start int, perPage int) (*Manifest, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	binding, ok := b.bindings[bindingID]
+	if !ok || binding.InstanceID != instanceID {
+		return nil, osb.HTTPStatusCodeError{
+			StatusCode: http.StatusNotFound,
+		}
+	}
+
+	return b.manifestPage(binding, start, perPage), nil
+}
+
+// RegisterManifestHandlers adds the endpoint paging through the manifest of
+// a binding to the broker's router, audited like those of
+// RegisterFetchHandlers
+func (b *BusinessLogic) RegisterManifestHandlers(router *mux.Router) {
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}/manifest", b.getManifestHandler).Methods("GET").Name("get_manifest")
+}
+
+func (b *BusinessLogic) getManifestHandler(w http.ResponseWriter, r *http.Request) {
+	if err := validateAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+		writeFetchError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+
+	start, err := queryInt(query, "start", 0)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	perPage, err := queryInt(query, "per_page", b.manifestPageSize)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	if start < 0 || perPage <= 0 || perPage > b.manifestPageSize {
+		description := fmt.Sprintf("start must be positive and per_page between 1 and %d", b.manifestPageSize)
+		writeFetchError(w, osb.HTTPStatusCodeError{
+			StatusCode:  http.StatusBadRequest,
+			Description: &description,
+		})
+		return
+	}
+
+	vars := mux.Vars(r)
+	response, err := b.GetManifest(vars[osb.VarKeyInstanceID], vars[osb.VarKeyBindingID], start, perPage)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+
+	writeFetchResponse(w, http.StatusOK, response)
+}
+
+func queryInt(query url.Values, key string, defaultValue int) (int, error) {
+	value := query.Get(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		description := key + " must be an integer"
+		return 0, osb.HTTPStatusCodeError{
+			StatusCode:  http.StatusBadRequest,
+			Description: &description,
+		}
+	}
+	return i, nil
+}
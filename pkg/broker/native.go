@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// nativeResponse is the envelope of Dataverse native API responses
+type nativeResponse struct {
+	Status  string          `json:"status"`
+	Message string          `json:"message,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// nativeAPI calls the Dataverse native API with token, sending body as JSON
+// when it isn't nil and decoding the data of the response into data when it
+// isn't nil. Errors reported by Dataverse are returned by dataverseError.
+func nativeAPI(method string, rawurl string, token string, body interface{}, data interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, rawurl, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("X-Dataverse-key", token)
+	}
+
+	resp, err := doDataverseRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	response := nativeResponse{}
+	if err = json.Unmarshal(respBody, &response); err != nil {
+		return badGateway(fmt.Sprintf("Dataverse answered %s to %s %s", resp.Status, method, req.URL.Path))
+	}
+	if resp.StatusCode >= 500 {
+		return dataverseError(resp.StatusCode, fmt.Sprintf("Dataverse answered %s: %s", resp.Status, response.Message))
+	}
+	if response.Status != "OK" || resp.StatusCode >= 300 {
+		description := response.Message
+		if description == "" {
+			description = fmt.Sprintf("Dataverse answered %s to %s %s", resp.Status, method, req.URL.Path)
+		}
+		return dataverseError(resp.StatusCode, description)
+	}
+
+	if data != nil && len(response.Data) > 0 {
+		return json.Unmarshal(response.Data, data)
+	}
+	return nil
+}
+
+// dataverseStatus is the status code Dataverse answered with, kept as the
+// ResponseError of the errors returned by dataverseError
+type dataverseStatus int
+
+func (s dataverseStatus) Error() string {
+	return fmt.Sprintf("Dataverse answered %d %s", int(s), http.StatusText(int(s)))
+}
+
+// dataverseError is the error returned when Dataverse answers with an error.
+// Its status codes mean something else in OSB, where 401 and 403 are about the
+// broker's own credentials and 404 and 409 about instances and bindings:
+// platforms get 400 for requests Dataverse found invalid, 422 for those it
+// refused otherwise and 502 for the others, with the message of Dataverse.
+func dataverseError(status int, description string) error {
+	code := http.StatusBadGateway
+	switch {
+	case status == http.StatusBadRequest:
+		code = http.StatusBadRequest
+	case status >= 400 && status < 500:
+		code = http.StatusUnprocessableEntity
+	}
+	return osb.HTTPStatusCodeError{
+		StatusCode:    code,
+		Description:   &description,
+		ResponseError: dataverseStatus(status),
+	}
+}
+
+// isStatus tells if err is an error from Dataverse with the status code
+func isStatus(err error, status int) bool {
+	httpErr, ok := err.(osb.HTTPStatusCodeError)
+	return ok && httpErr.ResponseError == dataverseStatus(status)
+}
+
+// isNotFound tells if err is a 404 from Dataverse
+func isNotFound(err error) bool {
+	return isStatus(err, http.StatusNotFound)
+}
@@ -0,0 +1,284 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// IDs of the open-dataset service, which gives access to any dataset of the
+// whitelisted servers by its persistent identifier
+const (
+	openDatasetServiceID = "7f3b0c52-1d4e-4b8a-9f61-0e2c5d7a3b90"
+	openDatasetPlanID    = "7f3b0c52-1d4e-4b8a-9f61-0e2c5d7a3b91"
+)
+
+// pidResolvers are the URL prefixes of persistent identifiers, turned into
+// their doi: or hdl: form
+var pidResolvers = map[string]string{
+	"https://doi.org/":        "doi:",
+	"https://dx.doi.org/":     "doi:",
+	"https://hdl.handle.net/": "hdl:",
+}
+
+// openedDataset is the dataset an open-dataset instance resolved to
+type openedDataset struct {
+	PersistentID string `json:"persistent_id"`
+	ServerUrl    string `json:"server_url"`
+	DatasetID    int    `json:"dataset_id"`
+	// Version found when provisioning or pinned by the last update, N.M or
+	// :draft
+	Version string `json:"version"`
+}
+
+// resolvedDataset is the part of the Dataverse dataset API used to resolve a
+// persistent identifier
+type resolvedDataset struct {
+	ID            int    `json:"id"`
+	PersistentUrl string `json:"persistentUrl"`
+	LatestVersion struct {
+		datasetVersion
+		MetadataBlocks struct {
+			Citation struct {
+				Fields []struct {
+					TypeName string      `json:"typeName"`
+					Value    interface{} `json:"value"`
+				} `json:"fields"`
+			} `json:"citation"`
+		} `json:"metadataBlocks"`
+	} `json:"latestVersion"`
+}
+
+// title is the title of the dataset from its citation metadata
+func (d *resolvedDataset) title() string {
+	for _, field := range d.LatestVersion.MetadataBlocks.Citation.Fields {
+		if title, ok := field.Value.(string); ok && field.TypeName == "title" {
+			return title
+		}
+	}
+	return ""
+}
+
+// openDatasetService is the catalog entry of the open-dataset service
+func openDatasetService() osb.Service {
+	service := osb.Service{
+		Name:          "open-dataset",
+		ID:            openDatasetServiceID,
+		Description:   "Any dataset of the available Dataverse servers, by its DOI or Handle",
+		Bindable:      true,
+		PlanUpdatable: truePtr(),
+		Metadata: map[string]interface{}{
+			"displayName": "Open dataset",
+		},
+		Plans: []osb.Plan{
+			{
+				Name:        "default",
+				ID:          openDatasetPlanID,
+				Description: "A dataset by its persistent identifier",
+				Free:        truePtr(),
+				Schemas: &osb.Schemas{
+					ServiceInstance: &osb.ServiceInstanceSchema{
+						Create: &osb.InputParametersSchema{
+							Parameters: map[string]interface{}{
+								"type":     "object",
+								"required": []string{"pid"},
+								"properties": map[string]interface{}{
+									"pid": map[string]interface{}{
+										"type":        "string",
+										"description": "Persistent identifier of the dataset, e.g. doi:10.7910/DVN/TJCLKP or hdl:1902.1/21919",
+									},
+									"credentials": map[string]interface{}{
+										"type":        "string",
+										"description": "API key to access restricted or unpublished datasets on Dataverse",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	pinVersion(&service.Plans[0])
+	return service
+}
+
+// isOpenDataset tells if a request is for the open-dataset service
+func isOpenDataset(serviceID string) bool {
+	return serviceID == openDatasetServiceID
+}
+
+// normalizePID returns the doi: or hdl: form of a persistent identifier
+func normalizePID(pid string) (string, error) {
+	pid = strings.TrimSpace(pid)
+	for prefix, scheme := range pidResolvers {
+		if strings.HasPrefix(pid, prefix) {
+			pid = scheme + strings.TrimPrefix(pid, prefix)
+		}
+	}
+	lower := strings.ToLower(pid)
+	if (!strings.HasPrefix(lower, "doi:") && !strings.HasPrefix(lower, "hdl:")) || !strings.Contains(pid, "/") {
+		return "", badRequest(fmt.Sprintf("%q is not a persistent identifier such as doi:10.7910/DVN/TJCLKP or hdl:1902.1/21919", pid))
+	}
+	return strings.ToLower(pid[:4]) + pid[4:], nil
+}
+
+// allowedServers lists the whitelisted Dataverse servers by URL, with their
+// name. It must be called with the BusinessLogic locked.
+func (b *BusinessLogic) allowedServers() ([]string, map[string]string) {
+	names := make(map[string]string)
+	for _, dataverse := range b.dataverses {
+		names[dataverse.ServerUrl] = dataverse.ServerName
+	}
+	urls := make([]string, 0, len(names))
+	for serverUrl := range names {
+		urls = append(urls, serverUrl)
+	}
+	sort.Strings(urls)
+	return urls, names
+}
+
+// pidLookup is the answer of a server to the lookup of a dataset
+type pidLookup struct {
+	dataset *resolvedDataset
+	err     error
+}
+
+// resolvePID looks for a dataset on the allowed servers at once through the
+// :persistentId API, which also checks the token may read it. The first
+// server in the list having it wins.
+func resolvePID(servers []string, pid string, token string) (string, *resolvedDataset, error) {
+	query := "?" + url.Values{"persistentId": {pid}}.Encode()
+
+	lookups := make([]pidLookup, len(servers))
+	var wg sync.WaitGroup
+	for i, serverUrl := range servers {
+		wg.Add(1)
+		go func(i int, serverUrl string) {
+			defer wg.Done()
+			dataset := &resolvedDataset{}
+			err := nativeAPI("GET", serverUrl+"/api/datasets/:persistentId/"+query, token, nil, dataset)
+			lookups[i] = pidLookup{dataset: dataset, err: err}
+		}(i, serverUrl)
+	}
+	wg.Wait()
+
+	var denied, failed error
+	for i, lookup := range lookups {
+		switch err := lookup.err; {
+		case err == nil:
+			return servers[i], lookup.dataset, nil
+		case isNotFound(err):
+			continue
+		case isStatus(err, http.StatusUnauthorized) || isStatus(err, http.StatusForbidden):
+			// The dataset is there but out of reach, another server
+			// may have it
+			denied = err
+		default:
+			// The server may have it, there is no telling
+			glog.Errorf("open dataset: unable to look for %s on %s: %v", pid, servers[i], err)
+			failed = err
+		}
+	}
+
+	if denied != nil {
+		return "", nil, forbidden(fmt.Sprintf("Not allowed to access %s: %s", pid, errorDescription(denied)))
+	}
+	if failed != nil {
+		return "", nil, badGateway(fmt.Sprintf("Unable to look for %s on every Dataverse server: %s", pid, errorDescription(failed)))
+	}
+	return "", nil, badRequest(fmt.Sprintf("Dataset %s was not found on the available Dataverse servers", pid))
+}
+
+// provisionOpenDataset provisions an instance of the open-dataset service.
+// Dataverse is asked without holding the lock, like when binding.
+func (b *BusinessLogic) provisionOpenDataset(request *osb.ProvisionRequest, c *broker.RequestContext) (*broker.ProvisionResponse, error) {
+	if request.PlanID != openDatasetPlanID {
+		return nil, badRequest("Unknown plan of the open-dataset service")
+	}
+
+	if err := b.provisionAllowed(request, c); err != nil {
+		return nil, err
+	}
+
+	b.RLock()
+	response, err := b.existingInstance(request)
+	servers, names := b.allowedServers()
+	b.RUnlock()
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	rawPID, err := stringParam(request.Parameters, "pid")
+	if err != nil {
+		return nil, err
+	}
+	pid, err := normalizePID(rawPID)
+	if err != nil {
+		return nil, err
+	}
+	token, _ := request.Parameters["credentials"].(string)
+
+	instance := &dataverseInstance{
+		ID:          request.InstanceID,
+		ServiceID:   request.ServiceID,
+		PlanID:      request.PlanID,
+		Description: &DataverseDescription{Type: "dataset", Global_id: pid},
+		Params:      request.Parameters,
+	}
+	version, err := versionParam(instance, request.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	serverUrl, dataset, err := resolvePID(servers, pid, token)
+	if err != nil {
+		return nil, err
+	}
+
+	instance.ServerUrl = serverUrl
+	instance.ServerName = names[serverUrl]
+	instance.Description.Name = dataset.title()
+	instance.Description.Url = dataset.PersistentUrl
+	if instance.Description.Url == "" {
+		instance.Description.Url = serverUrl + "/dataset.xhtml?" + url.Values{"persistentId": {pid}}.Encode()
+	}
+	instance.Opened = &openedDataset{
+		PersistentID: pid,
+		ServerUrl:    serverUrl,
+		DatasetID:    dataset.ID,
+		Version:      fmt.Sprintf("%d.%d", dataset.LatestVersion.VersionNumber, dataset.LatestVersion.VersionMinorNumber),
+	}
+	if dataset.LatestVersion.VersionState == "DRAFT" {
+		instance.Opened.Version = ":draft"
+	}
+	if version != "" {
+		if instance.Opened.Version, err = resolveVersion(serverUrl, pid, version, token); err != nil {
+			return nil, err
+		}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	// The same instance may have been provisioned meanwhile
+	if response, err := b.existingInstance(request); response != nil || err != nil {
+		return response, err
+	}
+	b.instances[request.InstanceID] = instance
+	glog.Infof("open dataset: instance %q is %s version %s on %s", request.InstanceID, pid, instance.Opened.Version, serverUrl)
+
+	response = &broker.ProvisionResponse{}
+	if request.AcceptsIncomplete {
+		response.Async = b.async
+	}
+	return response, nil
+}
@@ -0,0 +1,91 @@
+package broker
+
+import (
+	"net/http"
+
+	"github.com/golang/glog"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// Keys of the asynchronous operations on instances
+const (
+	provisionOperation   osb.OperationKey = "provision"
+	deprovisionOperation osb.OperationKey = "deprovision"
+)
+
+// instanceOperation is the last asynchronous operation on an instance, as
+// reported by LastOperation
+type instanceOperation struct {
+	Key         osb.OperationKey       `json:"key"`
+	State       osb.LastOperationState `json:"state"`
+	Description string                 `json:"description,omitempty"`
+}
+
+// inProgress tells if an operation is running on the instance, or it is
+// being updated
+func (i *dataverseInstance) inProgress() bool {
+	return i.updating || (i.Operation != nil && i.Operation.State == osb.StateInProgress)
+}
+
+// startOperation marks an operation in progress on the instance and runs it
+// in the background. Once run returns, finish is called with the
+// BusinessLogic locked and the result of run, then the operation's state is
+// recorded. startOperation must be called with the BusinessLogic locked.
+func (b *BusinessLogic) startOperation(instance *dataverseInstance, key osb.OperationKey, run func() error, finish func(error)) *osb.OperationKey {
+	instance.Operation = &instanceOperation{
+		Key:   key,
+		State: osb.StateInProgress,
+	}
+
+	go func() {
+		err := run()
+
+		b.Lock()
+		defer b.Unlock()
+
+		finish(err)
+		if err != nil {
+			glog.Errorf("%s of instance %q failed: %s", key, instance.ID, errorDescription(err))
+			instance.Operation.State = osb.StateFailed
+			instance.Operation.Description = errorDescription(err)
+			return
+		}
+		glog.Infof("%s of instance %q succeeded", key, instance.ID)
+		instance.Operation.State = osb.StateSucceeded
+	}()
+
+	return &key
+}
+
+// errorDescription is the message of an error for platforms and users
+func errorDescription(err error) string {
+	if httpErr, ok := err.(osb.HTTPStatusCodeError); ok && httpErr.Description != nil {
+		return *httpErr.Description
+	}
+	return err.Error()
+}
+
+// asyncRequired is returned for plans that only work asynchronously when the
+// platform doesn't accept incomplete operations
+func asyncRequired() error {
+	message := osb.AsyncErrorMessage
+	description := osb.AsyncErrorDescription
+	return osb.HTTPStatusCodeError{
+		StatusCode:   http.StatusUnprocessableEntity,
+		ErrorMessage: &message,
+		Description:  &description,
+	}
+}
+
+// concurrencyError is returned for requests on an instance with an operation
+// in progress
+func concurrencyError() error {
+	message := "ConcurrencyError"
+	description := "Another operation for this service instance is in progress"
+	return osb.HTTPStatusCodeError{
+		StatusCode:   http.StatusUnprocessableEntity,
+		ErrorMessage: &message,
+		Description:  &description,
+	}
+}
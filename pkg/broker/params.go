@@ -0,0 +1,61 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+func badRequest(description string) error {
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusBadRequest,
+		Description: &description,
+	}
+}
+
+// stringParam returns a required non-empty string parameter
+func stringParam(params map[string]interface{}, name string) (string, error) {
+	value, ok := params[name].(string)
+	if !ok || value == "" {
+		return "", badRequest(fmt.Sprintf("The %q parameter is required", name))
+	}
+	return value, nil
+}
+
+// stringsParam returns a required parameter given as a string or a list of
+// strings
+func stringsParam(params map[string]interface{}, name string) ([]string, error) {
+	values, err := optionalStringsParam(params, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, badRequest(fmt.Sprintf("The %q parameter is required", name))
+	}
+	return values, nil
+}
+
+// optionalStringsParam returns a parameter given as a string or a list of
+// strings, empty when it is missing
+func optionalStringsParam(params map[string]interface{}, name string) ([]string, error) {
+	values := make([]string, 0)
+	switch value := params[name].(type) {
+	case nil:
+	case string:
+		if value != "" {
+			values = append(values, value)
+		}
+	case []interface{}:
+		for _, v := range value {
+			s, ok := v.(string)
+			if !ok || s == "" {
+				return nil, badRequest(fmt.Sprintf("The %q parameter must be a list of strings", name))
+			}
+			values = append(values, s)
+		}
+	default:
+		return nil, badRequest(fmt.Sprintf("The %q parameter must be a string or a list of strings", name))
+	}
+	return values, nil
+}
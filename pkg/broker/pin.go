@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// versionPattern matches the versions a dataset instance can be pinned to
+var versionPattern = regexp.MustCompile(`^(:latest-published|:draft|[0-9]+\.[0-9]+)$`)
+
+// pinVersion adds the version parameter to the schemas of the plan of a
+// dataset service
+func pinVersion(plan *osb.Plan) {
+	version := map[string]interface{}{
+		"type":        "string",
+		"description": `Version of the dataset bindings point to: ":latest-published", ":draft" or a version number such as "1.0"; the latest version by default`,
+		"pattern":     versionPattern.String(),
+	}
+
+	create := plan.Schemas.ServiceInstance.Create.Parameters.(map[string]interface{})
+	create["properties"].(map[string]interface{})["version"] = version
+	plan.Schemas.ServiceInstance.Update = &osb.InputParametersSchema{
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"version": version,
+			},
+		},
+	}
+}
+
+// versionParam returns the version parameter of a dataset instance, empty
+// when it follows the latest version
+func versionParam(instance *dataverseInstance, params map[string]interface{}) (string, error) {
+	value, ok := params["version"]
+	if !ok {
+		return "", nil
+	}
+	if instance.Description.Type != "dataset" {
+		return "", badRequest("Only dataset instances can be pinned to a version")
+	}
+	version, _ := value.(string)
+	if !versionPattern.MatchString(version) {
+		return "", badRequest(`The "version" parameter must be ":latest-published", ":draft" or a version number such as "1.0"`)
+	}
+	return version, nil
+}
+
+// resolveVersion checks a version of a dataset exists and returns its number,
+// or :draft for drafts, so bindings keep pointing to the same version
+func resolveVersion(serverUrl string, pid string, version string, token string) (string, error) {
+	found := datasetVersion{}
+	query := "?" + url.Values{"persistentId": {pid}}.Encode()
+	err := nativeAPI("GET", serverUrl+"/api/datasets/:persistentId/versions/"+version+query, token, nil, &found)
+	if isNotFound(err) {
+		return "", badRequest(fmt.Sprintf("Dataset %s has no version %s", pid, version))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if found.VersionState == "DRAFT" {
+		return ":draft", nil
+	}
+	return fmt.Sprintf("%d.%d", found.VersionNumber, found.VersionMinorNumber), nil
+}
+
+// instanceVersion resolves the version a dataset instance is pinned to,
+// empty when it isn't
+func instanceVersion(instance *dataverseInstance) (string, error) {
+	version, _ := instance.Params["version"].(string)
+	if version == "" {
+		return "", nil
+	}
+	token, _ := instance.Params["credentials"].(string)
+	return resolveVersion(instance.ServerUrl, instance.Description.Global_id, version, token)
+}
+
+// versionCredentials are the version-specific URLs of a binding to a pinned
+// dataset
+func versionCredentials(instance *dataverseInstance, version string) map[string]interface{} {
+	pid := instance.Description.Global_id
+	page := url.Values{"persistentId": {pid}, "version": {version}}
+	if version == ":draft" {
+		page.Set("version", "DRAFT")
+	}
+
+	return map[string]interface{}{
+		"version":     version,
+		"coordinates": instance.ServerUrl + "/dataset.xhtml?" + page.Encode(),
+		"dataset_url": instance.ServerUrl + "/api/datasets/:persistentId/versions/" + version + "?" + url.Values{"persistentId": {pid}}.Encode(),
+	}
+}
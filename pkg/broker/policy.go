@@ -0,0 +1,204 @@
+package broker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+
+	"github.com/dataverse-broker/dataverse-broker/pkg/middleware"
+)
+
+// PolicyRule allows the subjects it selects to use a set of services and
+// plans. A rule with no namespaces, groups or users selects everyone, and "*"
+// in Services allows every service.
+type PolicyRule struct {
+	Namespaces []string `json:"namespaces,omitempty"`
+	Groups     []string `json:"groups,omitempty"`
+	Users      []string `json:"users,omitempty"`
+	Services   []string `json:"services"`
+	// Plans of the allowed services, empty for all of them
+	Plans []string `json:"plans,omitempty"`
+}
+
+// Policy decides which services and plans a subject may see and provision.
+// Anything not allowed by one of the rules is denied.
+type Policy struct {
+	// Filter the catalog for requests whose subject is known
+	FilterCatalog bool         `json:"filter_catalog"`
+	Rules         []PolicyRule `json:"rules"`
+}
+
+// policySubject is who a request is made on behalf of
+type policySubject struct {
+	Namespace string
+	Username  string
+	Groups    []string
+}
+
+// FileToPolicy reads a Policy from a JSON file
+func FileToPolicy(path string) (*Policy, error) {
+	byteValue, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &Policy{}
+	if err = json.Unmarshal(byteValue, policy); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// allowed reports whether the subject may use the service and plan
+func (p *Policy) allowed(subject *policySubject, serviceID string, planID string) bool {
+	for _, rule := range p.Rules {
+		if rule.selects(subject) && rule.allows(serviceID, planID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *PolicyRule) selects(subject *policySubject) bool {
+	if len(r.Namespaces) == 0 && len(r.Groups) == 0 && len(r.Users) == 0 {
+		return true
+	}
+	if subject.Namespace != "" && containsString(r.Namespaces, subject.Namespace) {
+		return true
+	}
+	if subject.Username != "" && containsString(r.Users, subject.Username) {
+		return true
+	}
+	for _, group := range subject.Groups {
+		if containsString(r.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *PolicyRule) allows(serviceID string, planID string) bool {
+	if !containsString(r.Services, "*") && !containsString(r.Services, serviceID) {
+		return false
+	}
+	return len(r.Plans) == 0 || containsString(r.Plans, planID)
+}
+
+// filterServices drops the services and plans the subject may not use.
+// Services left without plans are dropped entirely.
+func (p *Policy) filterServices(subject *policySubject, services []osb.Service) []osb.Service {
+	filtered := make([]osb.Service, 0, len(services))
+
+	for _, service := range services {
+		plans := make([]osb.Plan, 0, len(service.Plans))
+		for _, plan := range service.Plans {
+			if p.allowed(subject, service.ID, plan.ID) {
+				plans = append(plans, plan)
+			}
+		}
+		if len(plans) > 0 {
+			service.Plans = plans
+			filtered = append(filtered, service)
+		}
+	}
+
+	return filtered
+}
+
+// newPolicySubject gathers the subject of a request from the platform
+// context and the originating identity. Requests without either are made on
+// behalf of the user authenticated by the broker's middleware, the platform's
+// client, whose grants are never given to the platform's users. Returns false
+// when none of them are present.
+func newPolicySubject(platformContext map[string]interface{}, identity *osb.OriginatingIdentity, c *broker.RequestContext) (*policySubject, bool) {
+	subject := &policySubject{}
+	known := false
+
+	if namespace, ok := platformContext["namespace"].(string); ok && namespace != "" {
+		subject.Namespace = namespace
+		known = true
+	}
+
+	if identity != nil {
+		id, err := broker.ParseIdentity(*identity)
+		if err != nil {
+			glog.Infof("unable to parse originating identity: %v", err)
+		} else if id.Kubernetes != nil {
+			subject.Username = id.Kubernetes.Username
+			subject.Groups = append(subject.Groups, id.Kubernetes.Groups...)
+			known = true
+		} else if id.CloudFoundry != nil {
+			subject.Username = id.CloudFoundry.UserID
+			known = true
+		}
+	}
+
+	if known || identity != nil || c == nil {
+		return subject, known
+	}
+	if user, ok := middleware.UserFromRequest(c.Request); ok {
+		return &policySubject{
+			Username: user.Username,
+			Groups:   user.Groups,
+			// Namespaced brokers authenticate with a service account of
+			// their namespace
+			Namespace: serviceAccountNamespace(user.Username),
+		}, true
+	}
+	return subject, false
+}
+
+// serviceAccountNamespace returns NS for "system:serviceaccount:NS:NAME"
+func serviceAccountNamespace(username string) string {
+	parts := strings.Split(username, ":")
+	if len(parts) == 4 && parts[0] == "system" && parts[1] == "serviceaccount" {
+		return parts[2]
+	}
+	return ""
+}
+
+// originatingIdentityFromRequest reads the originating identity header, which
+// osb-broker-lib only parses for requests that carry it in their osb type
+func originatingIdentityFromRequest(r *http.Request) *osb.OriginatingIdentity {
+	if r == nil {
+		return nil
+	}
+	header := r.Header.Get(osb.OriginatingIdentityHeader)
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	value, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+	return &osb.OriginatingIdentity{
+		Platform: parts[0],
+		Value:    string(value),
+	}
+}
+
+// forbidden is returned when the policy denies a request
+func forbidden(description string) error {
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusForbidden,
+		Description: &description,
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,377 @@
+package broker
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// fileCache keeps verified copies of Dataverse files on local disk
+type fileCache struct {
+	dir      string
+	maxBytes int64
+
+	// Held to open or remove cached files, so eviction can't remove a file
+	// between checking and opening it
+	sync.Mutex
+	// locks serialize downloads of the same file
+	locks map[string]*sync.Mutex
+}
+
+func newFileCache(dir string, maxBytes int64) (*fileCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		locks:    make(map[string]*sync.Mutex),
+	}, nil
+}
+
+var cacheKeyPattern = regexp.MustCompile("[^a-zA-Z0-9]+")
+
+// key identifies a file's content, so new versions of a file aren't served
+// from the cache
+func (c *fileCache) key(file ManifestFile) string {
+	version := file.Checksum.Value
+	if version == "" {
+		version = strconv.FormatInt(file.Size, 10)
+	}
+	return strconv.Itoa(file.FileID) + "-" + cacheKeyPattern.ReplaceAllString(strings.ToLower(version), "")
+}
+
+func (c *fileCache) lock(key string) func() {
+	c.Lock()
+	l, ok := c.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		c.locks[key] = l
+	}
+	c.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// open opens the cached copy of a file if it is complete. An open copy can
+// still be read once evicted.
+func (c *fileCache) open(key string, size int64) *os.File {
+	c.Lock()
+	defer c.Unlock()
+
+	cached := filepath.Join(c.dir, key)
+	f, err := os.Open(cached)
+	if err != nil {
+		return nil
+	}
+	if info, err := f.Stat(); err != nil || info.Size() != size {
+		f.Close()
+		return nil
+	}
+
+	// Mark as recently used for eviction
+	now := time.Now()
+	os.Chtimes(cached, now, now)
+	return f
+}
+
+// get opens the cached copy of a file, downloading it from Dataverse with
+// token first if needed. The caller must close it.
+func (c *fileCache) get(file ManifestFile, token string) (*os.File, error) {
+	key := c.key(file)
+	cached := filepath.Join(c.dir, key)
+
+	unlock := c.lock(key)
+	defer unlock()
+
+	if f := c.open(key, file.Size); f != nil {
+		return f, nil
+	}
+
+	req, err := http.NewRequest("GET", file.DownloadURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Dataverse-key", token)
+	}
+	resp, err := doDataverseRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, badGateway(fmt.Sprintf("Dataverse answered %s for file %d", resp.Status, file.FileID))
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, key+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	var w io.Writer = tmp
+	h, hashErr := file.Checksum.NewHash()
+	if file.Checksum.Value != "" && hashErr == nil {
+		w = io.MultiWriter(tmp, h)
+	}
+	size, err := io.Copy(w, resp.Body)
+	tmp.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if size != file.Size || (file.Checksum.Value != "" && hashErr == nil && !file.Checksum.Matches(h)) {
+		glog.Errorf("proxy: file %d doesn't match its size or %s checksum", file.FileID, file.Checksum.Type)
+		return nil, badGateway(fmt.Sprintf("File %d doesn't match its checksum", file.FileID))
+	}
+
+	c.Lock()
+	err = os.Rename(tmp.Name(), cached)
+	var f *os.File
+	if err == nil {
+		f, err = os.Open(cached)
+	}
+	c.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	c.evict(key)
+	return f, nil
+}
+
+// evict removes the least recently used files until the cache fits in
+// maxBytes, keeping the file just added
+func (c *fileCache) evict(keep string) {
+	if c.maxBytes <= 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		glog.Errorf("proxy: unable to read cache: %v", err)
+		return
+	}
+
+	var total int64
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.Contains(entry.Name(), ".tmp") {
+			continue
+		}
+		total += entry.Size()
+		files = append(files, entry)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, f := range files {
+		if total <= c.maxBytes {
+			return
+		}
+		if f.Name() == keep {
+			continue
+		}
+		if os.Remove(filepath.Join(c.dir, f.Name())) == nil {
+			total -= f.Size()
+		}
+	}
+}
+
+func badGateway(description string) error {
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusBadGateway,
+		Description: &description,
+	}
+}
+
+// newBindingToken returns a random credential for a binding
+func newBindingToken() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
+
+// proxyFileURL is the address of a file on the proxy
+func (b *BusinessLogic) proxyFileURL(binding *dataverseBinding, file ManifestFile) string {
+	return b.proxyURL + "/data/" + binding.ID + "/files/" + strconv.Itoa(file.FileID)
+}
+
+// ProxyHandler returns the router of the data proxy. It must be served on its
+// own port, as it authenticates with binding credentials rather than those
+// of the platform.
+func (b *BusinessLogic) ProxyHandler() http.Handler {
+	router := mux.NewRouter()
+
+	router.HandleFunc("/data/{binding_id}/files", b.proxyListFiles).Methods("GET").Name("proxy_list_files")
+	router.HandleFunc("/data/{binding_id}/files/{file_id}", b.proxyGetFile).Methods("GET", "HEAD").Name("proxy_get_file")
+	if b.signer != nil {
+		router.HandleFunc("/signed/{binding_id}/{file_id}", b.proxySignedFile).Methods("GET", "HEAD").Name("proxy_signed_file")
+	}
+	router.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	router.Use(b.auditor.Middleware)
+
+	return router
+}
+
+// bindingAndToken returns a binding and the Dataverse token of its instance
+func (b *BusinessLogic) bindingAndToken(bindingID string) (*dataverseBinding, string, bool) {
+	b.RLock()
+	defer b.RUnlock()
+
+	binding, ok := b.bindings[bindingID]
+	if !ok {
+		return nil, "", false
+	}
+	instance, ok := b.instances[binding.InstanceID]
+	if !ok {
+		return nil, "", false
+	}
+
+	token, _ := instance.Params["credentials"].(string)
+	return binding, token, true
+}
+
+// proxyBinding authenticates a request with the binding's token and returns
+// the binding and the Dataverse token of its instance
+func (b *BusinessLogic) proxyBinding(r *http.Request) (*dataverseBinding, string, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	binding, dataverseToken, ok := b.bindingAndToken(mux.Vars(r)[osb.VarKeyBindingID])
+	// Unknown bindings and wrong tokens look the same
+	if !ok || binding.ProxyToken == "" || !tokensEqual(binding.ProxyToken, token) {
+		return nil, "", osb.HTTPStatusCodeError{
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	return binding, dataverseToken, nil
+}
+
+func tokensEqual(a string, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+func (b *BusinessLogic) proxyListFiles(w http.ResponseWriter, r *http.Request) {
+	binding, _, err := b.proxyBinding(r)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	start, err := queryInt(query, "start", 0)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	perPage, err := queryInt(query, "per_page", b.manifestPageSize)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	if start < 0 || perPage <= 0 || perPage > b.manifestPageSize {
+		description := fmt.Sprintf("start must be positive and per_page between 1 and %d", b.manifestPageSize)
+		writeFetchError(w, osb.HTTPStatusCodeError{
+			StatusCode:  http.StatusBadRequest,
+			Description: &description,
+		})
+		return
+	}
+
+	b.RLock()
+	manifest := b.manifestPage(binding, start, perPage)
+	b.RUnlock()
+
+	if manifest.Next != "" {
+		manifest.Next = fmt.Sprintf("%s/data/%s/files?start=%d&per_page=%d", b.proxyURL, binding.ID, start+perPage, perPage)
+	}
+	writeFetchResponse(w, http.StatusOK, manifest)
+}
+
+func (b *BusinessLogic) proxyGetFile(w http.ResponseWriter, r *http.Request) {
+	binding, token, err := b.proxyBinding(r)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+
+	if binding.Signed {
+		// The token of a binding with signed links only refreshes them
+		description := "Files of this binding are downloaded through signed links"
+		writeFetchError(w, osb.HTTPStatusCodeError{
+			StatusCode:  http.StatusForbidden,
+			Description: &description,
+		})
+		return
+	}
+
+	fileID, _ := strconv.Atoi(mux.Vars(r)["file_id"])
+	b.serveBindingFile(w, r, binding, token, fileID)
+}
+
+// serveBindingFile serves a file of the binding from the cache, supporting
+// range requests
+func (b *BusinessLogic) serveBindingFile(w http.ResponseWriter, r *http.Request, binding *dataverseBinding, token string, fileID int) {
+	auditTarget(r, binding.InstanceID, binding.ID)
+
+	var file *ManifestFile
+	for i := range binding.Files {
+		if binding.Files[i].FileID == fileID {
+			file = &binding.Files[i]
+			break
+		}
+	}
+	if file == nil {
+		writeFetchError(w, osb.HTTPStatusCodeError{StatusCode: http.StatusNotFound})
+		return
+	}
+
+	f, err := b.cache.get(*file, token)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+
+	if file.ContentType != "" {
+		w.Header().Set("Content-Type", file.ContentType)
+	}
+	http.ServeContent(w, r, path.Base(file.Path), info.ModTime(), f)
+}
@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/golang/glog"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+const publishOperation osb.OperationKey = "publish"
+
+// datasetPID is the persistent ID of the dataset of an instance, empty for
+// dataverses
+func (i *dataverseInstance) datasetPID() string {
+	if i.Deposit != nil {
+		return i.Deposit.PersistentID
+	}
+	if i.Description.Type == "dataset" {
+		return i.Description.Global_id
+	}
+	return ""
+}
+
+// publication is a checked request to publish the dataset of an instance
+type publication struct {
+	pid         string
+	versionType string
+	token       string
+}
+
+// publishParams checks the "publish" update parameter of an instance
+func publishParams(instance *dataverseInstance, publish interface{}) (*publication, error) {
+	pid := instance.datasetPID()
+	if pid == "" {
+		return nil, badRequest("Only datasets can be published")
+	}
+	versionType, _ := publish.(string)
+	if versionType != "major" && versionType != "minor" {
+		return nil, badRequest(`The "publish" parameter must be "major" or "minor"`)
+	}
+	token, _ := instance.Params["credentials"].(string)
+	if token == "" {
+		return nil, badRequest("A Dataverse API key is required to publish")
+	}
+	return &publication{pid: pid, versionType: versionType, token: token}, nil
+}
+
+// publishDataset publishes the dataset of an instance in the background. It
+// must be called with the BusinessLogic locked.
+func (b *BusinessLogic) publishDataset(instance *dataverseInstance, p *publication) *osb.OperationKey {
+	serverUrl, pid, token, versionType := instance.ServerUrl, p.pid, p.token, p.versionType
+	var version datasetVersion
+
+	return b.startOperation(instance, publishOperation, func() (err error) {
+		version, err = runPublish(serverUrl, pid, token, versionType)
+		return err
+	}, func(err error) {
+		if err == nil {
+			instance.Operation.Description = fmt.Sprintf("Published version %d.%d", version.VersionNumber, version.VersionMinorNumber)
+		}
+	})
+}
+
+// runPublish starts publishing a dataset, whose locks have been checked, and
+// waits until Dataverse is done with it, returning the published version
+func runPublish(serverUrl string, pid string, token string, versionType string) (datasetVersion, error) {
+	version := datasetVersion{}
+
+	query := "?" + url.Values{"persistentId": {pid}, "type": {versionType}}.Encode()
+	if err := nativeAPI("POST", serverUrl+"/api/datasets/:persistentId/actions/:publish"+query, token, nil, nil); err != nil {
+		return version, err
+	}
+	glog.Infof("publish: started %s release of %s", versionType, pid)
+
+	// Publishing registers the PID and runs workflows while the dataset is
+	// locked
+	if err := WaitForDatasetLocks(serverUrl, pid, token); err != nil {
+		return version, err
+	}
+
+	query = "?" + url.Values{"persistentId": {pid}}.Encode()
+	if err := nativeAPI("GET", serverUrl+"/api/datasets/:persistentId/versions/:latest"+query, token, nil, &version); err != nil {
+		return version, err
+	}
+	if version.VersionState != "RELEASED" {
+		// Dataverse only logs why asynchronous publishing failed
+		return version, fmt.Errorf("Dataset %s is still a draft, publishing failed on the Dataverse server", pid)
+	}
+
+	glog.Infof("publish: released %s version %d.%d", pid, version.VersionNumber, version.VersionMinorNumber)
+	return version, nil
+}
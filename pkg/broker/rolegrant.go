@@ -0,0 +1,252 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// assigneePattern matches users (@user) and groups (&group) as Dataverse
+// names them in role assignments
+var assigneePattern = regexp.MustCompile(`^[@&][a-zA-Z0-9._@:/-]+$`)
+
+// roleGrant is a role assignment created when provisioning the role-grant
+// plan
+type roleGrant struct {
+	Assignee     string `json:"assignee"`
+	Role         string `json:"role"`
+	AssignmentID int    `json:"assignment_id"`
+}
+
+// roleGrantPlanID is the ID of the role-grant plan of a dataverse service
+func roleGrantPlanID(planID string) string {
+	return planID + "-role-grant"
+}
+
+// isRoleGrantPlan tells if planID is the role-grant plan of the dataverse
+func isRoleGrantPlan(dataverse *dataverseInstance, planID string) bool {
+	return dataverse.Description.Type != "dataset" && planID == roleGrantPlanID(dataverse.PlanID)
+}
+
+// roleGrantPlan is the catalog entry of the role-grant plan of a dataverse
+func roleGrantPlan(dataverse *dataverseInstance) osb.Plan {
+	credentials := map[string]interface{}{
+		"type":        "string",
+		"description": "API key of a Dataverse user allowed to manage permissions of the dataverse",
+	}
+	role := map[string]interface{}{
+		"type":        "string",
+		"description": "Alias of a role defined in the dataverse, e.g. curator or contributor",
+	}
+
+	return osb.Plan{
+		Name:        "role-grant",
+		ID:          roleGrantPlanID(dataverse.PlanID),
+		Description: "A role in " + dataverse.Description.Name + " for a user or group",
+		Free:        truePtr(),
+		Bindable:    falsePtr(),
+		Schemas: &osb.Schemas{
+			ServiceInstance: &osb.ServiceInstanceSchema{
+				Create: &osb.InputParametersSchema{
+					Parameters: map[string]interface{}{
+						"type":     "object",
+						"required": []string{"credentials", "assignee", "role"},
+						"properties": map[string]interface{}{
+							"credentials": credentials,
+							"assignee": map[string]interface{}{
+								"type":        "string",
+								"description": "User (@user) or group (&group) to give the role to",
+							},
+							"role": role,
+						},
+					},
+				},
+				Update: &osb.InputParametersSchema{
+					Parameters: map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"role": role,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func falsePtr() *bool {
+	b := false
+	return &b
+}
+
+// dataverseRole is an entry of the Dataverse roles API
+type dataverseRole struct {
+	Alias string `json:"alias"`
+	Name  string `json:"name"`
+}
+
+// builtinRoles are the roles every Dataverse defines in its root dataverse
+var builtinRoles = []string{
+	"admin", "curator", "dsContributor", "dvContributor", "editor", "fileDownloader", "fullContributor", "member",
+}
+
+// validateRole checks the role is defined in the dataverse or, for the
+// built-in roles, in the root dataverse. Only admins of the root dataverse
+// may list its roles, others are checked against the usual built-in roles.
+func validateRole(serverUrl string, alias string, token string, role string) error {
+	available := make([]string, 0)
+	for _, dataverse := range []string{alias, ":root"} {
+		aliases := make([]string, 0)
+		roles := make([]dataverseRole, 0)
+		err := nativeAPI("GET", serverUrl+"/api/dataverses/"+url.PathEscape(dataverse)+"/roles", token, nil, &roles)
+		switch {
+		case dataverse == ":root" && (isStatus(err, http.StatusUnauthorized) || isStatus(err, http.StatusForbidden)):
+			aliases = builtinRoles
+		case err != nil:
+			return err
+		default:
+			for _, r := range roles {
+				aliases = append(aliases, r.Alias)
+			}
+		}
+
+		for _, a := range aliases {
+			if a == role {
+				return nil
+			}
+			if !containsString(available, a) {
+				available = append(available, a)
+			}
+		}
+	}
+
+	sort.Strings(available)
+	return badRequest(fmt.Sprintf("Role %q is not defined in %s, available roles are %s", role, alias, strings.Join(available, ", ")))
+}
+
+// roleGrantParams validates the provision parameters of the role-grant plan
+func roleGrantParams(params map[string]interface{}) (string, string, error) {
+	if _, err := stringParam(params, "credentials"); err != nil {
+		return "", "", badRequest("A Dataverse API key is required to assign roles")
+	}
+	assignee, err := stringParam(params, "assignee")
+	if err != nil {
+		return "", "", err
+	}
+	if !assigneePattern.MatchString(assignee) {
+		return "", "", badRequest(fmt.Sprintf("Assignee %q must be a user (@user) or a group (&group)", assignee))
+	}
+	role, err := stringParam(params, "role")
+	if err != nil {
+		return "", "", err
+	}
+	return assignee, role, nil
+}
+
+// assignRole gives the role on the instance's dataverse to the assignee and
+// returns the ID of the assignment
+func assignRole(instance *dataverseInstance, assignee string, role string) (int, error) {
+	token, _ := instance.Params["credentials"].(string)
+	alias := instance.dataverseAlias()
+
+	if err := validateRole(instance.ServerUrl, alias, token, role); err != nil {
+		return 0, err
+	}
+
+	assignment := struct {
+		ID int `json:"id"`
+	}{}
+	err := nativeAPI("POST", instance.ServerUrl+"/api/dataverses/"+url.PathEscape(alias)+"/assignments", token, map[string]interface{}{
+		"assignee": assignee,
+		"role":     role,
+	}, &assignment)
+	if err != nil {
+		return 0, err
+	}
+
+	glog.Infof("role grant: assigned %q on %q to %s", role, alias, assignee)
+	return assignment.ID, nil
+}
+
+// revokeRole deletes a role assignment on the instance's dataverse
+func revokeRole(instance *dataverseInstance, assignmentID int) error {
+	token, _ := instance.Params["credentials"].(string)
+	alias := instance.dataverseAlias()
+
+	err := nativeAPI("DELETE", fmt.Sprintf("%s/api/dataverses/%s/assignments/%d", instance.ServerUrl, url.PathEscape(alias), assignmentID),
+		token, nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	if err == nil {
+		glog.Infof("role grant: revoked assignment %d on %q", assignmentID, alias)
+	}
+	return err
+}
+
+// createRoleGrant assigns the role of a role-grant instance
+func createRoleGrant(instance *dataverseInstance) (*roleGrant, error) {
+	assignee, role, err := roleGrantParams(instance.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := assignRole(instance, assignee, role)
+	if err != nil {
+		return nil, err
+	}
+
+	return &roleGrant{
+		Assignee:     assignee,
+		Role:         role,
+		AssignmentID: id,
+	}, nil
+}
+
+// roleGrantUpdate returns the new role of a role-grant instance in update
+// parameters, "" when it doesn't change
+func roleGrantUpdate(instance *dataverseInstance, params map[string]interface{}) (string, error) {
+	if assignee, ok := params["assignee"].(string); ok && assignee != instance.Grant.Assignee {
+		return "", badRequest("The assignee of a role grant can't be changed, provision a new instance instead")
+	}
+	role, ok := params["role"].(string)
+	if !ok || role == instance.Grant.Role {
+		return "", nil
+	}
+	return role, nil
+}
+
+// changeRole gives the assignee of a role-grant instance a new role and
+// returns the ID of the assignment. The new role is assigned before the old
+// one is revoked, so the assignee never loses access.
+func changeRole(instance *dataverseInstance, role string) (int, error) {
+	id, err := assignRole(instance, instance.Grant.Assignee, role)
+	if err != nil {
+		return 0, err
+	}
+	if err = revokeRole(instance, instance.Grant.AssignmentID); err != nil {
+		// Roll back, so the update can be retried
+		if rollbackErr := revokeRole(instance, id); rollbackErr != nil {
+			glog.Errorf("role grant: unable to revoke assignment %d: %v", id, rollbackErr)
+		}
+		return 0, err
+	}
+	return id, nil
+}
+
+// notBindable is returned when binding to an instance of a plan that has
+// nothing to bind
+func notBindable() error {
+	description := "Instances of this plan can't be bound"
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusBadRequest,
+		Description: &description,
+	}
+}
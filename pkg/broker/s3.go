@@ -0,0 +1,558 @@
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+const (
+	// defaultS3Region is the region clients sign requests for when not
+	// configured
+	defaultS3Region = "us-east-1"
+	// s3MaxSkew is how far the date of a signed request may be from now
+	s3MaxSkew = 15 * time.Minute
+	// s3MaxExpires is the longest a presigned URL may be valid, in seconds
+	s3MaxExpires = 7 * 24 * 3600
+	// s3MaxKeys is the largest page of ListObjectsV2
+	s3MaxKeys = 1000
+	// s3EmptyPayload is the SHA-256 of an empty body
+	s3EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3Namespace    = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat   = "2006-01-02T15:04:05.000Z"
+)
+
+// s3Error is an error in the format of S3
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+	status   int
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func newS3Error(status int, code string, message string) *s3Error {
+	return &s3Error{Code: code, Message: message, status: status}
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name           `xml:"ListBucketResult"`
+	Xmlns                 string             `xml:"xmlns,attr"`
+	Name                  string             `xml:"Name"`
+	Prefix                string             `xml:"Prefix"`
+	Delimiter             string             `xml:"Delimiter,omitempty"`
+	MaxKeys               int                `xml:"MaxKeys"`
+	KeyCount              int                `xml:"KeyCount"`
+	IsTruncated           bool               `xml:"IsTruncated"`
+	ContinuationToken     string             `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string             `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string             `xml:"StartAfter,omitempty"`
+	EncodingType          string             `xml:"EncodingType,omitempty"`
+	Contents              []s3Object         `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefixes `xml:"CommonPrefixes"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefixes struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Region  string   `xml:",chardata"`
+}
+
+// newS3Keys returns a random access key ID and secret for a binding
+func newS3Keys() (string, string, error) {
+	id := make([]byte, 15)
+	secret := make([]byte, 30)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	return "DVB" + base32.StdEncoding.EncodeToString(id)[:17], base64.StdEncoding.EncodeToString(secret), nil
+}
+
+// S3Handler returns the handler of the S3 gateway, where every binding is a
+// bucket named after its ID holding the files of its manifest. It must be
+// served on its own port, as S3 clients expect buckets at the root.
+func (b *BusinessLogic) S3Handler() http.Handler {
+	return b.auditor.Handler("s3", http.HandlerFunc(b.serveS3))
+}
+
+func (b *BusinessLogic) serveS3(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/healthz" {
+		w.Write([]byte("OK"))
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeS3Error(w, r, newS3Error(http.StatusMethodNotAllowed, "MethodNotAllowed", "The gateway is read-only"))
+		return
+	}
+
+	binding, token, err := b.s3Authenticate(r)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	auditTarget(r, binding.InstanceID, binding.ID)
+
+	bucket, key := splitS3Path(r.URL.Path)
+	if bucket == "" {
+		b.s3ListBuckets(w, r, binding)
+		return
+	}
+	if bucket != binding.ID {
+		writeS3Error(w, r, newS3Error(http.StatusForbidden, "AccessDenied", "The access key is for bucket "+binding.ID))
+		return
+	}
+
+	if key == "" {
+		query := r.URL.Query()
+		switch {
+		case query["location"] != nil:
+			writeS3XML(w, r, &s3LocationConstraint{Xmlns: s3Namespace, Region: b.s3Region})
+		case r.Method == "HEAD":
+			// HeadBucket
+			w.WriteHeader(http.StatusOK)
+		case query.Get("list-type") == "2":
+			b.s3ListObjects(w, r, binding)
+		default:
+			writeS3Error(w, r, newS3Error(http.StatusNotImplemented, "NotImplemented", "Only ListObjectsV2 is supported"))
+		}
+		return
+	}
+
+	var file *ManifestFile
+	for i := range binding.Files {
+		if binding.Files[i].Path == key {
+			file = &binding.Files[i]
+			break
+		}
+	}
+	if file == nil {
+		writeS3Error(w, r, newS3Error(http.StatusNotFound, "NoSuchKey", "The specified key does not exist."))
+		return
+	}
+
+	w.Header().Set("ETag", s3ETag(*file))
+	if file.ContentType != "" {
+		w.Header().Set("Content-Type", file.ContentType)
+	}
+
+	if r.Method == "HEAD" {
+		// Don't download the file just for its headers
+		w.Header().Set("Content-Length", strconv.FormatInt(file.Size, 10))
+		w.Header().Set("Last-Modified", binding.CreatedAt.UTC().Format(http.TimeFormat))
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	f, err := b.cache.get(*file, token)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	defer f.Close()
+
+	http.ServeContent(w, r, "", binding.CreatedAt, f)
+}
+
+// s3ListBuckets lists the only bucket the access key can read
+func (b *BusinessLogic) s3ListBuckets(w http.ResponseWriter, r *http.Request, binding *dataverseBinding) {
+	writeS3XML(w, r, &s3ListAllMyBucketsResult{
+		Xmlns: s3Namespace,
+		Owner: s3Owner{ID: binding.ID, DisplayName: binding.ID},
+		Buckets: []s3Bucket{{
+			Name:         binding.ID,
+			CreationDate: binding.CreatedAt.UTC().Format(s3TimeFormat),
+		}},
+	})
+}
+
+// s3ListObjects implements ListObjectsV2. Continuation tokens are the last
+// key returned.
+func (b *BusinessLogic) s3ListObjects(w http.ResponseWriter, r *http.Request, binding *dataverseBinding) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+
+	maxKeys := s3MaxKeys
+	if value := query.Get("max-keys"); value != "" {
+		var err error
+		if maxKeys, err = strconv.Atoi(value); err != nil || maxKeys < 0 {
+			writeS3Error(w, r, newS3Error(http.StatusBadRequest, "InvalidArgument", "max-keys must be a positive integer"))
+			return
+		}
+		if maxKeys > s3MaxKeys {
+			maxKeys = s3MaxKeys
+		}
+	}
+
+	startAfter := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		decoded, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			writeS3Error(w, r, newS3Error(http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect"))
+			return
+		}
+		startAfter = string(decoded)
+	}
+
+	encode := func(s string) string { return s }
+	if query.Get("encoding-type") == "url" {
+		encode = func(s string) string { return s3Escape(s, false) }
+	}
+
+	result := &s3ListBucketResult{
+		Xmlns:             s3Namespace,
+		Name:              binding.ID,
+		Prefix:            encode(prefix),
+		Delimiter:         encode(delimiter),
+		MaxKeys:           maxKeys,
+		ContinuationToken: query.Get("continuation-token"),
+		StartAfter:        encode(query.Get("start-after")),
+		EncodingType:      query.Get("encoding-type"),
+		Contents:          make([]s3Object, 0),
+	}
+
+	keys := make([]*ManifestFile, 0, len(binding.Files))
+	for i := range binding.Files {
+		keys = append(keys, &binding.Files[i])
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Path < keys[j].Path })
+
+	lastModified := binding.CreatedAt.UTC().Format(s3TimeFormat)
+	seen := make(map[string]bool)
+	last := ""
+	for _, file := range keys {
+		if !strings.HasPrefix(file.Path, prefix) || file.Path <= startAfter {
+			continue
+		}
+		// Keys grouped in a prefix returned on a previous page
+		if delimiter != "" && strings.HasSuffix(startAfter, delimiter) && strings.HasPrefix(file.Path, startAfter) {
+			continue
+		}
+
+		commonPrefix := ""
+		if delimiter != "" {
+			if i := strings.Index(file.Path[len(prefix):], delimiter); i >= 0 {
+				commonPrefix = file.Path[:len(prefix)+i+len(delimiter)]
+				if seen[commonPrefix] {
+					continue
+				}
+			}
+		}
+
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			if last != "" {
+				result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(last))
+			}
+			break
+		}
+
+		if commonPrefix != "" {
+			seen[commonPrefix] = true
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefixes{Prefix: encode(commonPrefix)})
+			last = commonPrefix
+		} else {
+			result.Contents = append(result.Contents, s3Object{
+				Key:          encode(file.Path),
+				LastModified: lastModified,
+				ETag:         s3ETag(*file),
+				Size:         file.Size,
+				StorageClass: "STANDARD",
+			})
+			last = file.Path
+		}
+		result.KeyCount++
+	}
+
+	writeS3XML(w, r, result)
+}
+
+// s3ETag is the MD5 of the file when Dataverse has it, as S3 clients expect.
+// Other checksums would be taken for an MD5, files without one get a value
+// that can't be.
+func s3ETag(file ManifestFile) string {
+	if file.Checksum.Value == "" || !strings.EqualFold(file.Checksum.Type, "MD5") {
+		return fmt.Sprintf(`"%d-%d"`, file.FileID, file.Size)
+	}
+	return `"` + strings.ToLower(file.Checksum.Value) + `"`
+}
+
+func splitS3Path(path string) (string, string) {
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+// s3Authenticate checks the AWS Signature Version 4 of a request, either in
+// the Authorization header or in the query of a presigned URL, and returns
+// the binding of the access key and the Dataverse token of its instance
+func (b *BusinessLogic) s3Authenticate(r *http.Request) (*dataverseBinding, string, error) {
+	query := r.URL.Query()
+
+	var credential, signedHeaders, signature, amzDate string
+	presigned := false
+
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+			return nil, "", newS3Error(http.StatusBadRequest, "InvalidRequest", "Only AWS4-HMAC-SHA256 signatures are supported")
+		}
+		for _, field := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+			parts := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			switch parts[0] {
+			case "Credential":
+				credential = parts[1]
+			case "SignedHeaders":
+				signedHeaders = parts[1]
+			case "Signature":
+				signature = parts[1]
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+	} else if query.Get("X-Amz-Algorithm") == "AWS4-HMAC-SHA256" {
+		presigned = true
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+	} else {
+		return nil, "", newS3Error(http.StatusForbidden, "AccessDenied", "Anonymous access is not allowed")
+	}
+
+	// AKID/yyyymmdd/region/s3/aws4_request
+	scope := strings.Split(credential, "/")
+	if len(scope) != 5 || scope[3] != "s3" || scope[4] != "aws4_request" || signedHeaders == "" || signature == "" {
+		return nil, "", newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization is malformed")
+	}
+	if scope[2] != b.s3Region {
+		return nil, "", newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "The region must be "+b.s3Region)
+	}
+
+	date, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || date.Format("20060102") != scope[1] {
+		return nil, "", newS3Error(http.StatusForbidden, "AccessDenied", "Missing or invalid X-Amz-Date")
+	}
+	if presigned {
+		// Presigned URLs can't be made to last longer by dating them
+		// later
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 || expires > s3MaxExpires {
+			return nil, "", newS3Error(http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires must be between 0 and 604800")
+		}
+		if date.After(time.Now().Add(s3MaxSkew)) {
+			return nil, "", newS3Error(http.StatusForbidden, "AccessDenied", "Request is not valid yet")
+		}
+		if time.Now().After(date.Add(time.Duration(expires) * time.Second)) {
+			return nil, "", newS3Error(http.StatusForbidden, "AccessDenied", "Request has expired")
+		}
+	} else if skew := time.Since(date); skew > s3MaxSkew || skew < -s3MaxSkew {
+		return nil, "", newS3Error(http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the current time is too large")
+	}
+
+	binding, token, secret, ok := b.bindingForS3Key(scope[0])
+	if !ok {
+		return nil, "", newS3Error(http.StatusForbidden, "InvalidAccessKeyId", "The access key ID does not exist")
+	}
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		strings.Join(scope[1:], "/"),
+		sha256Hex(s3CanonicalRequest(r, strings.Split(signedHeaders, ";"), presigned)),
+	}, "\n")
+
+	key := []byte("AWS4" + secret)
+	for _, part := range scope[1:] {
+		key = hmacSHA256(key, part)
+	}
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, "", newS3Error(http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided")
+	}
+
+	return binding, token, nil
+}
+
+// bindingForS3Key returns the binding of an access key, the Dataverse token
+// of its instance and the secret key
+func (b *BusinessLogic) bindingForS3Key(accessKeyID string) (*dataverseBinding, string, string, bool) {
+	b.RLock()
+	defer b.RUnlock()
+
+	for _, binding := range b.bindings {
+		if binding.S3AccessKeyID == "" || binding.S3AccessKeyID != accessKeyID {
+			continue
+		}
+		instance, ok := b.instances[binding.InstanceID]
+		if !ok {
+			return nil, "", "", false
+		}
+		token, _ := instance.Params["credentials"].(string)
+		return binding, token, binding.S3SecretKey, true
+	}
+
+	return nil, "", "", false
+}
+
+// s3CanonicalRequest builds the canonical request of Signature Version 4
+func s3CanonicalRequest(r *http.Request, signedHeaders []string, presigned bool) string {
+	query := r.URL.Query()
+	if presigned {
+		query.Del("X-Amz-Signature")
+	}
+	params := make([]string, 0, len(query))
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(params)
+
+	headers := make([]string, 0, len(signedHeaders))
+	for _, name := range signedHeaders {
+		value := strings.Join(r.Header[http.CanonicalHeaderKey(name)], ",")
+		if name == "host" {
+			value = r.Host
+		}
+		headers = append(headers, name+":"+strings.Join(strings.Fields(value), " ")+"\n")
+	}
+
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	if presigned {
+		payload = "UNSIGNED-PAYLOAD"
+	} else if payload == "" {
+		payload = s3EmptyPayload
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		s3Escape(r.URL.Path, false),
+		strings.Join(params, "&"),
+		strings.Join(headers, ""),
+		strings.Join(signedHeaders, ";"),
+		payload,
+	}, "\n")
+}
+
+// s3Escape URI encodes s the way Signature Version 4 does
+func s3Escape(s string, encodeSlash bool) string {
+	const upperhex = "0123456789ABCDEF"
+	escaped := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			escaped = append(escaped, c)
+		} else {
+			escaped = append(escaped, '%', upperhex[c>>4], upperhex[c&15])
+		}
+	}
+	return string(escaped)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func writeS3XML(w http.ResponseWriter, r *http.Request, object interface{}) {
+	data, err := xml.Marshal(object)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		w.Write([]byte(xml.Header))
+		w.Write(data)
+	}
+}
+
+// writeS3Error writes errors as S3 does. Errors of the cache or of Dataverse
+// keep their status.
+func writeS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	e, ok := err.(*s3Error)
+	if !ok {
+		e = newS3Error(http.StatusInternalServerError, "InternalError", err.Error())
+		if httpErr, ok := osb.IsHTTPError(err); ok {
+			e.status = httpErr.StatusCode
+			if httpErr.Description != nil {
+				e.Message = *httpErr.Description
+			}
+			if httpErr.StatusCode == http.StatusServiceUnavailable {
+				e.Code = "ServiceUnavailable"
+			}
+		}
+	}
+	e.Resource = r.URL.Path
+
+	data, _ := xml.Marshal(e)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.status)
+	if r.Method != "HEAD" {
+		w.Write([]byte(xml.Header))
+		w.Write(data)
+	}
+}
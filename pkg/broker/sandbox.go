@@ -0,0 +1,243 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/golang/glog"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// What deprovisioning does with sandbox dataverses that aren't empty. Empty
+// ones are always deleted.
+const (
+	// SandboxRetentionFail fails the deprovision, keeping the instance
+	SandboxRetentionFail = "fail"
+	// SandboxRetentionRetain leaves the dataverse on the server and deletes
+	// the instance
+	SandboxRetentionRetain = "retain"
+)
+
+// sandboxAliasLength is the longest alias Dataverse accepts
+const sandboxAliasLength = 60
+
+// aliasPattern matches what Dataverse doesn't allow in aliases and usernames
+var aliasPattern = regexp.MustCompile("[^a-zA-Z0-9_-]+")
+
+// sandboxDataverse is a child dataverse created when provisioning the
+// sandbox plan
+type sandboxDataverse struct {
+	Alias string `json:"alias"`
+	// Set once the dataverse is created
+	ID int `json:"id,omitempty"`
+}
+
+// sandboxPlanID is the ID of the sandbox plan of a dataverse service
+func sandboxPlanID(planID string) string {
+	return planID + "-sandbox"
+}
+
+// isSandboxPlan tells if planID is the sandbox plan of the dataverse
+func isSandboxPlan(dataverse *dataverseInstance, planID string) bool {
+	return dataverse.Description.Type != "dataset" && planID == sandboxPlanID(dataverse.PlanID)
+}
+
+// sandboxAlias derives the alias of a sandbox dataverse from its instance ID
+func sandboxAlias(instanceID string) string {
+	alias := "sandbox-" + aliasPattern.ReplaceAllString(instanceID, "-")
+	if len(alias) > sandboxAliasLength {
+		alias = alias[:sandboxAliasLength]
+	}
+	return alias
+}
+
+// sandboxPlan is the catalog entry of the sandbox plan of a dataverse
+func sandboxPlan(dataverse *dataverseInstance) osb.Plan {
+	return osb.Plan{
+		Name:        "sandbox",
+		ID:          sandboxPlanID(dataverse.PlanID),
+		Description: "A new dataverse of your own in " + dataverse.Description.Name,
+		Free:        truePtr(),
+		Schemas: &osb.Schemas{
+			ServiceInstance: &osb.ServiceInstanceSchema{
+				Create: &osb.InputParametersSchema{
+					Parameters: map[string]interface{}{
+						"type":     "object",
+						"required": []string{"credentials", "contacts"},
+						"properties": map[string]interface{}{
+							"credentials": map[string]interface{}{
+								"type":        "string",
+								"description": "API key of a Dataverse user allowed to add dataverses to the dataverse",
+							},
+							"contacts": map[string]interface{}{
+								"type":        "array",
+								"description": "E-mail addresses of the contacts of the new dataverse",
+								"items":       map[string]interface{}{"type": "string"},
+							},
+							"name": map[string]interface{}{
+								"type":        "string",
+								"description": "Name of the new dataverse, the alias by default",
+							},
+							"affiliation": map[string]interface{}{
+								"type":        "string",
+								"description": "Affiliation of the new dataverse",
+							},
+							"description": map[string]interface{}{
+								"type":        "string",
+								"description": "Description of the new dataverse",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// sandboxMetadata validates the provision parameters of the sandbox plan and
+// returns the dataverse to create, in the format of the native API
+func sandboxMetadata(alias string, params map[string]interface{}) (map[string]interface{}, error) {
+	if _, err := stringParam(params, "credentials"); err != nil {
+		return nil, badRequest("A Dataverse API key is required to create a dataverse")
+	}
+	contacts, err := stringsParam(params, "contacts")
+	if err != nil {
+		return nil, err
+	}
+
+	contactValues := make([]map[string]interface{}, 0, len(contacts))
+	for _, contact := range contacts {
+		contactValues = append(contactValues, map[string]interface{}{"contactEmail": contact})
+	}
+
+	metadata := map[string]interface{}{
+		"alias":             alias,
+		"name":              alias,
+		"dataverseContacts": contactValues,
+		"dataverseType":     "UNCATEGORIZED",
+	}
+	for _, name := range []string{"name", "affiliation", "description"} {
+		if value, ok := params[name].(string); ok && value != "" {
+			metadata[name] = value
+		}
+	}
+
+	return metadata, nil
+}
+
+// createSandbox creates the dataverse of a sandbox instance under the
+// whitelisted one
+func createSandbox(serverUrl string, parent string, alias string, params map[string]interface{}) (int, error) {
+	metadata, err := sandboxMetadata(alias, params)
+	if err != nil {
+		return 0, err
+	}
+
+	created := struct {
+		ID int `json:"id"`
+	}{}
+	err = nativeAPI("POST", serverUrl+"/api/dataverses/"+url.PathEscape(parent), params["credentials"].(string), metadata, &created)
+	if err != nil {
+		return 0, err
+	}
+
+	glog.Infof("sandbox: created dataverse %q in %q", alias, parent)
+	return created.ID, nil
+}
+
+// removeSandbox deletes the dataverse of a sandbox instance if it is empty,
+// and applies the retention otherwise
+func removeSandbox(serverUrl string, alias string, token string, retention string) error {
+	contents := make([]interface{}, 0)
+	err := nativeAPI("GET", serverUrl+"/api/dataverses/"+url.PathEscape(alias)+"/contents", token, nil, &contents)
+	if isNotFound(err) {
+		glog.Infof("sandbox: dataverse %q is already gone", alias)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(contents) > 0 {
+		if retention == SandboxRetentionRetain {
+			glog.Infof("sandbox: retaining dataverse %q with %d items", alias, len(contents))
+			return nil
+		}
+		description := fmt.Sprintf("Dataverse %s is not empty, remove its %d datasets and dataverses first", alias, len(contents))
+		return osb.HTTPStatusCodeError{
+			StatusCode:  http.StatusConflict,
+			Description: &description,
+		}
+	}
+
+	err = nativeAPI("DELETE", serverUrl+"/api/dataverses/"+url.PathEscape(alias), token, nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	if err == nil {
+		glog.Infof("sandbox: deleted dataverse %q", alias)
+	}
+	return err
+}
+
+// provisionSandbox creates the dataverse of a sandbox instance in the
+// background. It must be called with the BusinessLogic locked.
+func (b *BusinessLogic) provisionSandbox(instance *dataverseInstance) *osb.OperationKey {
+	serverUrl, parent, alias := instance.ServerUrl, instance.Description.Identifier, instance.Sandbox.Alias
+	params := instance.Params
+	var id int
+
+	return b.startOperation(instance, provisionOperation, func() (err error) {
+		id, err = createSandbox(serverUrl, parent, alias, params)
+		return err
+	}, func(err error) {
+		if err == nil {
+			instance.Sandbox.ID = id
+		}
+	})
+}
+
+// deprovisionSandbox removes the dataverse of a sandbox instance in the
+// background, deleting the instance once done. It must be called with the
+// BusinessLogic locked.
+func (b *BusinessLogic) deprovisionSandbox(instance *dataverseInstance) *osb.OperationKey {
+	serverUrl, alias, retention := instance.ServerUrl, instance.Sandbox.Alias, b.sandboxRetention
+	token, _ := instance.Params["credentials"].(string)
+
+	return b.startOperation(instance, deprovisionOperation, func() error {
+		return removeSandbox(serverUrl, alias, token, retention)
+	}, func(err error) {
+		if err == nil {
+			b.deleteInstance(instance.ID)
+		}
+	})
+}
+
+// dataverseAlias is the alias of the dataverse an instance gives access to
+func (i *dataverseInstance) dataverseAlias() string {
+	if i.Sandbox != nil {
+		return i.Sandbox.Alias
+	}
+	return i.Description.Identifier
+}
+
+// bindable returns an error when an instance can't be bound to yet
+func (i *dataverseInstance) bindable() error {
+	if i.inProgress() {
+		return concurrencyError()
+	}
+	if i.Grant != nil {
+		return notBindable()
+	}
+	if i.Sandbox != nil && i.Sandbox.ID == 0 {
+		description := "The sandbox dataverse of this instance could not be created"
+		return osb.HTTPStatusCodeError{
+			StatusCode:  http.StatusUnprocessableEntity,
+			Description: &description,
+		}
+	}
+	return nil
+}
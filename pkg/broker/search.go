@@ -0,0 +1,198 @@
+package broker
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/golang/glog"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// searchResultsMax is the number of results returned in binding credentials,
+// the most the Dataverse search API returns at once
+const searchResultsMax = 1000
+
+// searchTypes are the types of objects the Dataverse search API finds
+var searchTypes = []string{"dataverse", "dataset", "file"}
+
+// savedSearch is the query of an instance of the search plan
+type savedSearch struct {
+	// Encoded query string of the search API, without paging
+	Query string `json:"query"`
+}
+
+// searchPlanID is the ID of the search plan of a dataverse service
+func searchPlanID(planID string) string {
+	return planID + "-search"
+}
+
+// isSearchPlan tells if planID is the search plan of the dataverse
+func isSearchPlan(dataverse *dataverseInstance, planID string) bool {
+	return dataverse.Description.Type != "dataset" && planID == searchPlanID(dataverse.PlanID)
+}
+
+// searchPlan is the catalog entry of the search plan of a dataverse
+func searchPlan(dataverse *dataverseInstance) osb.Plan {
+	stringOrList := func(description string, enum []string) map[string]interface{} {
+		item := map[string]interface{}{"type": "string"}
+		if enum != nil {
+			item["enum"] = enum
+		}
+		return map[string]interface{}{
+			"description": description,
+			"oneOf":       []interface{}{item, map[string]interface{}{"type": "array", "items": item}},
+		}
+	}
+
+	return osb.Plan{
+		Name:        "search",
+		ID:          searchPlanID(dataverse.PlanID),
+		Description: "The results of a search in " + dataverse.Description.Name,
+		Free:        truePtr(),
+		Schemas: &osb.Schemas{
+			ServiceInstance: &osb.ServiceInstanceSchema{
+				Create: &osb.InputParametersSchema{
+					Parameters: map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"credentials": map[string]interface{}{
+								"type":        "string",
+								"description": "API key of a Dataverse user, to include what only they can see",
+							},
+							"q": map[string]interface{}{
+								"type":        "string",
+								"description": "Search terms, * by default",
+							},
+							"type":    stringOrList("Types of objects to find, all by default", searchTypes),
+							"subtree": stringOrList("Aliases of the dataverses to search in, "+dataverse.Description.Identifier+" by default", nil),
+							"fq":      stringOrList("Filter queries, e.g. publicationDate:2020", nil),
+							"sort": map[string]interface{}{
+								"type":        "string",
+								"description": "Sort by name or date, by relevance by default",
+								"enum":        []string{"name", "date"},
+							},
+							"order": map[string]interface{}{
+								"type":        "string",
+								"description": "Sort order",
+								"enum":        []string{"asc", "desc"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// searchQuery builds the query of the search API from the provision
+// parameters of the search plan
+func searchQuery(alias string, params map[string]interface{}) (url.Values, error) {
+	query := url.Values{"q": {"*"}}
+
+	if q, ok := params["q"]; ok {
+		s, _ := q.(string)
+		if s == "" {
+			return nil, badRequest(`The "q" parameter must be a non-empty string`)
+		}
+		query.Set("q", s)
+	}
+
+	types, err := optionalStringsParam(params, "type")
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range types {
+		if !containsString(searchTypes, t) {
+			return nil, badRequest(fmt.Sprintf("Unknown type %q, types are dataverse, dataset and file", t))
+		}
+	}
+	query["type"] = types
+
+	subtrees, err := optionalStringsParam(params, "subtree")
+	if err != nil {
+		return nil, err
+	}
+	if len(subtrees) == 0 {
+		subtrees = []string{alias}
+	}
+	query["subtree"] = subtrees
+
+	fqs, err := optionalStringsParam(params, "fq")
+	if err != nil {
+		return nil, err
+	}
+	query["fq"] = fqs
+
+	if sort, ok := params["sort"]; ok {
+		if sort != "name" && sort != "date" {
+			return nil, badRequest(`The "sort" parameter must be "name" or "date"`)
+		}
+		query.Set("sort", sort.(string))
+	}
+	if order, ok := params["order"]; ok {
+		if order != "asc" && order != "desc" {
+			return nil, badRequest(`The "order" parameter must be "asc" or "desc"`)
+		}
+		query.Set("order", order.(string))
+	}
+
+	for k, v := range query {
+		if len(v) == 0 {
+			delete(query, k)
+		}
+	}
+	return query, nil
+}
+
+// runSearch returns up to perPage results of a saved search
+func runSearch(serverUrl string, search *savedSearch, token string, perPage int) (*DataverseResponse, error) {
+	results := &DataverseResponse{}
+	err := nativeAPI("GET", serverUrl+"/api/search?"+search.Query+"&per_page="+strconv.Itoa(perPage), token, nil, results)
+	if err != nil {
+		return nil, err
+	}
+	if results.Items == nil {
+		results.Items = make([]DataverseDescription, 0)
+	}
+	return results, nil
+}
+
+// createSearch validates the query of a search instance by running it
+func createSearch(instance *dataverseInstance) (*savedSearch, error) {
+	query, err := searchQuery(instance.Description.Identifier, instance.Params)
+	if err != nil {
+		return nil, err
+	}
+	search := &savedSearch{Query: query.Encode()}
+
+	token, _ := instance.Params["credentials"].(string)
+	results, err := runSearch(instance.ServerUrl, search, token, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	glog.Infof("search: %q finds %d results for instance %q", search.Query, results.Total_count, instance.ID)
+	return search, nil
+}
+
+// searchFiles lists the files of the first manifestDatasetsMax datasets in
+// the results of a search, each in a directory named after its dataset
+func searchFiles(instance *dataverseInstance, results *DataverseResponse, token string) fileListing {
+	datasets := make([]string, 0)
+	more := results.Total_count > len(results.Items)
+	for _, item := range results.Items {
+		if item.Type != "dataset" {
+			continue
+		}
+		if len(datasets) == manifestDatasetsMax {
+			more = true
+			break
+		}
+		datasets = append(datasets, item.Global_id)
+	}
+
+	files, unlisted := listDatasets(instance.ServerUrl, datasets, token)
+	return fileListing{Files: files, Incomplete: more || len(unlisted) > 0, UnlistedDatasets: unlisted}
+}
@@ -0,0 +1,189 @@
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// signingKeysCheckInterval is how often the signing keys file is checked for
+// changes
+const signingKeysCheckInterval = 5 * time.Second
+
+// defaultSignedURLTTL is how long signed links are valid when not configured
+const defaultSignedURLTTL = 15 * time.Minute
+
+// SigningKeys are the secrets signed download links are made with. Links are
+// signed with the current key and accepted with any key, so a new key can be
+// made current while links signed with the old one are still valid.
+type SigningKeys struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// URLSigner signs and verifies download links. The keys file is re-read as
+// soon as it changes.
+type URLSigner struct {
+	path string
+	ttl  time.Duration
+
+	sync.RWMutex
+	keys    *SigningKeys
+	modTime time.Time
+	checked time.Time
+}
+
+// NewURLSigner loads the signing keys from a JSON file
+func NewURLSigner(path string, ttl time.Duration) (*URLSigner, error) {
+	s := &URLSigner{path: path, ttl: ttl}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads the keys file. The current keys are kept if the file is
+// invalid.
+func (s *URLSigner) Reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	byteValue, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	keys := &SigningKeys{}
+	if err = json.Unmarshal(byteValue, keys); err != nil {
+		return err
+	}
+	if _, ok := keys.Keys[keys.Current]; !ok || keys.Current == "" {
+		return fmt.Errorf("current signing key %q is not in %s", keys.Current, s.path)
+	}
+	for id, key := range keys.Keys {
+		if len(key) < 32 {
+			return fmt.Errorf("signing key %q is shorter than 32 characters", id)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.keys = keys
+	s.modTime = info.ModTime()
+	s.checked = time.Now()
+
+	glog.Infof("loaded %d signing keys from %s, current %q", len(keys.Keys), s.path, keys.Current)
+	return nil
+}
+
+// current returns the keys, reloading the file first if it changed
+func (s *URLSigner) current() *SigningKeys {
+	s.RLock()
+	keys, checked, modTime := s.keys, s.checked, s.modTime
+	s.RUnlock()
+
+	if time.Since(checked) < signingKeysCheckInterval {
+		return keys
+	}
+
+	s.Lock()
+	s.checked = time.Now()
+	s.Unlock()
+
+	if info, err := os.Stat(s.path); err == nil && !info.ModTime().Equal(modTime) {
+		if err = s.Reload(); err != nil {
+			glog.Errorf("unable to reload signing keys from %s: %v", s.path, err)
+		}
+		s.RLock()
+		keys = s.keys
+		s.RUnlock()
+	}
+
+	return keys
+}
+
+func signature(key string, bindingID string, fileID int, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%d\n%d", bindingID, fileID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the query string of a link to a file of a binding, valid
+// until the signer's TTL from now
+func (s *URLSigner) Sign(bindingID string, fileID int) (string, time.Time) {
+	keys := s.current()
+	expires := time.Now().Add(s.ttl).Truncate(time.Second)
+
+	return fmt.Sprintf("expires=%d&kid=%s&signature=%s", expires.Unix(), keys.Current,
+		signature(keys.Keys[keys.Current], bindingID, fileID, expires.Unix())), expires
+}
+
+// Verify checks the signature and expiry of a link
+func (s *URLSigner) Verify(bindingID string, fileID int, expires int64, kid string, sig string) error {
+	key, ok := s.current().Keys[kid]
+	if !ok || !hmac.Equal([]byte(sig), []byte(signature(key, bindingID, fileID, expires))) {
+		return signedLinkError("invalid signature")
+	}
+	if time.Now().Unix() >= expires {
+		return signedLinkError("link expired")
+	}
+	return nil
+}
+
+func signedLinkError(description string) error {
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusForbidden,
+		Description: &description,
+	}
+}
+
+// signedFileURL is a signed link to a file on the proxy, and its expiry
+func (b *BusinessLogic) signedFileURL(binding *dataverseBinding, file ManifestFile) (string, time.Time) {
+	query, expires := b.signer.Sign(binding.ID, file.FileID)
+	return b.proxyURL + "/signed/" + binding.ID + "/" + strconv.Itoa(file.FileID) + "?" + query, expires
+}
+
+// proxySignedFile serves a file through a signed link. Deleting the binding
+// invalidates its links.
+func (b *BusinessLogic) proxySignedFile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+
+	fileID, err := strconv.Atoi(vars["file_id"])
+	if err != nil {
+		writeFetchError(w, signedLinkError("invalid signature"))
+		return
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		writeFetchError(w, signedLinkError("invalid signature"))
+		return
+	}
+
+	bindingID := vars[osb.VarKeyBindingID]
+	if err = b.signer.Verify(bindingID, fileID, expires, query.Get("kid"), query.Get("signature")); err != nil {
+		writeFetchError(w, err)
+		return
+	}
+
+	binding, token, ok := b.bindingAndToken(bindingID)
+	if !ok {
+		writeFetchError(w, signedLinkError("binding deleted"))
+		return
+	}
+
+	b.serveBindingFile(w, r, binding, token, fileID)
+}
@@ -2,6 +2,7 @@ package broker
 
 import (
 	"sync"
+	"time"
 )
 
 // BusinessLogic provides an implementation of the broker.BusinessLogic
@@ -13,8 +14,34 @@ type BusinessLogic struct {
 	sync.RWMutex
 	// Add fields here! These fields are provided purely as an example
 	instances map[string]*dataverseInstance
+	// bindings map binding_id to *dataverseBinding
+	bindings map[string]*dataverseBinding
 	// dataverse map dataverse_id to *dataverseInstances
 	dataverses map[string]*dataverseInstance
+	// Directory of the whitelist, for reloading it
+	catalogPath string
+	// Limits who may see and provision which dataverses, nil to allow all
+	policy *Policy
+	// Number of files listed in binding credentials and per manifest page
+	manifestPageSize int
+	// External URL of the data proxy, empty when bindings get the Dataverse
+	// token instead
+	proxyURL string
+	// Files served by the data proxy
+	cache *fileCache
+	// Signs download links when bindings get those instead of a token
+	signer *URLSigner
+	// External URL and region of the S3 gateway, empty when disabled
+	s3URL    string
+	s3Region string
+	// What happens to published deposits on deprovision
+	depositRetention string
+	// What happens to sandboxes that aren't empty on deprovision
+	sandboxRetention string
+	// Servers on which bindings get their own Dataverse account, nil for none
+	accounts *ManagedAccountsConfig
+	// Audit log of the operations, nil when disabled
+	auditor *Auditor
 }
 
 // dataverseInstance holds information about a dataverse service instance
@@ -26,6 +53,47 @@ type dataverseInstance struct {
 	ServerName  string                 `json:"server_name"`
 	ServerUrl   string                 `json:"server_url"`
 	Params      map[string]interface{} `json:"params"`
+	// Dataset created for the deposit plan
+	Deposit *depositDataset `json:"deposit,omitempty"`
+	// Dataverse created for the sandbox plan
+	Sandbox *sandboxDataverse `json:"sandbox,omitempty"`
+	// Role assignment created for the role-grant plan
+	Grant *roleGrant `json:"grant,omitempty"`
+	// Query of the search plan
+	Search *savedSearch `json:"search,omitempty"`
+	// Dataset found for the open-dataset service
+	Opened *openedDataset `json:"opened,omitempty"`
+	// Last asynchronous operation
+	Operation *instanceOperation `json:"operation,omitempty"`
+	// Set while Dataverse is changed for an update, without the lock
+	updating bool
+}
+
+// dataverseBinding holds information about a binding to a service instance
+type dataverseBinding struct {
+	ID          string                 `json:"id"`
+	InstanceID  string                 `json:"instance_id"`
+	ServiceID   string                 `json:"service_id"`
+	PlanID      string                 `json:"plan_id"`
+	Credentials map[string]interface{} `json:"credentials"`
+	Params      map[string]interface{} `json:"params"`
+	// Files of the instance when the binding was created
+	Files []ManifestFile `json:"files,omitempty"`
+	// Set while the files of a dataverse are listed, or when some of them
+	// couldn't be
+	FilesPending     bool     `json:"files_pending,omitempty"`
+	FilesIncomplete  bool     `json:"files_incomplete,omitempty"`
+	UnlistedDatasets []string `json:"unlisted_datasets,omitempty"`
+	// Credential for the data proxy, set when it is enabled. Bindings with
+	// signed links only use it to refresh them.
+	ProxyToken string `json:"proxy_token,omitempty"`
+	Signed     bool   `json:"signed,omitempty"`
+	// Keys of the S3 gateway, set when it is enabled
+	S3AccessKeyID string `json:"s3_access_key_id,omitempty"`
+	S3SecretKey   string `json:"s3_secret_key,omitempty"`
+	// Dataverse account of the binding, set when accounts are managed
+	Account   *managedAccount `json:"account,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
 }
 
 // Dataverse JSON Structs
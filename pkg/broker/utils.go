@@ -31,7 +31,7 @@ func DataverseMeta(base string, id float64) {
 	var status map[string]interface{}
 
 	// Executing GET request
-	resp, err := http.Get(base + search_uri)
+	resp, err := dataverseGet(base + search_uri)
 
 	if err != nil {
 		// Exit on error
@@ -77,7 +77,7 @@ func DataverseMetadataIds(base string) []float64 {
 	var metadata map[string]interface{}
 
 	// Make a GET request
-	resp, err := http.Get(base + search_uri)
+	resp, err := dataverseGet(base + search_uri)
 
 	if err != nil {
 		// Exit on error
@@ -198,6 +198,14 @@ func DataverseToService(dataverses map[string]*dataverseInstance) ([]osb.Service
 			},
 		}
 
+		if dataverse.Description.Type == "dataset" {
+			pinVersion(&services[i].Plans[0])
+		}
+
+		if dataverse.Description.Type != "dataset" {
+			services[i].Plans = append(services[i].Plans, depositPlan(dataverse), sandboxPlan(dataverse), roleGrantPlan(dataverse), searchPlan(dataverse))
+		}
+
 		i += 1
 	}
 
@@ -307,7 +315,7 @@ func SearchForDataverses(base *string, max_results_opt ...int) ([]*DataverseDesc
 			// Don't go over max_results
 			per_page = max_results - start
 		}
-		resp, err := http.Get(*base + search_uri + options + strconv.Itoa(start) + "&per_page=" + strconv.Itoa(per_page))
+		resp, err := dataverseGet(*base + search_uri + options + strconv.Itoa(start) + "&per_page=" + strconv.Itoa(per_page))
 
 		if err != nil {
 			return nil, err
@@ -370,8 +378,12 @@ func SearchForDataverses(base *string, max_results_opt ...int) ([]*DataverseDesc
 
 func PingDataverseToken(serverUrl string, token string) (bool, error) {
 	// Ping the url, return bool for success or failure, and error code on fail
-	resp, err := http.Get(serverUrl + "/api/dataverses/:root?key=" + token)
+	resp, err := dataverseGet(serverUrl + "/api/dataverses/:root?key=" + token)
 
+	if _, unavailable := osb.IsHTTPError(err); unavailable {
+		// Server is throttled or its circuit breaker is open
+		return false, err
+	}
 	if err != nil {
 		return false, osb.HTTPStatusCodeError{
 			StatusCode: http.StatusNotFound,
@@ -405,9 +417,13 @@ func PingDataverseToken(serverUrl string, token string) (bool, error) {
 }
 
 func PingDataverse(url string) (bool, error) {
-	resp, err := http.Get(url)
+	resp, err := dataverseGet(url)
 
-	if err != nil || resp.StatusCode == 404 {
+	if _, unavailable := osb.IsHTTPError(err); unavailable {
+		// Server is throttled or its circuit breaker is open
+		return false, err
+	}
+	if err != nil {
 		return false, osb.HTTPStatusCodeError{
 			StatusCode: http.StatusNotFound,
 		}
@@ -416,6 +432,12 @@ func PingDataverse(url string) (bool, error) {
 	// Must close response when finished
 	defer resp.Body.Close()
 
+	if resp.StatusCode == 404 {
+		return false, osb.HTTPStatusCodeError{
+			StatusCode: http.StatusNotFound,
+		}
+	}
+
 	// Reaching here means successful ping
 	return true, nil
 }
@@ -426,5 +448,13 @@ func truePtr() *bool {
 }
 
 func (i *dataverseInstance) Match(other *dataverseInstance) bool {
-	return reflect.DeepEqual(i, other)
+	// Compare what was asked for, not what provisioning created
+	a, o := *i, *other
+	a.Deposit, o.Deposit = nil, nil
+	a.Sandbox, o.Sandbox = nil, nil
+	a.Grant, o.Grant = nil, nil
+	a.Search, o.Search = nil, nil
+	a.Opened, o.Opened = nil, nil
+	a.Operation, o.Operation = nil, nil
+	return reflect.DeepEqual(&a, &o)
 }
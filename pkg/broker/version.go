@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// apiVersion is an X-Broker-API-Version header value, major.minor
+type apiVersion struct {
+	major int
+	minor int
+}
+
+// Range of OSB API versions the broker supports, and the versions that
+// introduced the optional features it gates
+var (
+	minAPIVersion = apiVersion{2, 11}
+	maxAPIVersion = apiVersion{2, 14}
+
+	// Plan schemas in the catalog
+	schemasAPIVersion = apiVersion{2, 13}
+	// Fetching instances and bindings
+	fetchAPIVersion = apiVersion{2, 14}
+)
+
+func parseAPIVersion(version string) (apiVersion, error) {
+	parts := strings.Split(strings.TrimSpace(version), ".")
+	if len(parts) != 2 {
+		return apiVersion{}, fmt.Errorf("invalid version %q", version)
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil || major < 0 {
+		return apiVersion{}, fmt.Errorf("invalid major version %q", version)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil || minor < 0 {
+		return apiVersion{}, fmt.Errorf("invalid minor version %q", version)
+	}
+
+	return apiVersion{major, minor}, nil
+}
+
+func (v apiVersion) atLeast(other apiVersion) bool {
+	return v.major > other.major || (v.major == other.major && v.minor >= other.minor)
+}
+
+func (v apiVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// requestAPIVersion returns the version negotiated for a request, which has
+// already passed ValidateBrokerAPIVersion. Requests made without an http
+// request (e.g. from tests) get the latest version.
+func requestAPIVersion(c *broker.RequestContext) apiVersion {
+	if c == nil || c.Request == nil {
+		return maxAPIVersion
+	}
+	version, err := parseAPIVersion(c.Request.Header.Get(osb.APIVersionHeader))
+	if err != nil {
+		return maxAPIVersion
+	}
+	return version
+}
+
+// versionError is the 412 returned for unsupported versions
+func versionError(description string) error {
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusPreconditionFailed,
+		Description: &description,
+	}
+}
+
+// validateAPIVersion checks that a version is within the supported range
+func validateAPIVersion(version string) error {
+	if version == "" {
+		return versionError("Missing " + osb.APIVersionHeader + " header")
+	}
+
+	v, err := parseAPIVersion(version)
+	if err != nil {
+		return versionError(fmt.Sprintf("Unsupported %s %q", osb.APIVersionHeader, version))
+	}
+
+	if !v.atLeast(minAPIVersion) || !maxAPIVersion.atLeast(v) {
+		return versionError(fmt.Sprintf("Unsupported %s %s, supported versions are %s to %s", osb.APIVersionHeader, v, minAPIVersion, maxAPIVersion))
+	}
+
+	return nil
+}
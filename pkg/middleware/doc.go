@@ -0,0 +1,6 @@
+// Package middleware holds the gorilla-mux middleware that authenticates and
+// authorizes callers of the broker. Authenticating middleware records the
+// caller in the request context, where it can be read back with
+// UserFromRequest by later middleware and by the broker's business logic.
+
+package middleware // import "github.com/dataverse-broker/dataverse-broker/pkg/middleware"
@@ -0,0 +1,236 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Environment variables read by NewCredentialStore when no file is given
+const (
+	UsernameEnvVar = "DATAVERSE_BROKER_USERNAME"
+	PasswordEnvVar = "DATAVERSE_BROKER_PASSWORD"
+	// Comma separated list of bearer tokens
+	TokensEnvVar = "DATAVERSE_BROKER_TOKENS"
+)
+
+// credentialCheckInterval is how often the credentials file is checked for
+// changes
+const credentialCheckInterval = 5 * time.Second
+
+// BasicCredential is a username and password accepted with HTTP basic auth
+type BasicCredential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// BearerCredential is a static bearer token; Name identifies the caller
+type BearerCredential struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+}
+
+// Credentials holds every credential the broker accepts
+type Credentials struct {
+	Users  []BasicCredential  `json:"users"`
+	Tokens []BearerCredential `json:"tokens"`
+}
+
+// CredentialStore holds the current Credentials. When loaded from a file the
+// file is re-read as soon as it changes, so credentials can be rotated
+// without a restart.
+type CredentialStore struct {
+	path string
+
+	sync.RWMutex
+	credentials *Credentials
+	modTime     time.Time
+	checked     time.Time
+}
+
+// NewCredentialStore loads credentials from a JSON file, or from the
+// environment when path is empty
+func NewCredentialStore(path string) (*CredentialStore, error) {
+	store := &CredentialStore{path: path}
+
+	if path == "" {
+		store.credentials = credentialsFromEnv()
+		return store, nil
+	}
+
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func credentialsFromEnv() *Credentials {
+	credentials := &Credentials{}
+
+	if username := os.Getenv(UsernameEnvVar); username != "" && os.Getenv(PasswordEnvVar) != "" {
+		credentials.Users = append(credentials.Users, BasicCredential{
+			Username: username,
+			Password: os.Getenv(PasswordEnvVar),
+		})
+	}
+
+	for i, token := range strings.Split(os.Getenv(TokensEnvVar), ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			credentials.Tokens = append(credentials.Tokens, BearerCredential{
+				Name:  fmt.Sprintf("token-%d", i),
+				Token: token,
+			})
+		}
+	}
+
+	return credentials
+}
+
+// Reload re-reads the credentials file. The current credentials are kept if
+// the file can't be read.
+func (s *CredentialStore) Reload() error {
+	if s.path == "" {
+		s.Lock()
+		s.credentials = credentialsFromEnv()
+		s.Unlock()
+		return nil
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	byteValue, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	credentials := &Credentials{}
+	if err = json.Unmarshal(byteValue, credentials); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.credentials = credentials
+	s.modTime = info.ModTime()
+	s.checked = time.Now()
+
+	glog.Infof("loaded %d users and %d tokens from %s", len(credentials.Users), len(credentials.Tokens), s.path)
+	return nil
+}
+
+// current returns the credentials, reloading the file first if it changed
+func (s *CredentialStore) current() *Credentials {
+	s.RLock()
+	credentials, checked, modTime := s.credentials, s.checked, s.modTime
+	s.RUnlock()
+
+	if s.path == "" || time.Since(checked) < credentialCheckInterval {
+		return credentials
+	}
+
+	s.Lock()
+	s.checked = time.Now()
+	s.Unlock()
+
+	if info, err := os.Stat(s.path); err == nil && !info.ModTime().Equal(modTime) {
+		if err = s.Reload(); err != nil {
+			glog.Errorf("unable to reload credentials from %s: %v", s.path, err)
+		}
+		s.RLock()
+		credentials = s.credentials
+		s.RUnlock()
+	}
+
+	return credentials
+}
+
+// StaticAuthMiddleware - Middleware authenticating callers against the
+// credentials in a CredentialStore with HTTP basic auth, static bearer tokens,
+// or both.
+type StaticAuthMiddleware struct {
+	Store       *CredentialStore
+	AllowBasic  bool
+	AllowBearer bool
+}
+
+// Middleware - function that conforms to gorilla-mux middleware.
+func (sa StaticAuthMiddleware) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RequestURI == "/healthz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		credentials := sa.Store.current()
+
+		if username, password, ok := r.BasicAuth(); ok && sa.AllowBasic {
+			if user, ok := credentials.checkBasic(username, password); ok {
+				next.ServeHTTP(w, WithUser(r, user))
+				return
+			}
+			glog.Infof("invalid basic auth credentials for %q", username)
+		} else if token, ok := bearerToken(r); ok && sa.AllowBearer {
+			if user, ok := credentials.checkBearer(token); ok {
+				next.ServeHTTP(w, WithUser(r, user))
+				return
+			}
+			glog.Infof("invalid bearer token")
+		} else {
+			glog.Infof("unable to find credentials for request to %v", r.RequestURI)
+		}
+
+		if sa.AllowBasic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dataverse-broker"`)
+		}
+		writeOSBStatusCodeErrorResponse(w, http.StatusUnauthorized, osbError{
+			Description: "user was not authenticated",
+		})
+	})
+}
+
+// checkBasic compares against every user so the time taken doesn't reveal
+// which user matched, or how much of a credential was right
+func (c *Credentials) checkBasic(username string, password string) (*UserInfo, bool) {
+	var user *UserInfo
+	for _, credential := range c.Users {
+		if credential.Password == "" {
+			continue
+		}
+		match := secureCompare(username, credential.Username) & secureCompare(password, credential.Password)
+		if match == 1 && user == nil {
+			user = &UserInfo{Username: credential.Username}
+		}
+	}
+	return user, user != nil
+}
+
+func (c *Credentials) checkBearer(token string) (*UserInfo, bool) {
+	var user *UserInfo
+	for _, credential := range c.Tokens {
+		if credential.Token == "" {
+			continue
+		}
+		if secureCompare(token, credential.Token) == 1 && user == nil {
+			user = &UserInfo{Username: credential.Name}
+		}
+	}
+	return user, user != nil
+}
+
+// secureCompare compares digests in constant time, which also hides the
+// length of the expected value. Returns 1 on a match.
+func secureCompare(given string, expected string) int {
+	givenSum := sha256.Sum256([]byte(given))
+	expectedSum := sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(givenSum[:], expectedSum[:])
+}
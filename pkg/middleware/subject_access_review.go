@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	authorizationapi "k8s.io/api/authorization/v1"
+	v1 "k8s.io/client-go/kubernetes/typed/authorization/v1"
+)
+
+// SubjectAccessReviewMiddleware - Middleware that authorizes the user found by
+// an authenticating middleware with a k8s SubjectAccessReview for a fixed verb
+// and resource, e.g. "create servicebrokers/proxy". It must be used after the
+// TokenReviewMiddleware.
+type SubjectAccessReviewMiddleware struct {
+	SubjectAccessReview v1.SubjectAccessReviewInterface
+	// Attributes checked for every request
+	ResourceAttributes authorizationapi.ResourceAttributes
+	// How long a review result is reused for the same user
+	CacheTTL time.Duration
+
+	sync.Mutex
+	cache map[string]accessReviewResult
+}
+
+type accessReviewResult struct {
+	allowed bool
+	expires time.Time
+}
+
+// maxAccessReviewCacheSize bounds the cache before expired entries are pruned
+const maxAccessReviewCacheSize = 1024
+
+// ParseResourceAttributes turns "resource/subresource" into ResourceAttributes
+func ParseResourceAttributes(verb string, group string, resource string) authorizationapi.ResourceAttributes {
+	attributes := authorizationapi.ResourceAttributes{
+		Verb:  verb,
+		Group: group,
+	}
+	parts := strings.SplitN(resource, "/", 2)
+	attributes.Resource = parts[0]
+	if len(parts) == 2 {
+		attributes.Subresource = parts[1]
+	}
+	return attributes
+}
+
+// Middleware - function that conforms to gorilla-mux middleware.
+func (sar *SubjectAccessReviewMiddleware) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RequestURI == "/healthz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, ok := UserFromRequest(r)
+		if !ok {
+			writeOSBStatusCodeErrorResponse(w, http.StatusForbidden, osbError{
+				Description: "unable to find authenticated user",
+			})
+			glog.Infof("no authenticated user to authorize for %v", r.RequestURI)
+			return
+		}
+
+		allowed, err := sar.review(user)
+		if err != nil {
+			writeOSBStatusCodeErrorResponse(w, http.StatusForbidden, osbError{
+				Description: "unable to authorize user",
+			})
+			glog.Infof("unable to authorize user %q- %v\n", user.Username, err)
+			return
+		}
+		if !allowed {
+			writeOSBStatusCodeErrorResponse(w, http.StatusForbidden, osbError{
+				Description: "user is not authorized to use the broker",
+			})
+			glog.Infof("user %q was not authorized", user.Username)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// review returns the cached result for the user or asks the API server
+func (sar *SubjectAccessReviewMiddleware) review(user *UserInfo) (bool, error) {
+	key := accessReviewKey(user)
+
+	sar.Lock()
+	cached, ok := sar.cache[key]
+	sar.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.allowed, nil
+	}
+
+	attributes := sar.ResourceAttributes
+	extra := make(map[string]authorizationapi.ExtraValue, len(user.Extra))
+	for k, v := range user.Extra {
+		extra[k] = authorizationapi.ExtraValue(v)
+	}
+	result, err := sar.SubjectAccessReview.Create(&authorizationapi.SubjectAccessReview{
+		Spec: authorizationapi.SubjectAccessReviewSpec{
+			ResourceAttributes: &attributes,
+			User:               user.Username,
+			UID:                user.UID,
+			Groups:             user.Groups,
+			Extra:              extra,
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	allowed := result.Status.Allowed && !result.Status.Denied
+	if sar.CacheTTL > 0 {
+		sar.store(key, allowed)
+	}
+	return allowed, nil
+}
+
+func (sar *SubjectAccessReviewMiddleware) store(key string, allowed bool) {
+	sar.Lock()
+	defer sar.Unlock()
+
+	now := time.Now()
+	if sar.cache == nil {
+		sar.cache = make(map[string]accessReviewResult)
+	}
+	if len(sar.cache) >= maxAccessReviewCacheSize {
+		for k, v := range sar.cache {
+			if now.After(v.expires) {
+				delete(sar.cache, k)
+			}
+		}
+	}
+	sar.cache[key] = accessReviewResult{
+		allowed: allowed,
+		expires: now.Add(sar.CacheTTL),
+	}
+}
+
+// accessReviewKey identifies a user and the groups it was reviewed with
+func accessReviewKey(user *UserInfo) string {
+	groups := append([]string{}, user.Groups...)
+	sort.Strings(groups)
+	return user.Username + "\x00" + user.UID + "\x00" + strings.Join(groups, "\x00")
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+
+	authenticationapi "k8s.io/api/authentication/v1"
+	v1 "k8s.io/client-go/kubernetes/typed/authentication/v1"
+)
+
+// TokenReviewMiddleware - Middleware to validate a bearer token using k8s
+// token review. Unlike the osb-broker-k8s-lib middleware it is based on, the
+// reviewed user is kept in the request context.
+type TokenReviewMiddleware struct {
+	TokenReview v1.TokenReviewInterface
+}
+
+// Middleware - function that conforms to gorilla-mux middleware.
+func (tr TokenReviewMiddleware) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RequestURI == "/healthz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		glog.Infof("Request to %v; checking token for authentication", r.RequestURI)
+		token, ok := bearerToken(r)
+		if !ok {
+			writeOSBStatusCodeErrorResponse(w, http.StatusUnauthorized, osbError{
+				Description: "unable to find authentication token",
+			})
+			glog.Infof("unable to find the authentication token")
+			return
+		}
+		t, err := tr.TokenReview.Create(&authenticationapi.TokenReview{Spec: authenticationapi.TokenReviewSpec{Token: token}})
+		if err != nil {
+			writeOSBStatusCodeErrorResponse(w, http.StatusUnauthorized, osbError{
+				Description: "unable to authenticate token",
+			})
+			glog.Infof("unable to authenticate token- %v\n", err)
+			return
+		}
+		if !t.Status.Authenticated {
+			writeOSBStatusCodeErrorResponse(w, http.StatusUnauthorized, osbError{
+				Description: "user was not authenticated",
+			})
+			glog.Infof("user was not authenticated")
+			return
+		}
+
+		user := &UserInfo{
+			Username: t.Status.User.Username,
+			UID:      t.Status.User.UID,
+			Groups:   t.Status.User.Groups,
+			Extra:    make(map[string][]string, len(t.Status.User.Extra)),
+		}
+		for k, v := range t.Status.User.Extra {
+			user.Extra[k] = []string(v)
+		}
+		glog.V(4).Infof("authenticated user %q", user.Username)
+
+		next.ServeHTTP(w, WithUser(r, user))
+	})
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	auth := strings.TrimSpace(r.Header.Get("Authorization"))
+	parts := strings.SplitN(auth, " ", 2)
+	if len(parts) < 2 || strings.ToLower(parts[0]) != "bearer" {
+		return "", false
+	}
+	token := strings.TrimSpace(parts[1])
+	return token, token != ""
+}
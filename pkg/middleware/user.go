@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// UserInfo describes the authenticated caller of a request
+type UserInfo struct {
+	Username string
+	UID      string
+	Groups   []string
+	Extra    map[string][]string
+}
+
+type userKey struct{}
+
+// WithUser returns a copy of the request carrying the authenticated user
+func WithUser(r *http.Request, user *UserInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+}
+
+// UserFromRequest returns the user recorded by an authenticating middleware
+func UserFromRequest(r *http.Request) (*UserInfo, bool) {
+	if r == nil {
+		return nil, false
+	}
+	user, ok := r.Context().Value(userKey{}).(*UserInfo)
+	return user, ok
+}
+
+type osbError struct {
+	Description string `json:"description,omitempty"`
+}
+
+// writeOSBStatusCodeErrorResponse - This is taken from osb-broker-lib.
+func writeOSBStatusCodeErrorResponse(w http.ResponseWriter, statusCode int, osbErr osbError) {
+	data, err := json.Marshal(osbErr)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	w.WriteHeader(statusCode)
+	w.Write(data)
+}
@@ -0,0 +1,252 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// Check every binding gets its own account, revoked and disabled on Unbind,
+// or when its instance is deleted, and kept when deprovisioning is refused
+func TestManagedAccounts(t *testing.T) {
+
+	var mutex sync.Mutex
+	events := make([]string, 0)
+	record := func(event string) {
+		mutex.Lock()
+		events = append(events, event)
+		mutex.Unlock()
+	}
+	ok := func(w http.ResponseWriter, data interface{}) {
+		writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": data})
+	}
+	// Publishing the dataset goes on until released
+	release := make(chan struct{})
+
+	server := newFakeDataverse(map[string]http.HandlerFunc{
+		"/api/builtin-users": func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("key") != "builtin-key" || r.URL.Query().Get("password") == "" {
+				writeDataverseJSON(w, http.StatusUnauthorized, map[string]interface{}{"status": "ERROR", "message": "Bad key"})
+				return
+			}
+			user := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&user)
+			record("create " + user["userName"].(string))
+			ok(w, map[string]interface{}{"apiToken": "token-" + user["userName"].(string)})
+		},
+		"/api/dataverses/test/assignments": func(w http.ResponseWriter, r *http.Request) {
+			assignment := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&assignment)
+			if r.Header.Get("X-Dataverse-key") != "admin-token" || assignment["assignee"] == "@binding-refused" {
+				writeDataverseJSON(w, http.StatusForbidden, map[string]interface{}{"status": "ERROR", "message": "Not allowed"})
+				return
+			}
+			record("assign " + assignment["role"].(string) + " to " + assignment["assignee"].(string))
+			ok(w, map[string]interface{}{"id": 99})
+		},
+		"/api/dataverses/test/assignments/": func(w http.ResponseWriter, r *http.Request) {
+			record(r.Method + " " + r.URL.Path)
+			ok(w, map[string]interface{}{})
+		},
+		"/api/users/token": func(w http.ResponseWriter, r *http.Request) {
+			record("delete " + r.Header.Get("X-Dataverse-key"))
+			ok(w, map[string]interface{}{})
+		},
+		"/api/admin/authenticatedUsers/": func(w http.ResponseWriter, r *http.Request) {
+			record(r.Method + " " + r.URL.Path)
+			ok(w, map[string]interface{}{})
+		},
+		"/api/datasets/": func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/assignments"):
+				assignment := map[string]interface{}{}
+				json.NewDecoder(r.Body).Decode(&assignment)
+				record("assign " + assignment["role"].(string) + " to " + assignment["assignee"].(string) + " on the dataset")
+				ok(w, map[string]interface{}{"id": 98})
+			case strings.Contains(r.URL.Path, "/assignments/"):
+				record(r.Method + " " + r.URL.Path)
+				ok(w, map[string]interface{}{})
+			case strings.HasSuffix(r.URL.Path, "/actions/:publish"):
+				<-release
+				ok(w, map[string]interface{}{})
+			case strings.HasSuffix(r.URL.Path, "/versions/:latest"):
+				ok(w, map[string]interface{}{"versionState": "RELEASED", "versionNumber": 1, "versionMinorNumber": 0})
+			default:
+				ok(w, []interface{}{})
+			}
+		},
+	})
+	defer server.Close()
+
+	configPath := writeTestFile(t, `{"servers": {"`+server.URL+`": {"admin_token": "admin-token", "builtin_users_key": "builtin-key", "role": "fileDownloader"}}}`)
+	defer os.Remove(configPath)
+
+	dir := newTestCatalog(t, server.URL, map[string]interface{}{
+		"id":         "test-dataset",
+		"service_id": testDatasetServiceID,
+		"plan_id":    testDatasetPlanID,
+		"description": map[string]interface{}{
+			"name":      "Test Dataset",
+			"type":      "dataset",
+			"url":       server.URL + "/dataverse/test",
+			"global_id": testDatasetPID,
+		},
+		"server_name": "test",
+		"server_url":  server.URL,
+	})
+	defer os.RemoveAll(dir)
+	businessLogic, err := logic.NewBusinessLogic(logic.Options{
+		CatalogPath:     dir,
+		ManagedAccounts: configPath,
+	})
+	if err != nil {
+		t.Fatalf("Error on BusinessLogic creation: %#+v\n", err)
+	}
+
+	serviceIDs := map[string]string{testServiceID: testPlanID, testDatasetServiceID: testDatasetPlanID}
+	service := testServiceID
+	provision := func(instanceID string) {
+		_, err := businessLogic.Provision(&osb.ProvisionRequest{
+			InstanceID: instanceID,
+			ServiceID:  service,
+			PlanID:     serviceIDs[service],
+			Parameters: map[string]interface{}{"credentials": "provisioner-token"},
+		}, &broker.RequestContext{})
+		if err != nil {
+			t.Fatalf("Error on Provision: %#+v\n", err)
+		}
+	}
+	bind := func(instanceID string, bindingID string) (*broker.BindResponse, error) {
+		return businessLogic.Bind(&osb.BindRequest{
+			BindingID:  bindingID,
+			InstanceID: instanceID,
+			ServiceID:  service,
+			PlanID:     serviceIDs[service],
+		}, &broker.RequestContext{})
+	}
+	deprovision := func(instanceID string) error {
+		_, err := businessLogic.Deprovision(&osb.DeprovisionRequest{
+			InstanceID: instanceID,
+			ServiceID:  service,
+			PlanID:     serviceIDs[service],
+		}, &broker.RequestContext{})
+		return err
+	}
+
+	provision("accounts1")
+	response, err := bind("accounts1", "app1")
+	if err != nil {
+		t.Fatalf("Error on Bind: %#+v\n", err)
+	}
+	if response.Credentials["credentials"] != "token-binding-app1" || response.Credentials["username"] != "binding-app1" {
+		t.Errorf("Error in credentials: expected the binding's own account, got %#+v\n", response.Credentials)
+	}
+	if response, err = bind("accounts1", "app1"); err != nil || !response.Exists || response.Credentials["credentials"] != "token-binding-app1" {
+		t.Errorf("Error on Bind with binding that already exists: %#+v %#+v\n", response, err)
+	}
+
+	if _, err = bind("accounts1", "refused"); err == nil {
+		t.Errorf("Error on Bind: expected error when the role can't be assigned\n")
+	}
+
+	_, err = businessLogic.Unbind(&osb.UnbindRequest{
+		BindingID:  "app1",
+		InstanceID: "accounts1",
+		ServiceID:  testServiceID,
+		PlanID:     testPlanID,
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Errorf("Error on Unbind: %#+v\n", err)
+	}
+
+	// Deprovisioning, or force deleting, an instance with bindings left
+	// removes their accounts too
+	if _, err = bind("accounts1", "app2"); err != nil {
+		t.Fatalf("Error on Bind: %#+v\n", err)
+	}
+	if err = deprovision("accounts1"); err != nil {
+		t.Errorf("Error on Deprovision: %#+v\n", err)
+	}
+
+	provision("accounts2")
+	if _, err = bind("accounts2", "app3"); err != nil {
+		t.Fatalf("Error on Bind: %#+v\n", err)
+	}
+	recorder := httptest.NewRecorder()
+	businessLogic.AdminHandler().ServeHTTP(recorder, httptest.NewRequest("DELETE", "/admin/instances/accounts2", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Error on force delete: %d %s\n", recorder.Code, recorder.Body.String())
+	}
+	if _, err = businessLogic.GetBinding("accounts2", "app3"); !isStatusError(err, http.StatusNotFound) {
+		t.Errorf("Error on GetBinding after force delete: expected 404, got %#+v\n", err)
+	}
+
+	// Deprovisioning is refused while the dataset is published, the
+	// accounts are only removed once it goes ahead
+	service = testDatasetServiceID
+	provision("accounts3")
+	if _, err = bind("accounts3", "app4"); err != nil {
+		t.Fatalf("Error on Bind: %#+v\n", err)
+	}
+	_, err = businessLogic.Update(&osb.UpdateInstanceRequest{
+		InstanceID:        "accounts3",
+		ServiceID:         service,
+		AcceptsIncomplete: true,
+		Parameters:        map[string]interface{}{"publish": "major"},
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Update: %#+v\n", err)
+	}
+	if err = deprovision("accounts3"); !isStatusError(err, http.StatusUnprocessableEntity) {
+		t.Errorf("Error on Deprovision while publishing: expected 422, got %#+v\n", err)
+	}
+	if _, err = businessLogic.GetBinding("accounts3", "app4"); err != nil {
+		t.Errorf("Error on GetBinding after refused Deprovision: %#+v\n", err)
+	}
+	record("published")
+	close(release)
+	if last, err := waitForOperation(t, businessLogic, "accounts3"); err != nil || last.State != osb.StateSucceeded {
+		t.Fatalf("Error on LastOperation: %#+v %#+v\n", last, err)
+	}
+	if err = deprovision("accounts3"); err != nil {
+		t.Errorf("Error on Deprovision: %#+v\n", err)
+	}
+
+	expected := []string{
+		"create binding-app1",
+		"assign fileDownloader to @binding-app1",
+		"create binding-refused",
+		"delete token-binding-refused",
+		"POST /api/admin/authenticatedUsers/binding-refused/deactivate",
+		"DELETE /api/dataverses/test/assignments/99",
+		"delete token-binding-app1",
+		"POST /api/admin/authenticatedUsers/binding-app1/deactivate",
+		"create binding-app2",
+		"assign fileDownloader to @binding-app2",
+		"DELETE /api/dataverses/test/assignments/99",
+		"delete token-binding-app2",
+		"POST /api/admin/authenticatedUsers/binding-app2/deactivate",
+		"create binding-app3",
+		"assign fileDownloader to @binding-app3",
+		"DELETE /api/dataverses/test/assignments/99",
+		"delete token-binding-app3",
+		"POST /api/admin/authenticatedUsers/binding-app3/deactivate",
+		"create binding-app4",
+		"assign fileDownloader to @binding-app4 on the dataset",
+		"published",
+		"DELETE /api/datasets/:persistentId/assignments/98",
+		"delete token-binding-app4",
+		"POST /api/admin/authenticatedUsers/binding-app4/deactivate",
+	}
+	if strings.Join(events, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Error in Dataverse calls: expected\n%s\ngot\n%s\n", strings.Join(expected, "\n"), strings.Join(events, "\n"))
+	}
+}
@@ -0,0 +1,115 @@
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// Check listing, inspecting and force deleting through the admin API
+func TestAdminAPI(t *testing.T) {
+
+	server := newFakeDataverse(nil)
+	defer server.Close()
+
+	dir := newTestCatalog(t, server.URL)
+	defer os.RemoveAll(dir)
+	businessLogic, err := logic.NewBusinessLogic(logic.Options{CatalogPath: dir})
+	if err != nil {
+		t.Fatalf("Error on BusinessLogic creation: %#+v\n", err)
+	}
+
+	for _, id := range []string{"admin1", "admin2"} {
+		_, err := businessLogic.Provision(&osb.ProvisionRequest{
+			InstanceID: id,
+			ServiceID:  testServiceID,
+			PlanID:     testPlanID,
+			Parameters: map[string]interface{}{"credentials": "secret-token"},
+		}, &broker.RequestContext{})
+		if err != nil {
+			t.Fatalf("Error on Provision: %#+v\n", err)
+		}
+	}
+	businessLogic.Bind(&osb.BindRequest{
+		BindingID:  "admin-binding1",
+		InstanceID: "admin1",
+		ServiceID:  testServiceID,
+		PlanID:     testPlanID,
+	}, &broker.RequestContext{})
+
+	admin := businessLogic.AdminHandler()
+	call := func(method string, path string, into interface{}) int {
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		if into != nil {
+			json.Unmarshal(recorder.Body.Bytes(), into)
+		}
+		return recorder.Code
+	}
+
+	instances := []logic.AdminInstance{}
+	if code := call("GET", "/admin/instances?service_id="+testServiceID, &instances); code != http.StatusOK || len(instances) != 2 {
+		t.Errorf("Error listing instances: %d, %d instances\n", code, len(instances))
+	}
+	if code := call("GET", "/admin/instances?plan_id=other", &instances); code != http.StatusOK || len(instances) != 0 {
+		t.Errorf("Error filtering instances: %d, %d instances\n", code, len(instances))
+	}
+
+	instance := logic.AdminInstance{}
+	if code := call("GET", "/admin/instances/admin1", &instance); code != http.StatusOK || len(instance.Bindings) != 1 {
+		t.Errorf("Error getting instance: %d %#+v\n", code, instance)
+	}
+	if instance.Params["credentials"] == "secret-token" {
+		t.Errorf("Error getting instance: credentials not redacted\n")
+	}
+
+	if code := call("DELETE", "/admin/instances/admin1", nil); code != http.StatusOK {
+		t.Errorf("Error deleting instance: %d\n", code)
+	}
+	if code := call("GET", "/admin/instances/admin1", nil); code != http.StatusNotFound {
+		t.Errorf("Error getting deleted instance: expected 404, got %d\n", code)
+	}
+	bindings := []logic.AdminBinding{}
+	if code := call("GET", "/admin/bindings", &bindings); code != http.StatusOK || len(bindings) != 0 {
+		t.Errorf("Error listing bindings of deleted instance: %d, %d bindings\n", code, len(bindings))
+	}
+
+	reload := map[string]int{}
+	if code := call("POST", "/admin/catalog/reload", &reload); code != http.StatusOK || reload["dataverses"] != 1 {
+		t.Errorf("Error reloading catalog: %d %#+v\n", code, reload)
+	}
+
+	// A broken whitelist leaves the catalog as it is
+	whitelist := filepath.Join(dir, "dataverses.json")
+	valid, err := ioutil.ReadFile(whitelist)
+	if err != nil {
+		t.Fatalf("Error reading whitelist: %#+v\n", err)
+	}
+	for _, broken := range []string{`[{"service_id": "typo",}]`, `[]`, `[{"service_id": "no-plan"}]`} {
+		ioutil.WriteFile(whitelist, []byte(broken), 0644)
+		if code := call("POST", "/admin/catalog/reload", nil); code != http.StatusInternalServerError {
+			t.Errorf("Error reloading broken catalog %s: expected 500, got %d\n", broken, code)
+		}
+	}
+	ioutil.WriteFile(whitelist, valid, 0644)
+	catalog, err := businessLogic.GetCatalog(&broker.RequestContext{})
+	if err != nil || len(catalog.Services) == 0 || catalog.Services[0].ID != testServiceID {
+		t.Errorf("Error in catalog after broken reloads: %#+v %#+v\n", catalog, err)
+	}
+
+	health := []logic.AdminServerHealth{}
+	if code := call("GET", "/admin/health?check=true", &health); code != http.StatusOK || len(health) != 1 {
+		t.Fatalf("Error getting health: %d %#+v\n", code, health)
+	}
+	if health[0].CircuitState != "closed" || health[0].Reachable == nil || !*health[0].Reachable {
+		t.Errorf("Error getting health: %#+v\n", health[0])
+	}
+}
@@ -0,0 +1,198 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	"github.com/dataverse-broker/dataverse-broker/pkg/middleware"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// Check that every operation is audited and credentials never are
+func TestAuditLog(t *testing.T) {
+
+	server := newFakeDataverse(nil)
+	defer server.Close()
+
+	businessLogic, cleanup := newTestBroker(t, server.URL, logic.Options{})
+	defer cleanup()
+
+	var log bytes.Buffer
+	audited := &logic.AuditedBroker{
+		Interface: businessLogic,
+		Auditor:   logic.NewAuditorWriter(&log),
+	}
+
+	identity := &osb.OriginatingIdentity{
+		Platform: osb.PlatformKubernetes,
+		Value:    `{"username": "alice", "groups": ["team-a"]}`,
+	}
+
+	audited.Provision(&osb.ProvisionRequest{
+		InstanceID:          "audit1",
+		ServiceID:           testServiceID,
+		PlanID:              testPlanID,
+		Parameters:          map[string]interface{}{"credentials": "secret-token"},
+		Context:             map[string]interface{}{"platform": "kubernetes", "namespace": "team-a"},
+		OriginatingIdentity: identity,
+	}, &broker.RequestContext{})
+
+	audited.Bind(&osb.BindRequest{
+		BindingID:  "audit-binding1",
+		InstanceID: "audit1",
+		ServiceID:  testServiceID,
+		PlanID:     testPlanID,
+	}, &broker.RequestContext{})
+
+	// Instance doesn't exist
+	audited.Bind(&osb.BindRequest{
+		BindingID:  "audit-binding2",
+		InstanceID: "not-an-instance",
+		ServiceID:  testServiceID,
+		PlanID:     testPlanID,
+	}, &broker.RequestContext{})
+
+	audited.Unbind(&osb.UnbindRequest{
+		BindingID:  "audit-binding1",
+		InstanceID: "audit1",
+		ServiceID:  testServiceID,
+		PlanID:     testPlanID,
+	}, &broker.RequestContext{})
+
+	if strings.Contains(log.String(), "secret-token") {
+		t.Errorf("Error in audit log: credentials were logged\n")
+	}
+
+	records := []logic.AuditRecord{}
+	scanner := bufio.NewScanner(&log)
+	for scanner.Scan() {
+		record := logic.AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Error in audit log: line is not JSON: %s\n", scanner.Text())
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 4 {
+		t.Fatalf("Error in audit log: expected 4 records, got %d\n", len(records))
+	}
+
+	provision := records[0]
+	if provision.Operation != "provision" || provision.InstanceID != "audit1" || provision.ServiceID != testServiceID ||
+		provision.PlanID != testPlanID || provision.Outcome != "success" || provision.FormatVersion != 1 {
+		t.Errorf("Error in provision record: %#+v\n", provision)
+	}
+	if provision.OriginatingIdentity == nil || provision.OriginatingIdentity.Platform != osb.PlatformKubernetes {
+		t.Errorf("Error in provision record: missing originating identity\n")
+	}
+	if provision.PlatformContext["namespace"] != "team-a" {
+		t.Errorf("Error in provision record: missing platform context\n")
+	}
+
+	if provision.StatusCode != http.StatusCreated {
+		t.Errorf("Error in provision record: expected status 201, got %d\n", provision.StatusCode)
+	}
+
+	if records[1].Operation != "bind" || records[1].BindingID != "audit-binding1" || records[1].Outcome != "success" ||
+		records[1].StatusCode != http.StatusCreated {
+		t.Errorf("Error in bind record: %#+v\n", records[1])
+	}
+	if records[2].Outcome != "failure" || records[2].StatusCode != 404 {
+		t.Errorf("Error in failed bind record: %#+v\n", records[2])
+	}
+	if records[3].Operation != "unbind" || records[3].Outcome != "success" || records[3].StatusCode != http.StatusOK {
+		t.Errorf("Error in unbind record: %#+v\n", records[3])
+	}
+}
+
+// Check the endpoints osb-broker-lib doesn't serve are audited too, once and
+// with their caller
+func TestAuditHandlers(t *testing.T) {
+
+	server := newFakeDataverse(nil)
+	defer server.Close()
+
+	logFile, err := ioutil.TempFile("", "dataverse-broker-audit")
+	if err != nil {
+		t.Fatalf("Error creating audit log: %#+v\n", err)
+	}
+	logFile.Close()
+	defer os.Remove(logFile.Name())
+
+	cacheDir, err := ioutil.TempDir("", "dataverse-broker-cache")
+	if err != nil {
+		t.Fatalf("Error creating cache dir: %#+v\n", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	businessLogic, cleanup := newTestBroker(t, server.URL, logic.Options{
+		AuditLogPath:  logFile.Name(),
+		ProxyURL:      "https://proxy.example.com",
+		ProxyCacheDir: cacheDir,
+	})
+	defer cleanup()
+	if businessLogic.Auditor() == nil {
+		t.Fatalf("Error on BusinessLogic creation: no auditor\n")
+	}
+
+	router := newTestRouter(t, businessLogic, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, middleware.WithUser(r, &middleware.UserInfo{Username: "platform"}))
+		})
+	})
+	if code := callBroker(router, "GET", "/v2/service_instances/not-an-instance", "2.14", nil).Code; code != http.StatusNotFound {
+		t.Errorf("Error fetching missing instance: expected 404, got %d\n", code)
+	}
+	path := "/v2/service_instances/not-an-instance/service_bindings/not-a-binding/manifest"
+	if code := callBroker(router, "GET", path, "2.14", nil).Code; code != http.StatusNotFound {
+		t.Errorf("Error getting manifest of missing binding: expected 404, got %d\n", code)
+	}
+	// Audited by AuditedBroker, not the handlers
+	callBroker(router, "GET", "/v2/catalog", "2.14", nil)
+
+	admin := businessLogic.AdminHandler()
+	admin.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/admin/instances", nil))
+	admin.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil))
+
+	proxy := businessLogic.ProxyHandler()
+	proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/data/audit-binding1/files", nil))
+
+	data, err := ioutil.ReadFile(logFile.Name())
+	if err != nil {
+		t.Fatalf("Error reading audit log: %#+v\n", err)
+	}
+	records := []logic.AuditRecord{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		record := logic.AuditRecord{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Error in audit log: line is not JSON: %s\n", line)
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 4 {
+		t.Fatalf("Error in audit log: expected 4 records, got %s\n", data)
+	}
+	if r := records[0]; r.Operation != "get_instance" || r.InstanceID != "not-an-instance" || r.StatusCode != http.StatusNotFound ||
+		r.Outcome != "failure" || r.Caller != "platform" {
+		t.Errorf("Error in fetch record: %#+v\n", r)
+	}
+	if r := records[1]; r.Operation != "get_manifest" || r.BindingID != "not-a-binding" || r.StatusCode != http.StatusNotFound || r.Caller != "platform" {
+		t.Errorf("Error in manifest record: %#+v\n", r)
+	}
+	if r := records[2]; r.Operation != "admin_list_instances" || r.StatusCode != http.StatusOK || r.Outcome != "success" {
+		t.Errorf("Error in admin record: %#+v\n", r)
+	}
+	if r := records[3]; r.Operation != "proxy_list_files" || r.BindingID != "audit-binding1" || r.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Error in proxy record: %#+v\n", r)
+	}
+}
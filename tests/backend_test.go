@@ -0,0 +1,202 @@
+package broker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// Check that the circuit breaker stops requests to a failing server
+func TestBackendCircuitBreaker(t *testing.T) {
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	logic.ConfigureBackends(logic.BackendConfig{
+		Default: logic.DefaultBackendConfig.Default,
+		Servers: map[string]logic.BackendLimits{
+			server.URL: {
+				MaxConcurrent:    1,
+				FailureThreshold: 2,
+				OpenSeconds:      60,
+			},
+		},
+	})
+	defer logic.ConfigureBackends(logic.DefaultBackendConfig)
+
+	// Failing requests still reach the server until the threshold
+	for i := 0; i < 2; i++ {
+		logic.PingDataverseToken(server.URL, "token")
+	}
+
+	if atomic.LoadInt32(&hits) != 2 {
+		t.Errorf("Error in circuit breaker: expected 2 requests before opening, got %d\n", hits)
+	}
+
+	// The breaker is now open and requests are rejected without being sent
+	_, err := logic.PingDataverse(server.URL)
+
+	if atomic.LoadInt32(&hits) != 2 {
+		t.Errorf("Error in circuit breaker: request sent while open\n")
+	}
+
+	httpErr, ok := osb.IsHTTPError(err)
+	if !ok || httpErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Error in circuit breaker: expected 503 while open, got %#+v\n", err)
+	}
+}
+
+// Check that the token bucket limits the request rate per server
+func TestBackendRateLimit(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	logic.ConfigureBackends(logic.BackendConfig{
+		Default: logic.DefaultBackendConfig.Default,
+		Servers: map[string]logic.BackendLimits{
+			server.URL: {
+				RequestsPerSecond: 0.001,
+				Burst:             1,
+				WaitSeconds:       1,
+			},
+		},
+	})
+	defer logic.ConfigureBackends(logic.DefaultBackendConfig)
+
+	if succ, err := logic.PingDataverse(server.URL); !succ || err != nil {
+		t.Errorf("Error on first request within burst: %#+v\n", err)
+	}
+
+	// The bucket is empty and won't refill before the wait times out
+	_, err := logic.PingDataverse(server.URL)
+
+	httpErr, ok := osb.IsHTTPError(err)
+	if !ok || httpErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Error in rate limit: expected 503 when throttled, got %#+v\n", err)
+	}
+}
+
+// Check that downloads hold their concurrency slot until they are read, not
+// only until Dataverse answers
+func TestBackendStreamingSlots(t *testing.T) {
+
+	var active, highest int32
+	server := newFakeDataverse(map[string]http.HandlerFunc{
+		"/api/datasets/": func(w http.ResponseWriter, r *http.Request) {
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{
+				"status": "OK",
+				"data": []interface{}{
+					map[string]interface{}{"label": "a.csv", "dataFile": map[string]interface{}{"id": 1, "filesize": 4}},
+					map[string]interface{}{"label": "b.csv", "dataFile": map[string]interface{}{"id": 2, "filesize": 4}},
+				},
+			})
+		},
+		"/api/search": func(w http.ResponseWriter, r *http.Request) {
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{
+				"status": "OK",
+				"data": map[string]interface{}{
+					"items":             []interface{}{map[string]interface{}{"global_id": "doi:10.5072/FK2/ABC", "type": "dataset"}},
+					"count_in_response": 1,
+					"total_count":       1,
+				},
+			})
+		},
+		"/api/access/datafile/": func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			for {
+				h := atomic.LoadInt32(&highest)
+				if n <= h || atomic.CompareAndSwapInt32(&highest, h, n) {
+					break
+				}
+			}
+
+			// Answer right away, then stream the content slowly
+			w.Write([]byte("a,"))
+			w.(http.Flusher).Flush()
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte("b\n"))
+		},
+	})
+	defer server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "dataverse-broker-cache")
+	if err != nil {
+		t.Fatalf("Error creating cache dir: %#+v\n", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	businessLogic, cleanup := newTestBroker(t, server.URL, logic.Options{
+		ProxyURL:      "https://proxy.example.com",
+		ProxyCacheDir: cacheDir,
+	})
+	defer cleanup()
+
+	logic.ConfigureBackends(logic.BackendConfig{
+		Default: logic.DefaultBackendConfig.Default,
+		Servers: map[string]logic.BackendLimits{
+			server.URL: {
+				MaxConcurrent: 1,
+				WaitSeconds:   5,
+			},
+		},
+	})
+	defer logic.ConfigureBackends(logic.DefaultBackendConfig)
+
+	_, err = businessLogic.Provision(&osb.ProvisionRequest{
+		InstanceID: "slots1",
+		ServiceID:  testServiceID,
+		PlanID:     testPlanID,
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Provision: %#+v\n", err)
+	}
+	response, err := businessLogic.Bind(&osb.BindRequest{
+		BindingID:  "slots-binding1",
+		InstanceID: "slots1",
+		ServiceID:  testServiceID,
+		PlanID:     testPlanID,
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Bind: %#+v\n", err)
+	}
+	token := response.Credentials["proxy_token"].(string)
+	waitForManifest(t, businessLogic, "slots1", "slots-binding1")
+
+	proxy := businessLogic.ProxyHandler()
+	var wg sync.WaitGroup
+	for _, path := range []string{"/data/slots-binding1/files/1", "/data/slots-binding1/files/2"} {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			request := httptest.NewRequest("GET", path, nil)
+			request.Header.Set("Authorization", "Bearer "+token)
+			recorder := httptest.NewRecorder()
+			proxy.ServeHTTP(recorder, request)
+			if recorder.Code != http.StatusOK || recorder.Body.String() != "a,b\n" {
+				t.Errorf("Error getting %s: %d %q\n", path, recorder.Code, recorder.Body.String())
+			}
+		}(path)
+	}
+	wg.Wait()
+
+	if h := atomic.LoadInt32(&highest); h != 1 {
+		t.Errorf("Error in concurrency limit: expected 1 download at a time, got %d\n", h)
+	}
+}
@@ -0,0 +1,35 @@
+package broker
+
+import (
+	"os"
+	"testing"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+)
+
+// Check every checksum type Dataverse uses
+func TestChecksumVerifyFile(t *testing.T) {
+
+	path := writeTestFile(t, "hello\n")
+	defer os.Remove(path)
+
+	checksums := []logic.DatafileChecksum{
+		{Type: "MD5", Value: "b1946ac92492d2347c6235b4d2611184"},
+		{Type: "SHA-1", Value: "f572d396fae9206628714fb2ce00f72e94f2258f"},
+		{Type: "SHA-256", Value: "5891B5B522D5DF086D0FF0B110FBD9D21BB4FC7163AF34D08286A2E846F6BE03"},
+		{Type: "SHA-512", Value: "e7c22b994c59d9cf2b48e549b1e24666636045930d3da7c1acb299d1c3b7f931f94aae41edda2c2b207a36e10f8bcb8d45223e54878f5b316e7ce3b6bc019629"},
+	}
+	for _, checksum := range checksums {
+		ok, err := checksum.VerifyFile(path)
+		if err != nil || !ok {
+			t.Errorf("Error verifying %s checksum: %v %#+v\n", checksum.Type, ok, err)
+		}
+	}
+
+	if ok, _ := (logic.DatafileChecksum{Type: "MD5", Value: "0"}).VerifyFile(path); ok {
+		t.Errorf("Error verifying checksum: mismatch not detected\n")
+	}
+	if _, err := (logic.DatafileChecksum{Type: "CRC32", Value: "0"}).VerifyFile(path); err == nil {
+		t.Errorf("Error verifying checksum: expected error for unsupported type\n")
+	}
+}
@@ -0,0 +1,139 @@
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// Check bindings to a dataset get its citation in plain text, BibTeX and RIS,
+// for the version current when bound
+func TestCitations(t *testing.T) {
+
+	var mutex sync.Mutex
+	latest := "1.1"
+
+	server := newFakeDataverse(map[string]http.HandlerFunc{
+		"/api/datasets/": func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("persistentId") != testDatasetPID {
+				writeDataverseJSON(w, http.StatusNotFound, map[string]interface{}{"status": "ERROR", "message": "Dataset not found"})
+				return
+			}
+			path := strings.TrimPrefix(r.URL.Path, "/api/datasets/:persistentId/versions/")
+			mutex.Lock()
+			path = strings.Replace(path, ":latest", latest, 1)
+			mutex.Unlock()
+
+			parts := strings.SplitN(path, "/", 2)
+			switch {
+			case len(parts) == 1:
+				numbers := strings.Split(parts[0], ".")
+				writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": map[string]interface{}{
+					"versionState": "RELEASED", "versionNumber": json.Number(numbers[0]), "versionMinorNumber": json.Number(numbers[1]),
+				}})
+			case parts[1] == "files":
+				writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": []interface{}{}})
+			case parts[1] == "citation":
+				writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": map[string]interface{}{
+					"message": "Doe, Jane, 2018, \"Soil samples\", https://doi.org/10.5072/FK2/PIN, Test Dataverse, V" + parts[0],
+				}})
+			case parts[1] == "citation/BibTeX":
+				w.Write([]byte("@data{FK2/PIN_2018,\nauthor = {Doe, Jane},\nversion = {V" + parts[0] + "},\n}\n"))
+			default:
+				// No RIS export on this server
+				writeDataverseJSON(w, http.StatusNotFound, map[string]interface{}{"status": "ERROR", "message": "Unknown format"})
+			}
+		},
+	})
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "dataverse-broker-test")
+	if err != nil {
+		t.Fatalf("Error creating catalog dir: %#+v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	data, _ := json.Marshal([]map[string]interface{}{
+		{
+			"id":         "test-dataset",
+			"service_id": testDatasetServiceID,
+			"plan_id":    testDatasetPlanID,
+			"description": map[string]interface{}{
+				"name":      "Test Dataset",
+				"type":      "dataset",
+				"url":       server.URL + "/dataverse/test",
+				"global_id": testDatasetPID,
+			},
+			"server_name": "test",
+			"server_url":  server.URL,
+		},
+	})
+	if err = ioutil.WriteFile(filepath.Join(dir, "dataverses.json"), data, 0644); err != nil {
+		t.Fatalf("Error writing catalog: %#+v\n", err)
+	}
+
+	businessLogic, err := logic.NewBusinessLogic(logic.Options{CatalogPath: dir})
+	if err != nil {
+		t.Fatalf("Error on BusinessLogic creation: %#+v\n", err)
+	}
+
+	provision := func(instanceID string, params map[string]interface{}) {
+		_, err := businessLogic.Provision(&osb.ProvisionRequest{
+			InstanceID: instanceID,
+			ServiceID:  testDatasetServiceID,
+			PlanID:     testDatasetPlanID,
+			Parameters: params,
+		}, &broker.RequestContext{})
+		if err != nil {
+			t.Fatalf("Error on Provision: %#+v\n", err)
+		}
+	}
+	bind := func(bindingID string, instanceID string) map[string]interface{} {
+		response, err := businessLogic.Bind(&osb.BindRequest{
+			BindingID:  bindingID,
+			InstanceID: instanceID,
+			ServiceID:  testDatasetServiceID,
+			PlanID:     testDatasetPlanID,
+		}, &broker.RequestContext{})
+		if err != nil {
+			t.Fatalf("Error on Bind: %#+v\n", err)
+		}
+		return response.Credentials
+	}
+
+	provision("cited1", nil)
+	provision("cited2", map[string]interface{}{"version": "1.0"})
+
+	credentials := bind("cited-binding1", "cited1")
+	if credentials["citation_version"] != "1.1" ||
+		!strings.HasSuffix(credentials["citation"].(string), "Test Dataverse, V1.1") ||
+		!strings.Contains(credentials["citation_bibtex"].(string), "version = {V1.1}") {
+		t.Errorf("Error in credentials: expected the citations of version 1.1, got %#+v\n", credentials)
+	}
+	if _, ok := credentials["citation_ris"]; ok {
+		t.Errorf("Error in credentials: expected no RIS citation, got %#+v\n", credentials["citation_ris"])
+	}
+
+	if credentials = bind("cited-binding2", "cited2"); credentials["citation_version"] != "1.0" {
+		t.Errorf("Error in credentials of pinned instance: expected the citation of version 1.0, got %#+v\n", credentials)
+	}
+
+	mutex.Lock()
+	latest = "2.0"
+	mutex.Unlock()
+
+	if credentials = bind("cited-binding3", "cited1"); credentials["citation_version"] != "2.0" {
+		t.Errorf("Error in credentials after new version: expected the citation of version 2.0, got %#+v\n", credentials)
+	}
+	if credentials = bind("cited-binding1", "cited1"); credentials["citation_version"] != "1.1" {
+		t.Errorf("Error in credentials of existing binding: expected the citation of version 1.1, got %#+v\n", credentials)
+	}
+}
@@ -0,0 +1,178 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// Check the deposit plan creates a draft dataset and deprovisioning removes
+// it according to whether it was published
+func TestDepositPlan(t *testing.T) {
+
+	var mutex sync.Mutex
+	created := make([]map[string]interface{}, 0)
+	deleted := make([]string, 0)
+	// Versions of the datasets by persistent ID
+	versions := map[string][]map[string]interface{}{}
+
+	server := newFakeDataverse(map[string]http.HandlerFunc{
+		"/api/dataverses/test/datasets": func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" || r.Header.Get("X-Dataverse-key") != "secret-token" {
+				writeDataverseJSON(w, http.StatusUnauthorized, map[string]interface{}{"status": "ERROR", "message": "Bad api key"})
+				return
+			}
+			body := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&body)
+
+			mutex.Lock()
+			created = append(created, body)
+			pid := "doi:10.5072/FK2/DEP" + strconv.Itoa(len(created))
+			versions[pid] = []map[string]interface{}{{"versionState": "DRAFT"}}
+			mutex.Unlock()
+
+			writeDataverseJSON(w, http.StatusCreated, map[string]interface{}{
+				"status": "OK",
+				"data":   map[string]interface{}{"id": 42, "persistentId": pid},
+			})
+		},
+		"/api/datasets/": func(w http.ResponseWriter, r *http.Request) {
+			pid := r.URL.Query().Get("persistentId")
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			switch {
+			case r.Method == "DELETE":
+				deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/api/datasets/:persistentId/")+pid)
+				writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": map[string]interface{}{}})
+			case strings.HasSuffix(r.URL.Path, "/versions"):
+				writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": versions[pid]})
+			default:
+				writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": []interface{}{}})
+			}
+		},
+	})
+	defer server.Close()
+
+	businessLogic, cleanup := newTestBroker(t, server.URL, logic.Options{
+		DepositRetention: logic.DepositRetentionDiscardDraft,
+	})
+	defer cleanup()
+
+	depositPlanID := testPlanID + "-deposit"
+
+	catalog, err := businessLogic.GetCatalog(&broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on GetCatalog: %#+v\n", err)
+	}
+	found := false
+	for _, plan := range catalog.Services[0].Plans {
+		found = found || (plan.ID == depositPlanID && plan.Name == "deposit")
+	}
+	if !found {
+		t.Errorf("Error in catalog: no deposit plan: %#+v\n", catalog.Services[0].Plans)
+	}
+
+	params := map[string]interface{}{
+		"credentials": "secret-token",
+		"title":       "Measurements",
+		"authors":     []interface{}{"Doe, Jane", "Roe, Richard"},
+		"description": "Raw measurements",
+		"subject":     "Physics",
+		"contact":     "jane@example.com",
+	}
+	provision := func(instanceID string, params map[string]interface{}) error {
+		_, err := businessLogic.Provision(&osb.ProvisionRequest{
+			InstanceID: instanceID,
+			ServiceID:  testServiceID,
+			PlanID:     depositPlanID,
+			Parameters: params,
+		}, &broker.RequestContext{})
+		return err
+	}
+
+	invalid := map[string]interface{}{}
+	for k, v := range params {
+		invalid[k] = v
+	}
+	invalid["subject"] = "Alchemy"
+	if httpErr, ok := provision("deposit0", invalid).(osb.HTTPStatusCodeError); !ok || httpErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Error on Provision with unknown subject: expected 400, got %#+v\n", httpErr)
+	}
+	delete(invalid, "subject")
+	delete(invalid, "title")
+	if httpErr, ok := provision("deposit0", invalid).(osb.HTTPStatusCodeError); !ok || httpErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Error on Provision without title: expected 400, got %#+v\n", httpErr)
+	}
+	// A 401 from Dataverse isn't about the broker's own credentials
+	invalid["title"] = params["title"]
+	invalid["subject"] = params["subject"]
+	invalid["credentials"] = "expired-token"
+	if httpErr, ok := provision("deposit0", invalid).(osb.HTTPStatusCodeError); !ok || httpErr.StatusCode != http.StatusUnprocessableEntity ||
+		httpErr.Description == nil || *httpErr.Description != "Bad api key" {
+		t.Errorf("Error on Provision with bad credentials: expected 422 with the Dataverse message, got %#+v\n", httpErr)
+	}
+	if len(created) != 0 {
+		t.Errorf("Error on Provision: dataset created with invalid parameters\n")
+	}
+
+	if err = provision("deposit1", params); err != nil {
+		t.Fatalf("Error on Provision: %#+v\n", err)
+	}
+	if err = provision("deposit1", params); err != nil {
+		t.Errorf("Error on Provision with instance that already exists: %#+v\n", err)
+	}
+	if len(created) != 1 || !strings.Contains(toJSON(created[0]), `"value":"Measurements"`) || !strings.Contains(toJSON(created[0]), `"value":"Roe, Richard"`) {
+		t.Errorf("Error on Provision: unexpected datasets created: %v\n", created)
+	}
+
+	response, err := businessLogic.Bind(&osb.BindRequest{
+		BindingID:  "deposit-binding1",
+		InstanceID: "deposit1",
+		ServiceID:  testServiceID,
+		PlanID:     depositPlanID,
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Bind: %#+v\n", err)
+	}
+	endpoints, _ := response.Credentials["upload_endpoints"].(map[string]interface{})
+	if response.Credentials["dataset"] != "doi:10.5072/FK2/DEP1" || response.Credentials["credentials"] != "secret-token" ||
+		!strings.HasPrefix(endpoints["native"].(string), server.URL+"/api/datasets/:persistentId/add?persistentId=doi") {
+		t.Errorf("Error in credentials: %#+v\n", response.Credentials)
+	}
+
+	// A second deposit gets published
+	if err = provision("deposit2", params); err != nil {
+		t.Fatalf("Error on Provision: %#+v\n", err)
+	}
+	mutex.Lock()
+	versions["doi:10.5072/FK2/DEP2"] = []map[string]interface{}{{"versionState": "DRAFT"}, {"versionState": "RELEASED", "versionNumber": 1}}
+	mutex.Unlock()
+
+	for _, instanceID := range []string{"deposit1", "deposit2"} {
+		_, err = businessLogic.Deprovision(&osb.DeprovisionRequest{
+			InstanceID: instanceID,
+			ServiceID:  testServiceID,
+			PlanID:     depositPlanID,
+		}, &broker.RequestContext{})
+		if err != nil {
+			t.Errorf("Error on Deprovision: %#+v\n", err)
+		}
+	}
+
+	if len(deleted) != 2 || deleted[0] != "doi:10.5072/FK2/DEP1" || deleted[1] != "versions/:draftdoi:10.5072/FK2/DEP2" {
+		t.Errorf("Error on Deprovision: unexpected deletions %v\n", deleted)
+	}
+}
+
+func toJSON(object interface{}) string {
+	data, _ := json.Marshal(object)
+	return string(data)
+}
@@ -0,0 +1,158 @@
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+)
+
+// IDs of the dataverse in the test catalog
+const (
+	testServiceID = "0b9ddc2a-3bd5-4d2f-9a04-0a4a2c4a6f01"
+	testPlanID    = "a7f0b8a2-2f21-4c43-8b1e-7a4a4a0e9d02"
+)
+
+// newFakeDataverse starts a server answering the Dataverse API calls made by
+// the broker. Extra handlers are registered on top of the defaults, replacing
+// those with the same pattern.
+func newFakeDataverse(handlers map[string]http.HandlerFunc) *httptest.Server {
+	defaults := map[string]http.HandlerFunc{
+		"/dataverse/test": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("<html></html>"))
+		},
+		"/api/dataverses/:root": func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("key") == "bad-token" {
+				writeDataverseJSON(w, http.StatusUnauthorized, map[string]interface{}{
+					"status":  "ERROR",
+					"message": "Bad api key",
+				})
+				return
+			}
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{
+				"status": "OK",
+				"data":   map[string]interface{}{},
+			})
+		},
+		"/api/info/version": func(w http.ResponseWriter, r *http.Request) {
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{
+				"status": "OK",
+				"data":   map[string]interface{}{"version": "4.9"},
+			})
+		},
+		// An empty dataverse
+		"/api/search": func(w http.ResponseWriter, r *http.Request) {
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{
+				"status": "OK",
+				"data": map[string]interface{}{
+					"items":             []interface{}{},
+					"count_in_response": 0,
+					"total_count":       0,
+				},
+			})
+		},
+	}
+
+	for pattern, handler := range handlers {
+		defaults[pattern] = handler
+	}
+
+	mux := http.NewServeMux()
+	for pattern, handler := range defaults {
+		mux.HandleFunc(pattern, handler)
+	}
+
+	return httptest.NewServer(mux)
+}
+
+func writeDataverseJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// newTestCatalog writes a whitelist with a single dataverse on the given
+// server, and any extra entries, and returns its directory
+func newTestCatalog(t *testing.T, serverURL string, extra ...map[string]interface{}) string {
+	dir, err := ioutil.TempDir("", "dataverse-broker-test")
+	if err != nil {
+		t.Fatalf("Error creating catalog dir: %#+v\n", err)
+	}
+
+	instances := []map[string]interface{}{
+		{
+			"id":         "test-dataverse",
+			"service_id": testServiceID,
+			"plan_id":    testPlanID,
+			"description": map[string]interface{}{
+				"name":       "Test Dataverse",
+				"type":       "dataverse",
+				"url":        serverURL + "/dataverse/test",
+				"identifier": "test",
+			},
+			"server_name": "test",
+			"server_url":  serverURL,
+		},
+	}
+	instances = append(instances, extra...)
+
+	data, _ := json.Marshal(instances)
+	if err = ioutil.WriteFile(filepath.Join(dir, "dataverses.json"), data, 0644); err != nil {
+		t.Fatalf("Error writing catalog: %#+v\n", err)
+	}
+
+	return dir
+}
+
+// newTestBroker creates a BusinessLogic over the test catalog
+func newTestBroker(t *testing.T, serverURL string, o logic.Options) (*logic.BusinessLogic, func()) {
+	dir := newTestCatalog(t, serverURL)
+	o.CatalogPath = dir
+
+	businessLogic, err := logic.NewBusinessLogic(o)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Error on BusinessLogic creation: %#+v\n", err)
+	}
+
+	return businessLogic, func() { os.RemoveAll(dir) }
+}
+
+// writeTestFile writes content to a new temporary file and returns its path
+func writeTestFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "dataverse-broker-test")
+	if err != nil {
+		t.Fatalf("Error creating file: %#+v\n", err)
+	}
+	defer f.Close()
+
+	if _, err = f.WriteString(content); err != nil {
+		t.Fatalf("Error writing file: %#+v\n", err)
+	}
+
+	return f.Name()
+}
+
+// waitForManifest waits for the files of a binding to be listed, and returns
+// the manifest of its credentials
+func waitForManifest(t *testing.T, businessLogic *logic.BusinessLogic, instanceID string, bindingID string) *logic.Manifest {
+	for i := 0; i < 500; i++ {
+		response, err := businessLogic.GetBinding(instanceID, bindingID)
+		if err != nil {
+			t.Fatalf("Error on GetBinding: %#+v\n", err)
+		}
+		manifest := response.Credentials["manifest"].(*logic.Manifest)
+		if !manifest.Pending {
+			return manifest
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Error waiting for manifest of binding %q: still pending\n", bindingID)
+	return nil
+}
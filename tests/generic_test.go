@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// Check the generic service of a server provisions any of its dataverses, by
+// alias or URL, and only when it exists
+func TestGenericService(t *testing.T) {
+
+	server := newFakeDataverse(map[string]http.HandlerFunc{
+		"/api/dataverses/": func(w http.ResponseWriter, r *http.Request) {
+			if strings.TrimPrefix(r.URL.Path, "/api/dataverses/") != "soil" {
+				writeDataverseJSON(w, http.StatusNotFound, map[string]interface{}{"status": "ERROR", "message": "Can't find dataverse"})
+				return
+			}
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": map[string]interface{}{
+				"id":           42,
+				"alias":        "soil",
+				"name":         "Soil Science",
+				"description":  "Soil samples and analyses",
+				"creationDate": "2018-06-01T12:00:00Z",
+			}})
+		},
+	})
+	defer server.Close()
+
+	businessLogic, cleanup := newTestBroker(t, server.URL, logic.Options{})
+	defer cleanup()
+
+	catalog, err := businessLogic.GetCatalog(&broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on GetCatalog: %#+v\n", err)
+	}
+	var serviceID, planID string
+	for _, service := range catalog.Services {
+		if strings.HasPrefix(service.Name, "dataverse-server-") {
+			serviceID, planID = service.ID, service.Plans[0].ID
+		}
+	}
+	if serviceID == "" {
+		t.Fatalf("Error in catalog: no generic service for %s\n", server.URL)
+	}
+
+	provision := func(instanceID string, target string) error {
+		_, err := businessLogic.Provision(&osb.ProvisionRequest{
+			InstanceID: instanceID,
+			ServiceID:  serviceID,
+			PlanID:     planID,
+			Parameters: map[string]interface{}{"dataverse": target},
+		}, &broker.RequestContext{})
+		return err
+	}
+
+	if err = provision("generic0", "https://dataverse.example.org/dataverse/soil"); !isStatusError(err, http.StatusBadRequest) {
+		t.Errorf("Error on Provision with dataverse of another server: expected 400, got %#+v\n", err)
+	}
+	if err = provision("generic0", server.URL+"/dataset.xhtml?persistentId=doi:10.5072/FK2/SOIL"); !isStatusError(err, http.StatusBadRequest) {
+		t.Errorf("Error on Provision with URL of a dataset: expected 400, got %#+v\n", err)
+	}
+	if err = provision("generic0", "water"); !isStatusError(err, http.StatusBadRequest) {
+		t.Errorf("Error on Provision with missing dataverse: expected 400, got %#+v\n", err)
+	}
+
+	if err = provision("generic1", "soil"); err != nil {
+		t.Fatalf("Error on Provision by alias: %#+v\n", err)
+	}
+	if err = provision("generic2", server.URL+"/dataverse/soil/"); err != nil {
+		t.Fatalf("Error on Provision by URL: %#+v\n", err)
+	}
+	if err = provision("generic1", "soil"); err != nil {
+		t.Errorf("Error on Provision with instance that already exists: %#+v\n", err)
+	}
+	if err = provision("generic1", "water"); !isStatusError(err, http.StatusConflict) {
+		t.Errorf("Error on Provision with instance ID in use: expected 409, got %#+v\n", err)
+	}
+
+	response, err := businessLogic.Bind(&osb.BindRequest{
+		BindingID:  "generic-binding2",
+		InstanceID: "generic2",
+		ServiceID:  serviceID,
+		PlanID:     planID,
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Bind: %#+v\n", err)
+	}
+	if response.Credentials["coordinates"] != server.URL+"/dataverse/soil" {
+		t.Errorf("Error in credentials: expected the resolved dataverse, got %#+v\n", response.Credentials)
+	}
+}
@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// Check the dataset of a deposit isn't changed while Dataverse has it locked:
+// synchronous requests get a 422, asynchronous ones wait for the locks to
+// clear
+func TestDatasetLocks(t *testing.T) {
+
+	var mutex sync.Mutex
+	locks := []interface{}{map[string]interface{}{"lockType": "Ingest", "user": "jane"}}
+	events := make([]string, 0)
+
+	ok := func(w http.ResponseWriter, data interface{}) {
+		writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": data})
+	}
+
+	server := newFakeDataverse(map[string]http.HandlerFunc{
+		"/api/dataverses/test/datasets": func(w http.ResponseWriter, r *http.Request) {
+			writeDataverseJSON(w, http.StatusCreated, map[string]interface{}{
+				"status": "OK",
+				"data":   map[string]interface{}{"id": 1, "persistentId": "doi:10.5072/FK2/LOCK1"},
+			})
+		},
+		"/api/datasets/": func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/locks"):
+				ok(w, locks)
+			case strings.HasSuffix(r.URL.Path, "/versions"):
+				ok(w, []interface{}{map[string]interface{}{"versionState": "DRAFT"}})
+			default:
+				if len(locks) > 0 {
+					// What Dataverse does to writes on locked datasets
+					writeDataverseJSON(w, http.StatusInternalServerError, map[string]interface{}{"status": "ERROR", "message": "Dataset is locked"})
+					return
+				}
+				events = append(events, r.Method+" "+r.URL.Path)
+				ok(w, map[string]interface{}{})
+			}
+		},
+	})
+	defer server.Close()
+
+	businessLogic, cleanup := newTestBroker(t, server.URL, logic.Options{})
+	defer cleanup()
+
+	depositPlanID := testPlanID + "-deposit"
+	_, err := businessLogic.Provision(&osb.ProvisionRequest{
+		InstanceID: "locked1",
+		ServiceID:  testServiceID,
+		PlanID:     depositPlanID,
+		Parameters: map[string]interface{}{
+			"credentials": "secret-token",
+			"title":       "Measurements",
+			"authors":     "Doe, Jane",
+			"description": "Raw measurements",
+			"subject":     "Physics",
+		},
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Provision: %#+v\n", err)
+	}
+
+	deprovision := func(acceptsIncomplete bool) (*broker.DeprovisionResponse, error) {
+		return businessLogic.Deprovision(&osb.DeprovisionRequest{
+			InstanceID:        "locked1",
+			ServiceID:         testServiceID,
+			PlanID:            depositPlanID,
+			AcceptsIncomplete: acceptsIncomplete,
+		}, &broker.RequestContext{})
+	}
+
+	_, err = deprovision(false)
+	httpErr, isHTTPErr := err.(osb.HTTPStatusCodeError)
+	if !isHTTPErr || httpErr.StatusCode != http.StatusUnprocessableEntity || httpErr.ErrorMessage == nil ||
+		*httpErr.ErrorMessage != "ConcurrencyError" || !strings.Contains(*httpErr.Description, "Ingest") {
+		t.Errorf("Error on Deprovision of locked dataset: expected 422 ConcurrencyError, got %#+v\n", err)
+	}
+
+	response, err := deprovision(true)
+	if err != nil || !response.Async || response.OperationKey == nil {
+		t.Fatalf("Error on asynchronous Deprovision of locked dataset: %#+v %#+v\n", response, err)
+	}
+	last, err := businessLogic.LastOperation(&osb.LastOperationRequest{InstanceID: "locked1"}, &broker.RequestContext{})
+	if err != nil || last.State != osb.StateInProgress {
+		t.Errorf("Error on LastOperation while locked: expected in progress, got %#+v %#+v\n", last, err)
+	}
+
+	mutex.Lock()
+	locks = []interface{}{}
+	mutex.Unlock()
+
+	if _, err = waitForOperation(t, businessLogic, "locked1"); !isStatusError(err, http.StatusGone) {
+		t.Errorf("Error on LastOperation after Deprovision: expected 410, got %#+v\n", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(events) != 1 || events[0] != "DELETE /api/datasets/:persistentId/" {
+		t.Errorf("Error on Deprovision: unexpected Dataverse calls: %v\n", events)
+	}
+}
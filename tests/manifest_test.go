@@ -0,0 +1,212 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// Check the files of a dataverse are listed and paged in binding credentials
+func TestBindingManifest(t *testing.T) {
+
+	server := newFakeDataverse(map[string]http.HandlerFunc{
+		"/api/search": func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("subtree") != "test" || r.URL.Query().Get("type") != "dataset" {
+				t.Errorf("Error in search query: %s\n", r.URL.RawQuery)
+			}
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{
+				"status": "OK",
+				"data": map[string]interface{}{
+					"items":             []interface{}{map[string]interface{}{"global_id": "doi:10.5072/FK2/ABC", "type": "dataset"}},
+					"count_in_response": 1,
+					"total_count":       1,
+				},
+			})
+		},
+		"/api/datasets/": func(w http.ResponseWriter, r *http.Request) {
+			// The token gives access to the draft
+			if !strings.HasSuffix(r.URL.Path, "/versions/:latest/files") || r.URL.Query().Get("key") != "secret-token" {
+				t.Errorf("Error in files request: %s\n", r.URL)
+			}
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{
+				"status": "OK",
+				"data": []interface{}{
+					map[string]interface{}{"label": "a.csv", "directoryLabel": "data", "dataFile": map[string]interface{}{
+						"id": 1, "contentType": "text/csv", "filesize": 10,
+						"checksum": map[string]interface{}{"type": "SHA-256", "value": "abc"},
+					}},
+					map[string]interface{}{"label": "b.txt", "dataFile": map[string]interface{}{
+						"id": 2, "contentType": "text/plain", "filesize": 20, "md5": "def",
+					}},
+					map[string]interface{}{"label": "c.txt", "dataFile": map[string]interface{}{
+						"id": 3, "contentType": "text/plain", "filesize": 30, "md5": "ghi",
+					}},
+				},
+			})
+		},
+	})
+	defer server.Close()
+
+	businessLogic, cleanup := newTestBroker(t, server.URL, logic.Options{ManifestPageSize: 2})
+	defer cleanup()
+
+	_, err := businessLogic.Provision(&osb.ProvisionRequest{
+		InstanceID: "manifest1",
+		ServiceID:  testServiceID,
+		PlanID:     testPlanID,
+		Parameters: map[string]interface{}{"credentials": "secret-token"},
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Provision: %#+v\n", err)
+	}
+
+	response, err := businessLogic.Bind(&osb.BindRequest{
+		BindingID:  "manifest-binding1",
+		InstanceID: "manifest1",
+		ServiceID:  testServiceID,
+		PlanID:     testPlanID,
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Bind: %#+v\n", err)
+	}
+
+	if response.Credentials["dataverse"] != "test" || response.Credentials["server_url"] != server.URL {
+		t.Errorf("Error in credentials: %#+v\n", response.Credentials)
+	}
+
+	// The datasets of a dataverse are listed once bound
+	manifest, ok := response.Credentials["manifest"].(*logic.Manifest)
+	if !ok || !manifest.Pending {
+		t.Fatalf("Error in credentials: expected a pending manifest, got %#+v\n", response.Credentials["manifest"])
+	}
+	manifest = waitForManifest(t, businessLogic, "manifest1", "manifest-binding1")
+	if manifest.TotalCount != 3 || len(manifest.Files) != 2 || manifest.Next == "" {
+		t.Errorf("Error in first manifest page: %#+v\n", manifest)
+	}
+
+	first := manifest.Files[0]
+	if first.FileID != 1 || first.Path != "doi-10.5072-FK2-ABC/data/a.csv" || first.Dataset != "doi:10.5072/FK2/ABC" ||
+		first.Checksum.Type != "SHA-256" || first.DownloadURL != server.URL+"/api/access/datafile/1" {
+		t.Errorf("Error in manifest file: %#+v\n", first)
+	}
+	if manifest.Files[1].Checksum.Type != "MD5" || manifest.Files[1].Checksum.Value != "def" {
+		t.Errorf("Error in manifest file with MD5 only: %#+v\n", manifest.Files[1])
+	}
+
+	page, err := businessLogic.GetManifest("manifest1", "manifest-binding1", 2, 2)
+	if err != nil {
+		t.Fatalf("Error on GetManifest: %#+v\n", err)
+	}
+	if page.Start != 2 || len(page.Files) != 1 || page.Files[0].FileID != 3 || page.Next != "" {
+		t.Errorf("Error in last manifest page: %#+v\n", page)
+	}
+
+	if _, err = businessLogic.GetManifest("other-instance", "manifest-binding1", 0, 2); err == nil {
+		t.Errorf("Error on GetManifest: expected error for wrong instance\n")
+	}
+}
+
+// Check binding a large dataverse lists a bounded number of datasets, and
+// datasets Dataverse fails to list leave the manifest incomplete rather than
+// failing the binding
+func TestBindingManifestIncomplete(t *testing.T) {
+
+	var (
+		mutex  sync.Mutex
+		listed int
+	)
+	server := newFakeDataverse(map[string]http.HandlerFunc{
+		"/api/search": func(w http.ResponseWriter, r *http.Request) {
+			start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+			items := make([]interface{}, 0)
+			for i := start; i < start+100 && i < 250; i++ {
+				items = append(items, map[string]interface{}{"global_id": fmt.Sprintf("doi:10.5072/FK2/%03d", i), "type": "dataset"})
+			}
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{
+				"status": "OK",
+				"data":   map[string]interface{}{"items": items, "count_in_response": len(items), "total_count": 250},
+			})
+		},
+		"/api/datasets/": func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			listed++
+			mutex.Unlock()
+			if r.URL.Query().Get("persistentId") == "doi:10.5072/FK2/007" {
+				writeDataverseJSON(w, http.StatusInternalServerError, map[string]interface{}{"status": "ERROR", "message": "Internal error"})
+				return
+			}
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{
+				"status": "OK",
+				"data": []interface{}{map[string]interface{}{"label": "a.csv", "dataFile": map[string]interface{}{
+					"id": 1, "contentType": "text/csv", "filesize": 10,
+				}}},
+			})
+		},
+	})
+	defer server.Close()
+
+	businessLogic, cleanup := newTestBroker(t, server.URL, logic.Options{})
+	defer cleanup()
+
+	// At the default rate limit, 100 datasets take 20s to list
+	limits := logic.DefaultBackendConfig.Default
+	limits.RequestsPerSecond = 0
+	logic.ConfigureBackends(logic.BackendConfig{
+		Default: logic.DefaultBackendConfig.Default,
+		Servers: map[string]logic.BackendLimits{server.URL: limits},
+	})
+	defer logic.ConfigureBackends(logic.DefaultBackendConfig)
+
+	_, err := businessLogic.Provision(&osb.ProvisionRequest{
+		InstanceID: "large1",
+		ServiceID:  testServiceID,
+		PlanID:     testPlanID,
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Provision: %#+v\n", err)
+	}
+
+	_, err = businessLogic.Bind(&osb.BindRequest{
+		BindingID:  "large-binding1",
+		InstanceID: "large1",
+		ServiceID:  testServiceID,
+		PlanID:     testPlanID,
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Bind: %#+v\n", err)
+	}
+
+	manifest := waitForManifest(t, businessLogic, "large1", "large-binding1")
+	if !manifest.Incomplete || len(manifest.UnlistedDatasets) != 1 || manifest.UnlistedDatasets[0] != "doi:10.5072/FK2/007" {
+		t.Errorf("Error in incomplete manifest: %#+v\n", manifest)
+	}
+	if manifest.TotalCount != 99 || manifest.Files[7].Dataset != "doi:10.5072/FK2/008" {
+		t.Errorf("Error in incomplete manifest: expected the files of 99 datasets in order, got %d\n", manifest.TotalCount)
+	}
+	mutex.Lock()
+	if listed != 100 {
+		t.Errorf("Error listing datasets: expected 100 listed, got %d\n", listed)
+	}
+	mutex.Unlock()
+
+	// The manifest endpoint is part of the OSB API, and checks its version
+	router := newTestRouter(t, businessLogic)
+	path := "/v2/service_instances/large1/service_bindings/large-binding1/manifest?start=98"
+	if recorder := callBroker(router, "GET", path, "", nil); recorder.Code != http.StatusPreconditionFailed {
+		t.Errorf("Error getting manifest without version: expected 412, got %d\n", recorder.Code)
+	}
+	recorder := callBroker(router, "GET", path, "2.13", nil)
+	page := logic.Manifest{}
+	json.Unmarshal(recorder.Body.Bytes(), &page)
+	if recorder.Code != http.StatusOK || len(page.Files) != 1 || !page.Incomplete {
+		t.Errorf("Error getting manifest: %d %s\n", recorder.Code, recorder.Body.String())
+	}
+}
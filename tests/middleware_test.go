@@ -0,0 +1,145 @@
+package broker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	authenticationapi "k8s.io/api/authentication/v1"
+	authorizationapi "k8s.io/api/authorization/v1"
+
+	"github.com/dataverse-broker/dataverse-broker/pkg/middleware"
+)
+
+// fakeTokenReviews authenticates the token "<username>"
+type fakeTokenReviews struct{}
+
+func (fakeTokenReviews) Create(tr *authenticationapi.TokenReview) (*authenticationapi.TokenReview, error) {
+	tr.Status = authenticationapi.TokenReviewStatus{
+		Authenticated: true,
+		User: authenticationapi.UserInfo{
+			Username: tr.Spec.Token,
+			Groups:   []string{"system:authenticated"},
+		},
+	}
+	return tr, nil
+}
+
+// fakeSubjectAccessReviews allows a single user and counts reviews
+type fakeSubjectAccessReviews struct {
+	allowedUser string
+	reviews     int
+}
+
+func (f *fakeSubjectAccessReviews) Create(sar *authorizationapi.SubjectAccessReview) (*authorizationapi.SubjectAccessReview, error) {
+	f.reviews++
+	sar.Status.Allowed = sar.Spec.User == f.allowedUser &&
+		sar.Spec.ResourceAttributes.Resource == "servicebrokers" &&
+		sar.Spec.ResourceAttributes.Subresource == "proxy"
+	return sar, nil
+}
+
+// Check that authenticated users are authorized and the result is cached
+func TestSubjectAccessReviewMiddleware(t *testing.T) {
+
+	reviews := &fakeSubjectAccessReviews{allowedUser: "system:serviceaccount:catalog:client"}
+	tr := middleware.TokenReviewMiddleware{TokenReview: fakeTokenReviews{}}
+	sar := &middleware.SubjectAccessReviewMiddleware{
+		SubjectAccessReview: reviews,
+		ResourceAttributes:  middleware.ParseResourceAttributes("create", "servicecatalog.k8s.io", "servicebrokers/proxy"),
+		CacheTTL:            time.Minute,
+	}
+
+	handler := tr.Middleware(sar.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})))
+
+	call := func(token string) int {
+		request := httptest.NewRequest("GET", "/v2/catalog", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	if code := call("system:serviceaccount:catalog:client"); code != http.StatusOK {
+		t.Errorf("Error on authorized user: expected 200, got %d\n", code)
+	}
+	if code := call("system:serviceaccount:other:default"); code != http.StatusForbidden {
+		t.Errorf("Error on unauthorized user: expected 403, got %d\n", code)
+	}
+
+	// Repeated requests are answered from the cache
+	call("system:serviceaccount:catalog:client")
+	call("system:serviceaccount:other:default")
+	if reviews.reviews != 2 {
+		t.Errorf("Error in review cache: expected 2 reviews, got %d\n", reviews.reviews)
+	}
+}
+
+// Check basic and bearer auth against a credentials file, and its reload
+func TestStaticAuthMiddleware(t *testing.T) {
+
+	path := writeTestFile(t, `{
+		"users": [{"username": "catalog", "password": "secret"}],
+		"tokens": [{"name": "standalone", "token": "static-token"}]
+	}`)
+	defer os.Remove(path)
+
+	store, err := middleware.NewCredentialStore(path)
+	if err != nil {
+		t.Fatalf("Error loading credentials: %#+v\n", err)
+	}
+
+	sa := middleware.StaticAuthMiddleware{Store: store, AllowBasic: true, AllowBearer: true}
+	handler := sa.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := middleware.UserFromRequest(r)
+		w.Write([]byte(user.Username))
+	}))
+
+	call := func(setAuth func(r *http.Request)) (int, string) {
+		request := httptest.NewRequest("GET", "/v2/catalog", nil)
+		setAuth(request)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code, recorder.Body.String()
+	}
+	basic := func(username, password string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(username, password) }
+	}
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	if code, user := call(basic("catalog", "secret")); code != http.StatusOK || user != "catalog" {
+		t.Errorf("Error on valid basic auth: got %d %q\n", code, user)
+	}
+	if code, _ := call(basic("catalog", "wrong")); code != http.StatusUnauthorized {
+		t.Errorf("Error on invalid basic auth: expected 401, got %d\n", code)
+	}
+	if code, user := call(bearer("static-token")); code != http.StatusOK || user != "standalone" {
+		t.Errorf("Error on valid bearer token: got %d %q\n", code, user)
+	}
+	if code, _ := call(bearer("other-token")); code != http.StatusUnauthorized {
+		t.Errorf("Error on invalid bearer token: expected 401, got %d\n", code)
+	}
+	if code, _ := call(func(r *http.Request) {}); code != http.StatusUnauthorized {
+		t.Errorf("Error on missing credentials: expected 401, got %d\n", code)
+	}
+
+	// Rotate the password
+	ioutil.WriteFile(path, []byte(`{"users": [{"username": "catalog", "password": "rotated"}]}`), 0600)
+	if err = store.Reload(); err != nil {
+		t.Fatalf("Error reloading credentials: %#+v\n", err)
+	}
+
+	if code, _ := call(basic("catalog", "secret")); code != http.StatusUnauthorized {
+		t.Errorf("Error on old password after reload: expected 401, got %d\n", code)
+	}
+	if code, _ := call(basic("catalog", "rotated")); code != http.StatusOK {
+		t.Errorf("Error on new password after reload: expected 200, got %d\n", code)
+	}
+}
@@ -0,0 +1,149 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// Check the open-dataset service resolves persistent identifiers on the
+// whitelisted servers, checking access with the token, and follows updates of
+// the version
+func TestOpenDataset(t *testing.T) {
+
+	server := newFakeDataverse(map[string]http.HandlerFunc{
+		"/api/datasets/:persistentId/": func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Query().Get("persistentId") {
+			case "doi:10.5072/FK2/OPEN":
+				writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": map[string]interface{}{
+					"id":            12,
+					"persistentUrl": "https://doi.org/10.5072/FK2/OPEN",
+					"latestVersion": map[string]interface{}{
+						"versionState":       "RELEASED",
+						"versionNumber":      2,
+						"versionMinorNumber": 1,
+						"metadataBlocks": map[string]interface{}{"citation": map[string]interface{}{"fields": []interface{}{
+							map[string]interface{}{"typeName": "title", "value": "Open data"},
+						}}},
+					},
+				}})
+			case "hdl:1902.1/SECRET":
+				if r.Header.Get("X-Dataverse-key") == "secret-token" {
+					writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": map[string]interface{}{
+						"id":            13,
+						"latestVersion": map[string]interface{}{"versionState": "DRAFT"},
+					}})
+					return
+				}
+				writeDataverseJSON(w, http.StatusUnauthorized, map[string]interface{}{"status": "ERROR", "message": "You are not permitted to view this dataset"})
+			case "doi:10.5072/FK2/BROKEN":
+				writeDataverseJSON(w, http.StatusInternalServerError, map[string]interface{}{"status": "ERROR", "message": "Internal error"})
+			default:
+				writeDataverseJSON(w, http.StatusNotFound, map[string]interface{}{"status": "ERROR", "message": "Dataset not found"})
+			}
+		},
+		"/api/datasets/:persistentId/versions/:latest-published/files": func(w http.ResponseWriter, r *http.Request) {
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": []interface{}{}})
+		},
+		"/api/datasets/:persistentId/versions/1.0": func(w http.ResponseWriter, r *http.Request) {
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": map[string]interface{}{
+				"versionState": "RELEASED", "versionNumber": 1, "versionMinorNumber": 0,
+			}})
+		},
+	})
+	defer server.Close()
+
+	businessLogic, cleanup := newTestBroker(t, server.URL, logic.Options{})
+	defer cleanup()
+
+	catalog, err := businessLogic.GetCatalog(&broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on GetCatalog: %#+v\n", err)
+	}
+	var serviceID, planID string
+	for _, service := range catalog.Services {
+		if service.Name == "open-dataset" {
+			serviceID, planID = service.ID, service.Plans[0].ID
+		}
+	}
+	if serviceID == "" {
+		t.Fatalf("Error in catalog: no open-dataset service\n")
+	}
+
+	provision := func(instanceID string, params map[string]interface{}) error {
+		_, err := businessLogic.Provision(&osb.ProvisionRequest{
+			InstanceID: instanceID,
+			ServiceID:  serviceID,
+			PlanID:     planID,
+			Parameters: params,
+		}, &broker.RequestContext{})
+		return err
+	}
+
+	if err = provision("open0", map[string]interface{}{"pid": "10.5072/FK2/OPEN"}); !isStatusError(err, http.StatusBadRequest) {
+		t.Errorf("Error on Provision with invalid identifier: expected 400, got %#+v\n", err)
+	}
+	if err = provision("open0", map[string]interface{}{"pid": "doi:10.5072/FK2/MISSING"}); !isStatusError(err, http.StatusBadRequest) {
+		t.Errorf("Error on Provision with unknown identifier: expected 400, got %#+v\n", err)
+	}
+	if err = provision("open0", map[string]interface{}{"pid": "doi:10.5072/FK2/BROKEN"}); !isStatusError(err, http.StatusBadGateway) {
+		t.Errorf("Error on Provision when the server fails: expected 502, got %#+v\n", err)
+	}
+	if err = provision("open0", map[string]interface{}{"pid": "hdl:1902.1/SECRET"}); !isStatusError(err, http.StatusForbidden) {
+		t.Errorf("Error on Provision without access: expected 403, got %#+v\n", err)
+	}
+
+	params := map[string]interface{}{"pid": "https://doi.org/10.5072/FK2/OPEN"}
+	if err = provision("open1", params); err != nil {
+		t.Fatalf("Error on Provision: %#+v\n", err)
+	}
+	if err = provision("open1", params); err != nil {
+		t.Errorf("Error on Provision with instance that already exists: %#+v\n", err)
+	}
+	if err = provision("open2", map[string]interface{}{"pid": "hdl:1902.1/SECRET", "credentials": "secret-token"}); err != nil {
+		t.Errorf("Error on Provision with token: %#+v\n", err)
+	}
+
+	adminInstance := func(instanceID string) logic.AdminInstance {
+		recorder := httptest.NewRecorder()
+		businessLogic.AdminHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/instances/"+instanceID, nil))
+		instance := logic.AdminInstance{}
+		json.Unmarshal(recorder.Body.Bytes(), &instance)
+		return instance
+	}
+	if instance := adminInstance("open1"); instance.Dataset != "doi:10.5072/FK2/OPEN" || instance.DatasetVersion != "2.1" || instance.ServerUrl != server.URL {
+		t.Errorf("Error in instance: expected dataset, version and server, got %#+v\n", instance)
+	}
+
+	response, err := businessLogic.Bind(&osb.BindRequest{
+		BindingID:  "open-binding1",
+		InstanceID: "open1",
+		ServiceID:  serviceID,
+		PlanID:     planID,
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Bind: %#+v\n", err)
+	}
+	if response.Credentials["dataset"] != "doi:10.5072/FK2/OPEN" || response.Credentials["server_url"] != server.URL ||
+		response.Credentials["coordinates"] != "https://doi.org/10.5072/FK2/OPEN" {
+		t.Errorf("Error in credentials: %#+v\n", response.Credentials)
+	}
+
+	// Pinning the instance to another version
+	_, err = businessLogic.Update(&osb.UpdateInstanceRequest{
+		InstanceID: "open1",
+		ServiceID:  serviceID,
+		Parameters: map[string]interface{}{"version": "1.0"},
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Update: %#+v\n", err)
+	}
+	if instance := adminInstance("open1"); instance.DatasetVersion != "1.0" {
+		t.Errorf("Error in instance after Update: expected version 1.0, got %#+v\n", instance)
+	}
+}
@@ -0,0 +1,237 @@
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+const (
+	testDatasetServiceID = "5c1e5e2d-8f0b-4d43-9a07-3e2b7d1c6f11"
+	testDatasetPlanID    = "9d3c2b1a-6e5f-4a3b-8c2d-1e0f9a8b7c12"
+	testDatasetPID       = "doi:10.5072/FK2/PIN"
+)
+
+// fakeDatasetVersions answers the version and file listing calls for the
+// versions of the test dataset
+func fakeDatasetVersions(w http.ResponseWriter, r *http.Request) {
+	versions := map[string]map[string]interface{}{
+		"1.0":               {"versionState": "RELEASED", "versionNumber": 1, "versionMinorNumber": 0},
+		"1.1":               {"versionState": "RELEASED", "versionNumber": 1, "versionMinorNumber": 1},
+		":latest-published": {"versionState": "RELEASED", "versionNumber": 1, "versionMinorNumber": 1},
+		":draft":            {"versionState": "DRAFT"},
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/datasets/:persistentId/versions/")
+	if strings.HasSuffix(path, "/files") {
+		id := 1
+		if strings.HasPrefix(path, "1.0/") {
+			id = 2
+		}
+		writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": []interface{}{
+			map[string]interface{}{"label": path, "dataFile": map[string]interface{}{"id": id, "filesize": 4}},
+		}})
+		return
+	}
+	version, ok := versions[path]
+	if !ok {
+		writeDataverseJSON(w, http.StatusNotFound, map[string]interface{}{"status": "ERROR", "message": "Version not found"})
+		return
+	}
+	writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": version})
+}
+
+// newDatasetBroker creates a BusinessLogic whose catalog only has the test
+// dataset
+func newDatasetBroker(t *testing.T, serverURL string) (*logic.BusinessLogic, func()) {
+	dir, err := ioutil.TempDir("", "dataverse-broker-test")
+	if err != nil {
+		t.Fatalf("Error creating catalog dir: %#+v\n", err)
+	}
+	data, _ := json.Marshal([]map[string]interface{}{
+		{
+			"id":         "test-dataset",
+			"service_id": testDatasetServiceID,
+			"plan_id":    testDatasetPlanID,
+			"description": map[string]interface{}{
+				"name":      "Test Dataset",
+				"type":      "dataset",
+				"url":       serverURL + "/dataverse/test",
+				"global_id": testDatasetPID,
+			},
+			"server_name": "test",
+			"server_url":  serverURL,
+		},
+	})
+	if err = ioutil.WriteFile(filepath.Join(dir, "dataverses.json"), data, 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Error writing catalog: %#+v\n", err)
+	}
+
+	businessLogic, err := logic.NewBusinessLogic(logic.Options{CatalogPath: dir})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Error on BusinessLogic creation: %#+v\n", err)
+	}
+	return businessLogic, func() { os.RemoveAll(dir) }
+}
+
+// Check dataset instances can be pinned to a version that exists, and their
+// bindings only point to that version
+func TestVersionPinning(t *testing.T) {
+
+	server := newFakeDataverse(map[string]http.HandlerFunc{"/api/datasets/": fakeDatasetVersions})
+	defer server.Close()
+
+	businessLogic, cleanup := newDatasetBroker(t, server.URL)
+	defer cleanup()
+
+	catalog, err := businessLogic.GetCatalog(&broker.RequestContext{})
+	if err != nil || catalog.Services[0].Plans[0].Schemas.ServiceInstance.Update == nil {
+		t.Errorf("Error in catalog: expected an update schema with the version: %#+v %#+v\n", catalog, err)
+	}
+
+	provision := func(instanceID string, version string) error {
+		_, err := businessLogic.Provision(&osb.ProvisionRequest{
+			InstanceID: instanceID,
+			ServiceID:  testDatasetServiceID,
+			PlanID:     testDatasetPlanID,
+			Parameters: map[string]interface{}{"version": version},
+		}, &broker.RequestContext{})
+		return err
+	}
+	bind := func(bindingID string) map[string]interface{} {
+		response, err := businessLogic.Bind(&osb.BindRequest{
+			BindingID:  bindingID,
+			InstanceID: "pinned1",
+			ServiceID:  testDatasetServiceID,
+			PlanID:     testDatasetPlanID,
+		}, &broker.RequestContext{})
+		if err != nil {
+			t.Fatalf("Error on Bind: %#+v\n", err)
+		}
+		return response.Credentials
+	}
+
+	if err = provision("pinned0", "latest"); !isStatusError(err, http.StatusBadRequest) {
+		t.Errorf("Error on Provision with invalid version: expected 400, got %#+v\n", err)
+	}
+	if err = provision("pinned0", "2.0"); !isStatusError(err, http.StatusBadRequest) {
+		t.Errorf("Error on Provision with missing version: expected 400, got %#+v\n", err)
+	}
+	if err = provision("pinned1", ":latest-published"); err != nil {
+		t.Fatalf("Error on Provision: %#+v\n", err)
+	}
+
+	credentials := bind("pinned-binding1")
+	if credentials["version"] != "1.1" ||
+		credentials["coordinates"] != server.URL+"/dataset.xhtml?persistentId=doi%3A10.5072%2FFK2%2FPIN&version=1.1" ||
+		credentials["dataset_url"] != server.URL+"/api/datasets/:persistentId/versions/1.1?persistentId=doi%3A10.5072%2FFK2%2FPIN" {
+		t.Errorf("Error in credentials: expected URLs of version 1.1, got %#+v\n", credentials)
+	}
+	if manifest := toJSON(credentials["manifest"]); !strings.Contains(manifest, `"path":"1.1/files"`) {
+		t.Errorf("Error in manifest: expected the files of version 1.1, got %s\n", manifest)
+	}
+
+	update := func(version string) error {
+		_, err := businessLogic.Update(&osb.UpdateInstanceRequest{
+			InstanceID: "pinned1",
+			ServiceID:  testDatasetServiceID,
+			Parameters: map[string]interface{}{"version": version},
+		}, &broker.RequestContext{})
+		return err
+	}
+	if err = update("3.0"); !isStatusError(err, http.StatusBadRequest) {
+		t.Errorf("Error on Update with missing version: expected 400, got %#+v\n", err)
+	}
+	if err = update("1.0"); err != nil {
+		t.Fatalf("Error on Update: %#+v\n", err)
+	}
+
+	// Publishing is only asynchronous, nothing changes without
+	// accepts_incomplete
+	_, err = businessLogic.Update(&osb.UpdateInstanceRequest{
+		InstanceID: "pinned1",
+		ServiceID:  testDatasetServiceID,
+		Parameters: map[string]interface{}{"version": "1.1", "publish": "major"},
+	}, &broker.RequestContext{})
+	if !isStatusError(err, http.StatusUnprocessableEntity) {
+		t.Errorf("Error on Update publishing without accepts_incomplete: expected 422, got %#+v\n", err)
+	}
+
+	credentials = bind("pinned-binding2")
+	if credentials["version"] != "1.0" || !strings.Contains(toJSON(credentials["manifest"]), `"file_id":2`) {
+		t.Errorf("Error in credentials after Update: expected version 1.0, got %#+v\n", credentials)
+	}
+	if credentials = bind("pinned-binding1"); credentials["version"] != "1.1" {
+		t.Errorf("Error in credentials of existing binding: expected version 1.1, got %#+v\n", credentials)
+	}
+}
+
+// Check bindings can be created while the instance is updated. Run with
+// -race, the data race detector reports bindings reading the instance as it
+// changes.
+func TestBindDuringUpdate(t *testing.T) {
+
+	server := newFakeDataverse(map[string]http.HandlerFunc{"/api/datasets/": fakeDatasetVersions})
+	defer server.Close()
+
+	businessLogic, cleanup := newDatasetBroker(t, server.URL)
+	defer cleanup()
+
+	_, err := businessLogic.Provision(&osb.ProvisionRequest{
+		InstanceID: "pinned1",
+		ServiceID:  testDatasetServiceID,
+		PlanID:     testDatasetPlanID,
+		Parameters: map[string]interface{}{"version": "1.0"},
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Provision: %#+v\n", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			_, err := businessLogic.Update(&osb.UpdateInstanceRequest{
+				InstanceID: "pinned1",
+				ServiceID:  testDatasetServiceID,
+				Parameters: map[string]interface{}{"version": []string{"1.0", "1.1"}[i%2]},
+			}, &broker.RequestContext{})
+			if err != nil && !isStatusError(err, http.StatusUnprocessableEntity) {
+				t.Errorf("Error on Update: %#+v\n", err)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			response, err := businessLogic.Bind(&osb.BindRequest{
+				BindingID:  "binding" + strconv.Itoa(i),
+				InstanceID: "pinned1",
+				ServiceID:  testDatasetServiceID,
+				PlanID:     testDatasetPlanID,
+			}, &broker.RequestContext{})
+			if err != nil {
+				// Updates in progress refuse bindings
+				if !isStatusError(err, http.StatusUnprocessableEntity) {
+					t.Errorf("Error on Bind: %#+v\n", err)
+				}
+				return
+			}
+			if version := response.Credentials["version"]; version != "1.0" && version != "1.1" {
+				t.Errorf("Error in credentials: expected version 1.0 or 1.1, got %#+v\n", version)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,131 @@
+package broker
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	"github.com/dataverse-broker/dataverse-broker/pkg/middleware"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+const testPolicy = `{
+	"filter_catalog": true,
+	"rules": [
+		{
+			"namespaces": ["team-a"],
+			"services": ["` + testServiceID + `"]
+		},
+		{
+			"groups": ["data-admins"],
+			"services": ["*"]
+		}
+	]
+}`
+
+// Check that provisions are allowed only for the namespaces and groups in the policy
+func TestPolicyProvision(t *testing.T) {
+
+	server := newFakeDataverse(nil)
+	defer server.Close()
+
+	policyPath := writeTestFile(t, testPolicy)
+	defer os.Remove(policyPath)
+
+	businessLogic, cleanup := newTestBroker(t, server.URL, logic.Options{PolicyPath: policyPath})
+	defer cleanup()
+
+	// The platform's client is a data admin
+	request := middleware.WithUser(httptest.NewRequest("PUT", "/v2/service_instances/policy", nil), &middleware.UserInfo{
+		Username: "system:serviceaccount:catalog:client",
+		Groups:   []string{"data-admins"},
+	})
+	provision := func(instanceID string, context map[string]interface{}, identity *osb.OriginatingIdentity) error {
+		_, err := businessLogic.Provision(
+			&osb.ProvisionRequest{
+				InstanceID:          instanceID,
+				ServiceID:           testServiceID,
+				PlanID:              testPlanID,
+				Parameters:          map[string]interface{}{},
+				Context:             context,
+				OriginatingIdentity: identity,
+			},
+			&broker.RequestContext{Request: request})
+		return err
+	}
+
+	// Allowed namespace
+	if err := provision("policy1", map[string]interface{}{"platform": "kubernetes", "namespace": "team-a"}, nil); err != nil {
+		t.Errorf("Error on Provision from allowed namespace: %#+v\n", err)
+	}
+
+	// Other namespace
+	err := provision("policy2", map[string]interface{}{"platform": "kubernetes", "namespace": "team-b"}, nil)
+	if httpErr, ok := osb.IsHTTPError(err); !ok || httpErr.StatusCode != http.StatusForbidden {
+		t.Errorf("Error on Provision from other namespace: expected 403, got %#+v\n", err)
+	}
+
+	// Other namespace, but the user is in an allowed group
+	identity := &osb.OriginatingIdentity{
+		Platform: osb.PlatformKubernetes,
+		Value:    `{"username": "alice", "groups": ["data-admins"]}`,
+	}
+	if err := provision("policy3", map[string]interface{}{"platform": "kubernetes", "namespace": "team-b"}, identity); err != nil {
+		t.Errorf("Error on Provision from allowed group: %#+v\n", err)
+	}
+
+	// Users don't get the grants of the platform's client
+	identity.Value = `{"username": "bob", "groups": ["others"]}`
+	err = provision("policy4", nil, identity)
+	if httpErr, ok := osb.IsHTTPError(err); !ok || httpErr.StatusCode != http.StatusForbidden {
+		t.Errorf("Error on Provision from user without access: expected 403, got %#+v\n", err)
+	}
+
+	// Without a user, the client is the subject
+	if err := provision("policy5", nil, nil); err != nil {
+		t.Errorf("Error on Provision from allowed client: %#+v\n", err)
+	}
+}
+
+// Check that the catalog is filtered when the platform sends the originating identity
+func TestPolicyCatalog(t *testing.T) {
+
+	server := newFakeDataverse(nil)
+	defer server.Close()
+
+	policyPath := writeTestFile(t, testPolicy)
+	defer os.Remove(policyPath)
+
+	businessLogic, cleanup := newTestBroker(t, server.URL, logic.Options{PolicyPath: policyPath})
+	defer cleanup()
+
+	catalog := func(identity string) int {
+		request, _ := http.NewRequest("GET", "/v2/catalog", nil)
+		if identity != "" {
+			request.Header.Set(osb.OriginatingIdentityHeader, "kubernetes "+base64.StdEncoding.EncodeToString([]byte(identity)))
+		}
+		response, err := businessLogic.GetCatalog(&broker.RequestContext{Request: request})
+		if err != nil {
+			t.Fatalf("Error on GetCatalog: %#+v\n", err)
+		}
+		return len(response.Services)
+	}
+
+	// No identity, the catalog is not filtered: the dataverse, the generic
+	// service of its server and the open-dataset service
+	if n := catalog(""); n != 3 {
+		t.Errorf("Error on GetCatalog without identity: expected 3 services, got %d\n", n)
+	}
+
+	if n := catalog(`{"username": "bob", "groups": ["others"]}`); n != 0 {
+		t.Errorf("Error on GetCatalog for user without access: expected 0 services, got %d\n", n)
+	}
+
+	if n := catalog(`{"username": "alice", "groups": ["data-admins"]}`); n != 3 {
+		t.Errorf("Error on GetCatalog for user with access: expected 3 services, got %d\n", n)
+	}
+}
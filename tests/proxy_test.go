@@ -0,0 +1,255 @@
+package broker
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// Check files are served from the cache to the binding's token only, and
+// that unbinding revokes it
+func TestDataProxy(t *testing.T) {
+
+	content := "a,b\n1,2\n"
+	sum := md5.Sum([]byte(content))
+	downloads := 0
+
+	server := newFakeDataverse(map[string]http.HandlerFunc{
+		"/api/search": func(w http.ResponseWriter, r *http.Request) {
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{
+				"status": "OK",
+				"data": map[string]interface{}{
+					"items":             []interface{}{map[string]interface{}{"global_id": "doi:10.5072/FK2/ABC", "type": "dataset"}},
+					"count_in_response": 1,
+					"total_count":       1,
+				},
+			})
+		},
+		"/api/datasets/": func(w http.ResponseWriter, r *http.Request) {
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{
+				"status": "OK",
+				"data": []interface{}{
+					map[string]interface{}{"label": "a.csv", "dataFile": map[string]interface{}{
+						"id": 1, "contentType": "text/csv", "filesize": len(content),
+						"checksum": map[string]interface{}{"type": "MD5", "value": hex.EncodeToString(sum[:])},
+					}},
+					map[string]interface{}{"label": "corrupt.csv", "dataFile": map[string]interface{}{
+						"id": 2, "contentType": "text/csv", "filesize": len(content),
+						"checksum": map[string]interface{}{"type": "MD5", "value": "0"},
+					}},
+				},
+			})
+		},
+		"/api/access/datafile/": func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Dataverse-key") != "secret-token" {
+				t.Errorf("Error in download: the Dataverse token wasn't sent\n")
+			}
+			downloads++
+			w.Write([]byte(content))
+		},
+	})
+	defer server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "dataverse-broker-cache")
+	if err != nil {
+		t.Fatalf("Error creating cache dir: %#+v\n", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	businessLogic, cleanup := newTestBroker(t, server.URL, logic.Options{
+		ProxyURL:      "https://proxy.example.com",
+		ProxyCacheDir: cacheDir,
+	})
+	defer cleanup()
+
+	_, err = businessLogic.Provision(&osb.ProvisionRequest{
+		InstanceID: "proxy1",
+		ServiceID:  testServiceID,
+		PlanID:     testPlanID,
+		Parameters: map[string]interface{}{"credentials": "secret-token"},
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Provision: %#+v\n", err)
+	}
+
+	response, err := businessLogic.Bind(&osb.BindRequest{
+		BindingID:  "proxy-binding1",
+		InstanceID: "proxy1",
+		ServiceID:  testServiceID,
+		PlanID:     testPlanID,
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Bind: %#+v\n", err)
+	}
+
+	if _, ok := response.Credentials["credentials"]; ok {
+		t.Errorf("Error in credentials: the Dataverse token was given to the binding\n")
+	}
+	if response.Credentials["proxy_url"] != "https://proxy.example.com/data/proxy-binding1" {
+		t.Errorf("Error in credentials: %#+v\n", response.Credentials)
+	}
+	manifest := waitForManifest(t, businessLogic, "proxy1", "proxy-binding1")
+	if manifest.Files[0].DownloadURL != "https://proxy.example.com/data/proxy-binding1/files/1" {
+		t.Errorf("Error in manifest: download url %s\n", manifest.Files[0].DownloadURL)
+	}
+
+	proxy := businessLogic.ProxyHandler()
+	get := func(path string, token string, header map[string]string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		for k, v := range header {
+			request.Header.Set(k, v)
+		}
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, request)
+		return recorder
+	}
+	token := response.Credentials["proxy_token"].(string)
+
+	if code := get("/data/proxy-binding1/files/1", "wrong", nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("Error with wrong token: expected 401, got %d\n", code)
+	}
+
+	for i := 0; i < 2; i++ {
+		recorder := get("/data/proxy-binding1/files/1", token, nil)
+		if recorder.Code != http.StatusOK || recorder.Body.String() != content {
+			t.Errorf("Error getting file: %d %q\n", recorder.Code, recorder.Body.String())
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("Error in cache: expected 1 download from Dataverse, got %d\n", downloads)
+	}
+
+	recorder := get("/data/proxy-binding1/files/1", token, map[string]string{"Range": "bytes=4-"})
+	if recorder.Code != http.StatusPartialContent || recorder.Body.String() != "1,2\n" {
+		t.Errorf("Error getting range: %d %q\n", recorder.Code, recorder.Body.String())
+	}
+
+	if code := get("/data/proxy-binding1/files/2", token, nil).Code; code != http.StatusBadGateway {
+		t.Errorf("Error getting corrupt file: expected 502, got %d\n", code)
+	}
+	if code := get("/data/proxy-binding1/files/99", token, nil).Code; code != http.StatusNotFound {
+		t.Errorf("Error getting file outside the binding: expected 404, got %d\n", code)
+	}
+
+	businessLogic.Unbind(&osb.UnbindRequest{
+		BindingID:  "proxy-binding1",
+		InstanceID: "proxy1",
+		ServiceID:  testServiceID,
+		PlanID:     testPlanID,
+	}, &broker.RequestContext{})
+
+	if code := get("/data/proxy-binding1/files/1", token, nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("Error after Unbind: expected 401, got %d\n", code)
+	}
+}
+
+// Check files evicted while being served are still served in full, with a
+// cache that only holds one of them
+func TestProxyCacheEviction(t *testing.T) {
+
+	contents := map[string]string{
+		"1": strings.Repeat("a", 700*1024),
+		"2": strings.Repeat("b", 700*1024),
+	}
+
+	server := newFakeDataverse(map[string]http.HandlerFunc{
+		"/api/search": func(w http.ResponseWriter, r *http.Request) {
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{
+				"status": "OK",
+				"data": map[string]interface{}{
+					"items":             []interface{}{map[string]interface{}{"global_id": "doi:10.5072/FK2/ABC", "type": "dataset"}},
+					"count_in_response": 1,
+					"total_count":       1,
+				},
+			})
+		},
+		"/api/datasets/": func(w http.ResponseWriter, r *http.Request) {
+			files := make([]interface{}, 0, len(contents))
+			for id, content := range contents {
+				sum := md5.Sum([]byte(content))
+				files = append(files, map[string]interface{}{"label": id + ".txt", "dataFile": map[string]interface{}{
+					"id": json.Number(id), "filesize": len(content),
+					"checksum": map[string]interface{}{"type": "MD5", "value": hex.EncodeToString(sum[:])},
+				}})
+			}
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": files})
+		},
+		"/api/access/datafile/": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(contents[strings.TrimPrefix(r.URL.Path, "/api/access/datafile/")]))
+		},
+	})
+	defer server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "dataverse-broker-cache")
+	if err != nil {
+		t.Fatalf("Error creating cache dir: %#+v\n", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	businessLogic, cleanup := newTestBroker(t, server.URL, logic.Options{
+		ProxyURL:        "https://proxy.example.com",
+		ProxyCacheDir:   cacheDir,
+		ProxyCacheMaxMB: 1,
+	})
+	defer cleanup()
+
+	limits := logic.DefaultBackendConfig.Default
+	limits.RequestsPerSecond = 0
+	logic.ConfigureBackends(logic.BackendConfig{
+		Default: logic.DefaultBackendConfig.Default,
+		Servers: map[string]logic.BackendLimits{server.URL: limits},
+	})
+	defer logic.ConfigureBackends(logic.DefaultBackendConfig)
+
+	_, err = businessLogic.Provision(&osb.ProvisionRequest{
+		InstanceID: "evict1",
+		ServiceID:  testServiceID,
+		PlanID:     testPlanID,
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Provision: %#+v\n", err)
+	}
+	response, err := businessLogic.Bind(&osb.BindRequest{
+		BindingID:  "evict-binding1",
+		InstanceID: "evict1",
+		ServiceID:  testServiceID,
+		PlanID:     testPlanID,
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Bind: %#+v\n", err)
+	}
+	token := response.Credentials["proxy_token"].(string)
+	waitForManifest(t, businessLogic, "evict1", "evict-binding1")
+
+	proxy := businessLogic.ProxyHandler()
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			request := httptest.NewRequest("GET", "/data/evict-binding1/files/"+id, nil)
+			request.Header.Set("Authorization", "Bearer "+token)
+			recorder := httptest.NewRecorder()
+			proxy.ServeHTTP(recorder, request)
+			if recorder.Code != http.StatusOK || recorder.Body.String() != contents[id] {
+				t.Errorf("Error getting file %s while evicting: %d, %d bytes\n", id, recorder.Code, recorder.Body.Len())
+			}
+		}(strconv.Itoa(i%2 + 1))
+	}
+	wg.Wait()
+}
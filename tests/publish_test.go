@@ -0,0 +1,168 @@
+package broker
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// Check publishing a deposit through Update stays in progress until the
+// dataset locks clear, is refused while the dataset is locked, and reports
+// the message of Dataverse when it fails
+func TestPublishDataset(t *testing.T) {
+
+	var mutex sync.Mutex
+	count := 0
+	published := make([]string, 0)
+	// Lock checks left before the locks of each dataset clear
+	locked := map[string]int{}
+	versions := map[string]map[string]interface{}{}
+
+	ok := func(w http.ResponseWriter, data interface{}) {
+		writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": data})
+	}
+
+	server := newFakeDataverse(map[string]http.HandlerFunc{
+		"/api/dataverses/test/datasets": func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			count++
+			pid := "doi:10.5072/FK2/PUB" + strconv.Itoa(count)
+			versions[pid] = map[string]interface{}{"versionState": "DRAFT"}
+			mutex.Unlock()
+			writeDataverseJSON(w, http.StatusCreated, map[string]interface{}{
+				"status": "OK",
+				"data":   map[string]interface{}{"id": count, "persistentId": pid},
+			})
+		},
+		"/api/datasets/": func(w http.ResponseWriter, r *http.Request) {
+			pid := r.URL.Query().Get("persistentId")
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/actions/:publish"):
+				if pid == "doi:10.5072/FK2/PUB2" {
+					writeDataverseJSON(w, http.StatusForbidden, map[string]interface{}{"status": "ERROR", "message": "User is not allowed to publish"})
+					return
+				}
+				published = append(published, pid+" "+r.URL.Query().Get("type"))
+				locked[pid] = 2
+				writeDataverseJSON(w, http.StatusAccepted, map[string]interface{}{"status": "OK", "data": map[string]interface{}{}})
+			case strings.HasSuffix(r.URL.Path, "/locks"):
+				if locked[pid] == 0 {
+					if len(published) > 0 {
+						versions[pid] = map[string]interface{}{"versionState": "RELEASED", "versionNumber": 1, "versionMinorNumber": 0}
+					}
+					ok(w, []interface{}{})
+					return
+				}
+				locked[pid]--
+				ok(w, []interface{}{map[string]interface{}{"lockType": "finalizePublication", "user": "jane"}})
+			case strings.HasSuffix(r.URL.Path, "/versions/:latest"):
+				ok(w, versions[pid])
+			default:
+				ok(w, []interface{}{})
+			}
+		},
+	})
+	defer server.Close()
+
+	businessLogic, cleanup := newTestBroker(t, server.URL, logic.Options{})
+	defer cleanup()
+
+	provision := func(instanceID string, planID string, params map[string]interface{}) {
+		_, err := businessLogic.Provision(&osb.ProvisionRequest{
+			InstanceID: instanceID,
+			ServiceID:  testServiceID,
+			PlanID:     planID,
+			Parameters: params,
+		}, &broker.RequestContext{})
+		if err != nil {
+			t.Fatalf("Error on Provision: %#+v\n", err)
+		}
+	}
+	params := map[string]interface{}{
+		"credentials": "secret-token",
+		"title":       "Measurements",
+		"authors":     "Doe, Jane",
+		"description": "Raw measurements",
+		"subject":     "Physics",
+	}
+	provision("publish1", testPlanID+"-deposit", params)
+	provision("publish2", testPlanID+"-deposit", params)
+	provision("publish3", testPlanID, map[string]interface{}{"credentials": "secret-token"})
+
+	update := func(instanceID string, publish interface{}, acceptsIncomplete bool) (*broker.UpdateInstanceResponse, error) {
+		return businessLogic.Update(&osb.UpdateInstanceRequest{
+			InstanceID:        instanceID,
+			ServiceID:         testServiceID,
+			AcceptsIncomplete: acceptsIncomplete,
+			Parameters:        map[string]interface{}{"publish": publish},
+		}, &broker.RequestContext{})
+	}
+
+	if _, err := update("publish1", "major", false); !isStatusError(err, http.StatusUnprocessableEntity) {
+		t.Errorf("Error on Update without accepts_incomplete: expected 422, got %#+v\n", err)
+	}
+	if _, err := update("publish1", "patch", true); !isStatusError(err, http.StatusBadRequest) {
+		t.Errorf("Error on Update with unknown version type: expected 400, got %#+v\n", err)
+	}
+	if _, err := update("publish3", "major", true); !isStatusError(err, http.StatusBadRequest) {
+		t.Errorf("Error on Update of a dataverse: expected 400, got %#+v\n", err)
+	}
+
+	response, err := update("publish1", "major", true)
+	if err != nil {
+		t.Fatalf("Error on Update: %#+v\n", err)
+	}
+	if !response.Async || response.OperationKey == nil || *response.OperationKey != "publish" {
+		t.Errorf("Error on Update: expected asynchronous publish operation, got %#+v\n", response)
+	}
+	if _, err = update("publish1", "minor", true); !isStatusError(err, http.StatusUnprocessableEntity) {
+		t.Errorf("Error on Update while publishing: expected 422, got %#+v\n", err)
+	}
+
+	last, err := waitForOperation(t, businessLogic, "publish1")
+	if err != nil || last.State != osb.StateSucceeded || last.Description == nil || *last.Description != "Published version 1.0" {
+		t.Errorf("Error on LastOperation after publishing: %#+v %#+v\n", last, err)
+	}
+	mutex.Lock()
+	if locked["doi:10.5072/FK2/PUB1"] != 0 {
+		t.Errorf("Error on LastOperation: succeeded before the dataset locks cleared\n")
+	}
+	if len(published) != 1 || published[0] != "doi:10.5072/FK2/PUB1 major" {
+		t.Errorf("Error on Update: unexpected datasets published: %v\n", published)
+	}
+	mutex.Unlock()
+
+	// Locked datasets aren't published, not even in the background
+	mutex.Lock()
+	locked["doi:10.5072/FK2/PUB2"] = 1
+	mutex.Unlock()
+	if _, err = update("publish2", "minor", true); !isStatusError(err, http.StatusUnprocessableEntity) {
+		t.Errorf("Error on Update of a locked dataset: expected 422, got %#+v\n", err)
+	}
+	if last, err = businessLogic.LastOperation(&osb.LastOperationRequest{InstanceID: "publish2"}, &broker.RequestContext{}); err != nil || last.State != osb.StateSucceeded {
+		t.Errorf("Error on LastOperation after refused publishing: expected no operation, got %#+v %#+v\n", last, err)
+	}
+
+	if _, err = update("publish2", "minor", true); err != nil {
+		t.Fatalf("Error on Update: %#+v\n", err)
+	}
+	last, err = waitForOperation(t, businessLogic, "publish2")
+	if err != nil || last.State != osb.StateFailed || last.Description == nil || *last.Description != "User is not allowed to publish" {
+		t.Errorf("Error on LastOperation after failed publishing: %#+v %#+v\n", last, err)
+	}
+}
+
+// isStatusError tells if err is an HTTPStatusCodeError with the status code
+func isStatusError(err error, status int) bool {
+	httpErr, ok := err.(osb.HTTPStatusCodeError)
+	return ok && httpErr.StatusCode == status
+}
@@ -0,0 +1,145 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// Check the role-grant plan assigns, changes and revokes roles the dataverse
+// defines, or the built-in ones when the root dataverse's can't be listed
+func TestRoleGrantPlan(t *testing.T) {
+
+	var mutex sync.Mutex
+	events := make([]string, 0)
+	nextID := 10
+
+	roles := func(aliases ...string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			data := make([]interface{}, 0)
+			for _, alias := range aliases {
+				data = append(data, map[string]interface{}{"alias": alias, "name": alias})
+			}
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": data})
+		}
+	}
+
+	server := newFakeDataverse(map[string]http.HandlerFunc{
+		"/api/dataverses/:root/roles": func(w http.ResponseWriter, r *http.Request) {
+			// Only admins of the root dataverse may list its roles
+			if r.Header.Get("X-Dataverse-key") != "root-token" {
+				writeDataverseJSON(w, http.StatusUnauthorized, map[string]interface{}{"status": "ERROR", "message": "Not authorized"})
+				return
+			}
+			roles("admin", "curator", "member", "steward")(w, r)
+		},
+		"/api/dataverses/test/roles": roles("reviewer"),
+		"/api/dataverses/test/assignments": func(w http.ResponseWriter, r *http.Request) {
+			assignment := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&assignment)
+
+			mutex.Lock()
+			nextID++
+			id := nextID
+			events = append(events, "assign "+assignment["role"].(string)+" to "+assignment["assignee"].(string))
+			mutex.Unlock()
+
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": map[string]interface{}{"id": id}})
+		},
+		"/api/dataverses/test/assignments/": func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			events = append(events, r.Method+" "+strings.TrimPrefix(r.URL.Path, "/api/dataverses/test/assignments/"))
+			mutex.Unlock()
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": map[string]interface{}{}})
+		},
+	})
+	defer server.Close()
+
+	businessLogic, cleanup := newTestBroker(t, server.URL, logic.Options{})
+	defer cleanup()
+
+	grantPlanID := testPlanID + "-role-grant"
+	provision := func(instanceID string, params map[string]interface{}) error {
+		_, err := businessLogic.Provision(&osb.ProvisionRequest{
+			InstanceID: instanceID,
+			ServiceID:  testServiceID,
+			PlanID:     grantPlanID,
+			Parameters: params,
+		}, &broker.RequestContext{})
+		return err
+	}
+
+	if err := provision("grant0", map[string]interface{}{"credentials": "secret-token", "assignee": "jane", "role": "curator"}); err == nil {
+		t.Errorf("Error on Provision with invalid assignee: expected error\n")
+	}
+	err := provision("grant0", map[string]interface{}{"credentials": "secret-token", "assignee": "@jane", "role": "superhero"})
+	if httpErr, ok := err.(osb.HTTPStatusCodeError); !ok || httpErr.StatusCode != http.StatusBadRequest ||
+		!strings.Contains(*httpErr.Description, "curator, dsContributor, dvContributor, editor, fileDownloader, fullContributor, member, reviewer") {
+		t.Errorf("Error on Provision with unknown role: expected 400 listing roles, got %#+v\n", err)
+	}
+	err = provision("grant0", map[string]interface{}{"credentials": "secret-token", "assignee": "@jane", "role": "steward"})
+	if !isStatusError(err, http.StatusBadRequest) {
+		t.Errorf("Error on Provision with role of the root dataverse it can't list: expected 400, got %#+v\n", err)
+	}
+	if err = provision("grant2", map[string]interface{}{"credentials": "root-token", "assignee": "@jane", "role": "steward"}); err != nil {
+		t.Errorf("Error on Provision with role of the root dataverse: %#+v\n", err)
+	}
+
+	if err = provision("grant1", map[string]interface{}{"credentials": "secret-token", "assignee": "&team-b", "role": "curator"}); err != nil {
+		t.Fatalf("Error on Provision: %#+v\n", err)
+	}
+
+	_, err = businessLogic.Bind(&osb.BindRequest{
+		BindingID:  "grant-binding1",
+		InstanceID: "grant1",
+		ServiceID:  testServiceID,
+		PlanID:     grantPlanID,
+	}, &broker.RequestContext{})
+	if err == nil {
+		t.Errorf("Error on Bind: expected error for role grant\n")
+	}
+
+	update := func(params map[string]interface{}) error {
+		_, err := businessLogic.Update(&osb.UpdateInstanceRequest{
+			InstanceID: "grant1",
+			ServiceID:  testServiceID,
+			Parameters: params,
+		}, &broker.RequestContext{})
+		return err
+	}
+	if err = update(map[string]interface{}{"role": "reviewer"}); err != nil {
+		t.Errorf("Error on Update: %#+v\n", err)
+	}
+	if err = update(map[string]interface{}{"role": "superhero"}); err == nil {
+		t.Errorf("Error on Update with unknown role: expected error\n")
+	}
+	if err = update(map[string]interface{}{"assignee": "@john"}); err == nil {
+		t.Errorf("Error on Update of assignee: expected error\n")
+	}
+
+	_, err = businessLogic.Deprovision(&osb.DeprovisionRequest{
+		InstanceID: "grant1",
+		ServiceID:  testServiceID,
+		PlanID:     grantPlanID,
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Errorf("Error on Deprovision: %#+v\n", err)
+	}
+
+	expected := []string{
+		"assign steward to @jane",
+		"assign curator to &team-b",
+		"assign reviewer to &team-b",
+		"DELETE 12",
+		"DELETE 13",
+	}
+	if strings.Join(events, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Error in Dataverse calls: expected\n%s\ngot\n%s\n", strings.Join(expected, "\n"), strings.Join(events, "\n"))
+	}
+}
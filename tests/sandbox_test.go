@@ -0,0 +1,175 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// waitForOperation polls LastOperation until the operation on the instance
+// is no longer in progress
+func waitForOperation(t *testing.T, businessLogic *logic.BusinessLogic, instanceID string) (*broker.LastOperationResponse, error) {
+	for i := 0; i < 200; i++ {
+		response, err := businessLogic.LastOperation(&osb.LastOperationRequest{
+			InstanceID: instanceID,
+		}, &broker.RequestContext{})
+		if err != nil || response.State != osb.StateInProgress {
+			return response, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Error on LastOperation: operation on %q still in progress\n", instanceID)
+	return nil, nil
+}
+
+// Check the sandbox plan creates a child dataverse in the background, and
+// only deletes it when empty
+func TestSandboxPlan(t *testing.T) {
+
+	var mutex sync.Mutex
+	created := make([]map[string]interface{}, 0)
+	deleted := make([]string, 0)
+	contents := []interface{}{map[string]interface{}{"type": "dataset", "id": 1}}
+
+	server := newFakeDataverse(map[string]http.HandlerFunc{
+		"/api/dataverses/test": func(w http.ResponseWriter, r *http.Request) {
+			body := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&body)
+			if r.Method != "POST" || r.Header.Get("X-Dataverse-key") != "secret-token" {
+				writeDataverseJSON(w, http.StatusForbidden, map[string]interface{}{"status": "ERROR", "message": "Not allowed to create dataverses"})
+				return
+			}
+
+			mutex.Lock()
+			created = append(created, body)
+			mutex.Unlock()
+
+			writeDataverseJSON(w, http.StatusCreated, map[string]interface{}{
+				"status": "OK",
+				"data":   map[string]interface{}{"id": 7, "alias": body["alias"]},
+			})
+		},
+		"/api/dataverses/": func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if r.Method == "DELETE" {
+				deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/api/dataverses/"))
+				writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": map[string]interface{}{}})
+				return
+			}
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": contents})
+		},
+	})
+	defer server.Close()
+
+	businessLogic, cleanup := newTestBroker(t, server.URL, logic.Options{})
+	defer cleanup()
+
+	sandboxPlanID := testPlanID + "-sandbox"
+	params := map[string]interface{}{
+		"credentials": "secret-token",
+		"contacts":    []interface{}{"team@example.com"},
+		"name":        "Team sandbox",
+	}
+	provision := func(instanceID string, params map[string]interface{}, acceptsIncomplete bool) (*broker.ProvisionResponse, error) {
+		return businessLogic.Provision(&osb.ProvisionRequest{
+			InstanceID:        instanceID,
+			ServiceID:         testServiceID,
+			PlanID:            sandboxPlanID,
+			Parameters:        params,
+			AcceptsIncomplete: acceptsIncomplete,
+		}, &broker.RequestContext{})
+	}
+	deprovision := func(instanceID string) (*broker.DeprovisionResponse, error) {
+		return businessLogic.Deprovision(&osb.DeprovisionRequest{
+			InstanceID:        instanceID,
+			ServiceID:         testServiceID,
+			PlanID:            sandboxPlanID,
+			AcceptsIncomplete: true,
+		}, &broker.RequestContext{})
+	}
+
+	if _, err := provision("sandbox1", params, false); !osb.IsAsyncRequiredError(err) {
+		t.Errorf("Error on synchronous Provision: expected AsyncRequired, got %#+v\n", err)
+	}
+	if _, err := provision("sandbox1", map[string]interface{}{"credentials": "secret-token"}, true); err == nil {
+		t.Errorf("Error on Provision without contacts: expected error\n")
+	}
+
+	response, err := provision("sandbox1", params, true)
+	if err != nil {
+		t.Fatalf("Error on Provision: %#+v\n", err)
+	}
+	if !response.Async || response.OperationKey == nil {
+		t.Errorf("Error on Provision: expected asynchronous response, got %#+v\n", response)
+	}
+	if last, err := waitForOperation(t, businessLogic, "sandbox1"); err != nil || last.State != osb.StateSucceeded {
+		t.Fatalf("Error on LastOperation after Provision: %#+v %#+v\n", last, err)
+	}
+	if len(created) != 1 || created[0]["alias"] != "sandbox-sandbox1" || created[0]["name"] != "Team sandbox" {
+		t.Errorf("Error on Provision: unexpected dataverses created: %v\n", created)
+	}
+
+	bindResponse, err := businessLogic.Bind(&osb.BindRequest{
+		BindingID:  "sandbox-binding1",
+		InstanceID: "sandbox1",
+		ServiceID:  testServiceID,
+		PlanID:     sandboxPlanID,
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Bind: %#+v\n", err)
+	}
+	if bindResponse.Credentials["dataverse"] != "sandbox-sandbox1" || bindResponse.Credentials["credentials"] != "secret-token" {
+		t.Errorf("Error in credentials: %#+v\n", bindResponse.Credentials)
+	}
+
+	// Not empty, the instance stays
+	if _, err = deprovision("sandbox1"); err != nil {
+		t.Fatalf("Error on Deprovision: %#+v\n", err)
+	}
+	last, err := waitForOperation(t, businessLogic, "sandbox1")
+	if err != nil || last.State != osb.StateFailed || last.Description == nil || !strings.Contains(*last.Description, "not empty") {
+		t.Errorf("Error on LastOperation after Deprovision of non empty sandbox: %#+v %#+v\n", last, err)
+	}
+
+	mutex.Lock()
+	contents = []interface{}{}
+	mutex.Unlock()
+
+	if _, err = deprovision("sandbox1"); err != nil {
+		t.Fatalf("Error on Deprovision: %#+v\n", err)
+	}
+	_, err = waitForOperation(t, businessLogic, "sandbox1")
+	if httpErr, ok := err.(osb.HTTPStatusCodeError); !ok || httpErr.StatusCode != http.StatusGone {
+		t.Errorf("Error on LastOperation after Deprovision: expected 410, got %#+v\n", err)
+	}
+	if len(deleted) != 1 || deleted[0] != "sandbox-sandbox1" {
+		t.Errorf("Error on Deprovision: unexpected deletions %v\n", deleted)
+	}
+
+	// Dataverse refuses to create the sandbox
+	params["credentials"] = "other-token"
+	if _, err = provision("sandbox2", params, true); err != nil {
+		t.Fatalf("Error on Provision: %#+v\n", err)
+	}
+	if last, err = waitForOperation(t, businessLogic, "sandbox2"); err != nil || last.State != osb.StateFailed {
+		t.Errorf("Error on LastOperation after failed Provision: %#+v %#+v\n", last, err)
+	}
+	_, err = businessLogic.Bind(&osb.BindRequest{
+		BindingID:  "sandbox-binding2",
+		InstanceID: "sandbox2",
+		ServiceID:  testServiceID,
+		PlanID:     sandboxPlanID,
+	}, &broker.RequestContext{})
+	if httpErr, ok := err.(osb.HTTPStatusCodeError); !ok || httpErr.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Error on Bind to failed sandbox: expected 422, got %#+v\n", err)
+	}
+}
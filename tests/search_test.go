@@ -0,0 +1,136 @@
+package broker
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// Check the search plan validates its query by running it, and bindings get
+// the search endpoint, its results and the files of the datasets found
+func TestSearchPlan(t *testing.T) {
+
+	var mutex sync.Mutex
+	queries := make([]string, 0)
+
+	server := newFakeDataverse(map[string]http.HandlerFunc{
+		"/api/search": func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			mutex.Lock()
+			queries = append(queries, r.URL.RawQuery)
+			mutex.Unlock()
+
+			if query.Get("subtree") == "missing" {
+				writeDataverseJSON(w, http.StatusBadRequest, map[string]interface{}{"status": "ERROR", "message": "Could not find dataverse with alias missing"})
+				return
+			}
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{
+				"status": "OK",
+				"data": map[string]interface{}{
+					"q":                 query.Get("q"),
+					"total_count":       3,
+					"count_in_response": 3,
+					"items": []interface{}{
+						map[string]interface{}{"name": "Soil samples", "type": "dataset", "global_id": "doi:10.5072/FK2/SOIL"},
+						map[string]interface{}{"name": "Field notes", "type": "dataverse", "identifier": "notes"},
+						map[string]interface{}{"name": "Deaccessioned", "type": "dataset", "global_id": "doi:10.5072/FK2/GONE"},
+					},
+				},
+			})
+		},
+		"/api/datasets/:persistentId/versions/:latest-published/files": func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("persistentId") == "doi:10.5072/FK2/GONE" {
+				writeDataverseJSON(w, http.StatusNotFound, map[string]interface{}{"status": "ERROR", "message": "Dataset not found"})
+				return
+			}
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{"status": "OK", "data": []interface{}{
+				map[string]interface{}{"label": "ph.csv", "dataFile": map[string]interface{}{"id": 7, "filesize": 12}},
+			}})
+		},
+	})
+	defer server.Close()
+
+	businessLogic, cleanup := newTestBroker(t, server.URL, logic.Options{})
+	defer cleanup()
+
+	searchPlanID := testPlanID + "-search"
+	provision := func(instanceID string, params map[string]interface{}) error {
+		_, err := businessLogic.Provision(&osb.ProvisionRequest{
+			InstanceID: instanceID,
+			ServiceID:  testServiceID,
+			PlanID:     searchPlanID,
+			Parameters: params,
+		}, &broker.RequestContext{})
+		return err
+	}
+
+	if err := provision("search0", map[string]interface{}{"type": "collection"}); !isStatusError(err, http.StatusBadRequest) {
+		t.Errorf("Error on Provision with unknown type: expected 400, got %#+v\n", err)
+	}
+	if err := provision("search0", map[string]interface{}{"sort": "size"}); !isStatusError(err, http.StatusBadRequest) {
+		t.Errorf("Error on Provision with unknown sort: expected 400, got %#+v\n", err)
+	}
+	err := provision("search0", map[string]interface{}{"subtree": "missing"})
+	if httpErr, ok := err.(osb.HTTPStatusCodeError); !ok || httpErr.StatusCode != http.StatusBadRequest ||
+		!strings.Contains(*httpErr.Description, "missing") {
+		t.Errorf("Error on Provision with query Dataverse rejects: expected 400, got %#+v\n", err)
+	}
+
+	params := map[string]interface{}{
+		"q":     "soil",
+		"type":  []interface{}{"dataset", "dataverse"},
+		"fq":    "subject_ss:Earth",
+		"sort":  "date",
+		"order": "desc",
+	}
+	if err = provision("search1", params); err != nil {
+		t.Fatalf("Error on Provision: %#+v\n", err)
+	}
+	if err = provision("search1", params); err != nil {
+		t.Errorf("Error on Provision with instance that already exists: %#+v\n", err)
+	}
+
+	mutex.Lock()
+	searches := len(queries)
+	mutex.Unlock()
+
+	response, err := businessLogic.Bind(&osb.BindRequest{
+		BindingID:  "search-binding1",
+		InstanceID: "search1",
+		ServiceID:  testServiceID,
+		PlanID:     searchPlanID,
+	}, &broker.RequestContext{})
+	if err != nil {
+		t.Fatalf("Error on Bind: %#+v\n", err)
+	}
+
+	expected := server.URL + "/api/search?fq=subject_ss%3AEarth&order=desc&q=soil&sort=date&subtree=test&type=dataset&type=dataverse"
+	if response.Credentials["search_url"] != expected {
+		t.Errorf("Error in search_url: expected %s, got %v\n", expected, response.Credentials["search_url"])
+	}
+	results := toJSON(response.Credentials["search_results"])
+	if !strings.Contains(results, `"total_count":3`) || !strings.Contains(results, "doi:10.5072/FK2/SOIL") {
+		t.Errorf("Error in search_results: %s\n", results)
+	}
+	manifest := waitForManifest(t, businessLogic, "search1", "search-binding1")
+	if !strings.Contains(toJSON(manifest), `"path":"doi-10.5072-FK2-SOIL/ph.csv"`) {
+		t.Errorf("Error in manifest: expected the files of the datasets found, got %s\n", toJSON(manifest))
+	}
+	if !manifest.Incomplete || len(manifest.UnlistedDatasets) != 1 || manifest.UnlistedDatasets[0] != "doi:10.5072/FK2/GONE" {
+		t.Errorf("Error in manifest: expected the dataset Dataverse failed to list, got %s\n", toJSON(manifest))
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(queries) != searches+1 {
+		t.Errorf("Error on Bind: expected a single search, got %d\n", len(queries)-searches)
+	}
+	if last := queries[len(queries)-1]; !strings.HasSuffix(last, "&per_page=1000") {
+		t.Errorf("Error on Bind: expected the first 1000 results, got query %s\n", last)
+	}
+}
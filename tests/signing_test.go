@@ -0,0 +1,249 @@
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+const (
+	testSigningKey1 = "0123456789abcdef0123456789abcdef"
+	testSigningKey2 = "fedcba9876543210fedcba9876543210"
+)
+
+// Check links stay valid across a key rotation, and expire
+func TestURLSigner(t *testing.T) {
+
+	keysPath := writeTestFile(t, `{"current": "k1", "keys": {"k1": "`+testSigningKey1+`"}}`)
+	defer os.Remove(keysPath)
+
+	signer, err := logic.NewURLSigner(keysPath, time.Minute)
+	if err != nil {
+		t.Fatalf("Error on NewURLSigner: %#+v\n", err)
+	}
+
+	verify := func(query string, fileID int) error {
+		values, _ := url.ParseQuery(query)
+		expires, _ := strconv.ParseInt(values.Get("expires"), 10, 64)
+		return signer.Verify("binding1", fileID, expires, values.Get("kid"), values.Get("signature"))
+	}
+
+	old, _ := signer.Sign("binding1", 7)
+	if err = verify(old, 7); err != nil {
+		t.Errorf("Error verifying link: %#+v\n", err)
+	}
+	if err = verify(old, 8); err == nil {
+		t.Errorf("Error verifying link: accepted for another file\n")
+	}
+
+	// Rotate, keeping the old key for links already handed out
+	ioutil.WriteFile(keysPath, []byte(`{"current": "k2", "keys": {"k1": "`+testSigningKey1+`", "k2": "`+testSigningKey2+`"}}`), 0600)
+	if err = signer.Reload(); err != nil {
+		t.Fatalf("Error on Reload: %#+v\n", err)
+	}
+
+	rotated, _ := signer.Sign("binding1", 7)
+	if !strings.Contains(rotated, "kid=k2") {
+		t.Errorf("Error signing link: not signed with the current key: %s\n", rotated)
+	}
+	if verify(old, 7) != nil || verify(rotated, 7) != nil {
+		t.Errorf("Error verifying links after rotation\n")
+	}
+
+	expired, err := logic.NewURLSigner(keysPath, -time.Minute)
+	if err != nil {
+		t.Fatalf("Error on NewURLSigner: %#+v\n", err)
+	}
+	query, _ := expired.Sign("binding1", 7)
+	if err = verify(query, 7); err == nil {
+		t.Errorf("Error verifying link: expired link accepted\n")
+	}
+
+	ioutil.WriteFile(keysPath, []byte(`{"current": "k3", "keys": {"k1": "`+testSigningKey1+`"}}`), 0600)
+	if err = signer.Reload(); err == nil {
+		t.Errorf("Error on Reload: expected error for missing current key\n")
+	}
+}
+
+// Check dataset bindings get signed links which the proxy serves until
+// unbinding, and a token refreshing them, while other bindings use the proxy
+func TestSignedLinks(t *testing.T) {
+
+	content := "signed content\n"
+	server := newFakeDataverse(map[string]http.HandlerFunc{
+		"/api/search": func(w http.ResponseWriter, r *http.Request) {
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{
+				"status": "OK",
+				"data": map[string]interface{}{
+					"items":             []interface{}{map[string]interface{}{"global_id": "doi:10.5072/FK2/ABC", "type": "dataset"}},
+					"count_in_response": 1,
+					"total_count":       1,
+				},
+			})
+		},
+		"/api/datasets/": func(w http.ResponseWriter, r *http.Request) {
+			writeDataverseJSON(w, http.StatusOK, map[string]interface{}{
+				"status": "OK",
+				"data": []interface{}{
+					map[string]interface{}{"label": "a.txt", "dataFile": map[string]interface{}{
+						"id": 1, "contentType": "text/plain", "filesize": len(content),
+					}},
+					map[string]interface{}{"label": "b.txt", "dataFile": map[string]interface{}{
+						"id": 2, "contentType": "text/plain", "filesize": len(content),
+					}},
+				},
+			})
+		},
+		"/api/access/datafile/": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(content))
+		},
+	})
+	defer server.Close()
+
+	keysPath := writeTestFile(t, `{"current": "k1", "keys": {"k1": "`+testSigningKey1+`"}}`)
+	defer os.Remove(keysPath)
+	cacheDir, err := ioutil.TempDir("", "dataverse-broker-cache")
+	if err != nil {
+		t.Fatalf("Error creating cache dir: %#+v\n", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	dir := newTestCatalog(t, server.URL, map[string]interface{}{
+		"id":         "test-dataset",
+		"service_id": testDatasetServiceID,
+		"plan_id":    testDatasetPlanID,
+		"description": map[string]interface{}{
+			"name":      "Test Dataset",
+			"type":      "dataset",
+			"url":       server.URL + "/dataverse/test",
+			"global_id": testDatasetPID,
+		},
+		"server_name": "test",
+		"server_url":  server.URL,
+	})
+	defer os.RemoveAll(dir)
+
+	businessLogic, err := logic.NewBusinessLogic(logic.Options{
+		CatalogPath:      dir,
+		ProxyURL:         "https://proxy.example.com",
+		ProxyCacheDir:    cacheDir,
+		SigningKeysPath:  keysPath,
+		ManifestPageSize: 1,
+	})
+	if err != nil {
+		t.Fatalf("Error on BusinessLogic creation: %#+v\n", err)
+	}
+
+	bind := func(instanceID string, bindingID string, serviceID string, planID string) map[string]interface{} {
+		_, err := businessLogic.Provision(&osb.ProvisionRequest{
+			InstanceID: instanceID,
+			ServiceID:  serviceID,
+			PlanID:     planID,
+			Parameters: map[string]interface{}{"credentials": "secret-token"},
+		}, &broker.RequestContext{})
+		if err != nil {
+			t.Fatalf("Error on Provision: %#+v\n", err)
+		}
+		response, err := businessLogic.Bind(&osb.BindRequest{
+			BindingID:  bindingID,
+			InstanceID: instanceID,
+			ServiceID:  serviceID,
+			PlanID:     planID,
+		}, &broker.RequestContext{})
+		if err != nil {
+			t.Fatalf("Error on Bind: %#+v\n", err)
+		}
+		return response.Credentials
+	}
+
+	credentials := bind("signed1", "signed-binding1", testDatasetServiceID, testDatasetPlanID)
+	_, hasToken := credentials["credentials"]
+	_, hasProxyToken := credentials["proxy_token"]
+	if hasToken || hasProxyToken {
+		t.Errorf("Error in credentials: long lived token given with signed links\n")
+	}
+	manifestToken, _ := credentials["manifest_token"].(string)
+	if manifestToken == "" || credentials["manifest_url"] != "https://proxy.example.com/data/signed-binding1/files" {
+		t.Errorf("Error in credentials: expected a manifest url and token, got %#+v\n", credentials)
+	}
+
+	manifest := waitForManifest(t, businessLogic, "signed1", "signed-binding1")
+	if manifest.ExpiresAt == "" {
+		t.Errorf("Error in manifest: no expiry\n")
+	}
+	if manifest.Next != "https://proxy.example.com/data/signed-binding1/files?start=1&per_page=1" {
+		t.Errorf("Error in manifest: expected the next page on the proxy, got %q\n", manifest.Next)
+	}
+	link, _ := url.Parse(manifest.Files[0].DownloadURL)
+
+	proxy := businessLogic.ProxyHandler()
+	get := func(path string, token string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		proxy.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder := get(link.RequestURI(), "")
+	if recorder.Code != http.StatusOK || recorder.Body.String() != content {
+		t.Errorf("Error getting signed link: %d %q\n", recorder.Code, recorder.Body.String())
+	}
+	if code := get(strings.Replace(link.RequestURI(), "/1?", "/2?", 1), "").Code; code != http.StatusForbidden {
+		t.Errorf("Error getting tampered link: expected 403, got %d\n", code)
+	}
+
+	// The manifest token refreshes the links of every page, but doesn't
+	// download files
+	if code := get("/data/signed-binding1/files?start=1", "").Code; code != http.StatusUnauthorized {
+		t.Errorf("Error refreshing links without token: expected 401, got %d\n", code)
+	}
+	recorder = get("/data/signed-binding1/files?start=1", manifestToken)
+	page := logic.Manifest{}
+	json.Unmarshal(recorder.Body.Bytes(), &page)
+	if recorder.Code != http.StatusOK || len(page.Files) != 1 || page.ExpiresAt == "" {
+		t.Fatalf("Error refreshing links: %d %s\n", recorder.Code, recorder.Body.String())
+	}
+	second, _ := url.Parse(page.Files[0].DownloadURL)
+	if recorder = get(second.RequestURI(), ""); recorder.Code != http.StatusOK || recorder.Body.String() != content {
+		t.Errorf("Error getting refreshed link: %d %q\n", recorder.Code, recorder.Body.String())
+	}
+	if code := get("/data/signed-binding1/files/1", manifestToken).Code; code != http.StatusForbidden {
+		t.Errorf("Error downloading with manifest token: expected 403, got %d\n", code)
+	}
+
+	// Bindings to a dataverse aren't signed
+	credentials = bind("signed2", "signed-binding2", testServiceID, testPlanID)
+	proxyToken, _ := credentials["proxy_token"].(string)
+	if proxyToken == "" {
+		t.Errorf("Error in credentials of dataverse binding: expected a proxy token, got %#+v\n", credentials)
+	}
+	manifest = waitForManifest(t, businessLogic, "signed2", "signed-binding2")
+	if manifest.ExpiresAt != "" || len(manifest.Files) == 0 || strings.Contains(manifest.Files[0].DownloadURL, "/signed/") {
+		t.Errorf("Error in manifest of dataverse binding: expected proxy links, got %#+v\n", manifest)
+	}
+
+	businessLogic.Unbind(&osb.UnbindRequest{
+		BindingID:  "signed-binding1",
+		InstanceID: "signed1",
+		ServiceID:  testDatasetServiceID,
+		PlanID:     testDatasetPlanID,
+	}, &broker.RequestContext{})
+
+	if code := get(link.RequestURI(), "").Code; code != http.StatusForbidden {
+		t.Errorf("Error getting link after Unbind: expected 403, got %d\n", code)
+	}
+}
@@ -0,0 +1,159 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	prom "github.com/prometheus/client_golang/prometheus"
+
+	logic "github.com/dataverse-broker/dataverse-broker/pkg/broker"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/metrics"
+	"github.com/pmorie/osb-broker-lib/pkg/rest"
+	"github.com/pmorie/osb-broker-lib/pkg/server"
+)
+
+// newTestRouter serves the broker's OSB API like main does, behind the given
+// authenticating middleware
+func newTestRouter(t *testing.T, businessLogic *logic.BusinessLogic, auth ...mux.MiddlewareFunc) *mux.Router {
+	api, err := rest.NewAPISurface(businessLogic, metrics.New())
+	if err != nil {
+		t.Fatalf("Error creating API surface: %#+v\n", err)
+	}
+	s := server.New(api, prom.NewRegistry())
+	businessLogic.RegisterFetchHandlers(s.Router)
+	businessLogic.RegisterManifestHandlers(s.Router)
+	for _, middleware := range auth {
+		s.Router.Use(middleware)
+	}
+	s.Router.Use(businessLogic.Auditor().Middleware)
+	return s.Router
+}
+
+func callBroker(router http.Handler, method string, path string, version string, body interface{}) *httptest.ResponseRecorder {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	request := httptest.NewRequest(method, path, bytes.NewReader(data))
+	if version != "" {
+		request.Header.Set(osb.APIVersionHeader, version)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// Check which X-Broker-API-Version values are accepted
+func TestValidateBrokerAPIVersion(t *testing.T) {
+
+	versions := map[string]bool{
+		"":     false,
+		"2":    false,
+		"two":  false,
+		"2.x":  false,
+		"1.0":  false,
+		"2.10": false,
+		"2.11": true,
+		"2.12": true,
+		"2.13": true,
+		"2.14": true,
+		"2.15": false,
+		"3.0":  false,
+	}
+
+	businessLogic := &logic.BusinessLogic{}
+
+	for version, supported := range versions {
+		err := businessLogic.ValidateBrokerAPIVersion(version)
+		if supported && err != nil {
+			t.Errorf("Error validating version %q: %#+v\n", version, err)
+		}
+		if !supported {
+			httpErr, ok := osb.IsHTTPError(err)
+			if !ok || httpErr.StatusCode != http.StatusPreconditionFailed {
+				t.Errorf("Error validating version %q: expected 412, got %#+v\n", version, err)
+			}
+		}
+	}
+}
+
+// Check the catalog and fetch endpoints for each supported version
+func TestAPIVersionFeatures(t *testing.T) {
+
+	dataverse := newFakeDataverse(nil)
+	defer dataverse.Close()
+
+	businessLogic, cleanup := newTestBroker(t, dataverse.URL, logic.Options{})
+	defer cleanup()
+
+	router := newTestRouter(t, businessLogic)
+
+	if code := callBroker(router, "GET", "/v2/catalog", "", nil).Code; code != http.StatusPreconditionFailed {
+		t.Errorf("Error on catalog without version: expected 412, got %d\n", code)
+	}
+
+	provision := callBroker(router, "PUT", "/v2/service_instances/version1", "2.14", map[string]interface{}{
+		"service_id": testServiceID,
+		"plan_id":    testPlanID,
+	})
+	if provision.Code != http.StatusCreated {
+		t.Fatalf("Error on Provision: %d %s\n", provision.Code, provision.Body.String())
+	}
+
+	bind := callBroker(router, "PUT", "/v2/service_instances/version1/service_bindings/binding1", "2.14", map[string]interface{}{
+		"service_id": testServiceID,
+		"plan_id":    testPlanID,
+	})
+	if bind.Code != http.StatusCreated {
+		t.Fatalf("Error on Bind: %d %s\n", bind.Code, bind.Body.String())
+	}
+
+	for _, version := range []string{"2.11", "2.12", "2.13", "2.14"} {
+		catalog := callBroker(router, "GET", "/v2/catalog", version, nil)
+		if catalog.Code != http.StatusOK {
+			t.Errorf("Error on catalog with version %s: %d\n", version, catalog.Code)
+			continue
+		}
+		response := osb.CatalogResponse{}
+		json.Unmarshal(catalog.Body.Bytes(), &response)
+		minor, _ := strconv.Atoi(strings.TrimPrefix(version, "2."))
+		hasSchemas := response.Services[0].Plans[0].Schemas != nil
+		if wantSchemas := minor >= 13; hasSchemas != wantSchemas {
+			t.Errorf("Error on catalog with version %s: plan schemas present %v, expected %v\n", version, hasSchemas, wantSchemas)
+		}
+
+		// Every service can be fetched once the fetch endpoints exist
+		services := struct {
+			Services []map[string]interface{} `json:"services"`
+		}{}
+		json.Unmarshal(catalog.Body.Bytes(), &services)
+		for _, service := range services.Services {
+			wantFetch := minor >= 14
+			if (service["bindings_retrievable"] == true) != wantFetch || (service["instances_retrievable"] == true) != wantFetch {
+				t.Errorf("Error on catalog with version %s: service %v retrievable, expected %v\n", version, service["name"], wantFetch)
+			}
+		}
+
+		wantFetch := http.StatusPreconditionFailed
+		if version == "2.14" {
+			wantFetch = http.StatusOK
+		}
+		if code := callBroker(router, "GET", "/v2/service_instances/version1", version, nil).Code; code != wantFetch {
+			t.Errorf("Error fetching instance with version %s: expected %d, got %d\n", version, wantFetch, code)
+		}
+		if code := callBroker(router, "GET", "/v2/service_instances/version1/service_bindings/binding1", version, nil).Code; code != wantFetch {
+			t.Errorf("Error fetching binding with version %s: expected %d, got %d\n", version, wantFetch, code)
+		}
+	}
+
+	if code := callBroker(router, "GET", "/v2/service_instances/not-an-instance", "2.14", nil).Code; code != http.StatusNotFound {
+		t.Errorf("Error fetching missing instance: expected 404, got %d\n", code)
+	}
+}